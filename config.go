@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	mulu "github.com/eliquious/mulu/server"
+)
+
+// Config holds the settings of the mulu binary. Values are read from the
+// optional JSON config file first; flags given on the command line override
+// them.
+type Config struct {
+	Addr       string   `json:"addr"`
+	CacheSize  ByteSize `json:"cache_size"`
+	GOMAXPROCS int      `json:"gomaxprocs"`
+	LogLevel   string   `json:"log_level"`
+
+	// Address of the admin HTTP listener serving /metrics and the admin API,
+	// empty disabling it, and whether it only listens on localhost
+	AdminAddr      string `json:"admin_addr"`
+	AdminLocalhost bool   `json:"admin_localhost"`
+
+	// Password of the AUTH command granting FLUSHALL and FLUSH, empty
+	// disabling them
+	AdminPassword string `json:"admin_password"`
+
+	// Storage engine: freecache or tinylfu
+	Engine string `json:"engine"`
+
+	// Snapshot file loaded on startup and written on shutdown and every
+	// SnapshotInterval, unless it is zero
+	Snapshot         string   `json:"snapshot"`
+	SnapshotInterval Duration `json:"snapshot_interval"`
+
+	// Append-only log replayed on startup, synced always, everysec or never
+	AppendLog   string `json:"append_log"`
+	AppendFsync string `json:"append_fsync"`
+
+	// Address of the primary to replicate, and the size of the ring of writes
+	// kept for replicas of this server, zero disabling them
+	ReplicaOf          string   `json:"replica_of"`
+	ReplicationBacklog ByteSize `json:"replication_backlog"`
+
+	// Number of dummy keyN entries to write on startup, for benchmarking
+	Seed int `json:"seed"`
+}
+
+// DefaultConfig returns the settings used when neither a config file nor
+// flags override them.
+func DefaultConfig() Config {
+	return Config{
+		Addr:           mulu.DefaultAddr,
+		CacheSize:      mulu.DefaultCacheSize,
+		LogLevel:       "info",
+		AdminLocalhost: true,
+		Engine:         mulu.EngineFreecache.String(),
+		AppendFsync:    mulu.FsyncEverySecond.String(),
+	}
+}
+
+// LoadConfig parses the command line arguments, reading the config file named
+// by -config if present. Errors are reported on stderr.
+func LoadConfig(args []string) (config Config, err error) {
+	config = DefaultConfig()
+
+	flags := flag.NewFlagSet("mulu", flag.ContinueOnError)
+	path := flags.String("config", "", "path to a JSON config file")
+	flags.StringVar(&config.Addr, "addr", config.Addr, "listen address")
+	flags.Var(&config.CacheSize, "cache-size", "cache size in bytes, with an optional KB, MB or GB suffix")
+	flags.IntVar(&config.GOMAXPROCS, "gomaxprocs", config.GOMAXPROCS, "maximum number of CPUs, 0 leaves the runtime default")
+	flags.StringVar(&config.LogLevel, "log-level", config.LogLevel, "minimum log level: debug, info, warn, error or none")
+	flags.StringVar(&config.AdminAddr, "admin-addr", config.AdminAddr, "admin HTTP listen address serving /metrics and the admin API, empty to disable")
+	flags.BoolVar(&config.AdminLocalhost, "admin-localhost", config.AdminLocalhost, "bind the admin listener to localhost only")
+	flags.StringVar(&config.AdminPassword, "admin-password", config.AdminPassword, "password of AUTH, required by FLUSHALL and FLUSH, which it enables, and by SYNC and PSYNC; replicas send their own to the primary")
+	flags.StringVar(&config.Engine, "engine", config.Engine, "storage engine: freecache or tinylfu")
+	flags.StringVar(&config.Snapshot, "snapshot", config.Snapshot, "snapshot file loaded on startup and written on shutdown")
+	flags.Var(&config.SnapshotInterval, "snapshot-interval", "interval between snapshots, such as 5m; 0 only saves on shutdown")
+	flags.StringVar(&config.AppendLog, "append-log", config.AppendLog, "append-only log of writes, replayed on startup")
+	flags.StringVar(&config.AppendFsync, "append-fsync", config.AppendFsync, "when to sync the append-only log: always, everysec or never")
+	flags.StringVar(&config.ReplicaOf, "replica-of", config.ReplicaOf, "address of the primary to replicate")
+	flags.Var(&config.ReplicationBacklog, "replication-backlog", "size of the ring of writes kept for replicas, 0 disables serving replicas")
+	flags.IntVar(&config.Seed, "seed", config.Seed, "number of dummy keyN entries to write on startup")
+	if err := flags.Parse(args); err != nil {
+		return config, err
+	}
+
+	// the flag package reports its own errors
+	defer func() {
+		if err != nil {
+			fmt.Fprintln(flags.Output(), err)
+		}
+	}()
+
+	if *path != "" {
+		// Flags set on the command line take precedence over the file
+		explicit := config
+		if err := config.readFile(*path); err != nil {
+			return config, err
+		}
+		flags.Visit(func(f *flag.Flag) {
+			switch f.Name {
+			case "addr":
+				config.Addr = explicit.Addr
+			case "cache-size":
+				config.CacheSize = explicit.CacheSize
+			case "gomaxprocs":
+				config.GOMAXPROCS = explicit.GOMAXPROCS
+			case "log-level":
+				config.LogLevel = explicit.LogLevel
+			case "admin-addr":
+				config.AdminAddr = explicit.AdminAddr
+			case "admin-localhost":
+				config.AdminLocalhost = explicit.AdminLocalhost
+			case "admin-password":
+				config.AdminPassword = explicit.AdminPassword
+			case "engine":
+				config.Engine = explicit.Engine
+			case "snapshot":
+				config.Snapshot = explicit.Snapshot
+			case "snapshot-interval":
+				config.SnapshotInterval = explicit.SnapshotInterval
+			case "append-log":
+				config.AppendLog = explicit.AppendLog
+			case "append-fsync":
+				config.AppendFsync = explicit.AppendFsync
+			case "replica-of":
+				config.ReplicaOf = explicit.ReplicaOf
+			case "replication-backlog":
+				config.ReplicationBacklog = explicit.ReplicationBacklog
+			case "seed":
+				config.Seed = explicit.Seed
+			}
+		})
+	}
+
+	if _, ok := logLevels[config.LogLevel]; !ok {
+		return config, fmt.Errorf("config: Unknown log level %q", config.LogLevel)
+	}
+	if _, err := mulu.ParseEngine(config.Engine); err != nil {
+		return config, err
+	}
+	if _, err := mulu.ParseFsyncPolicy(config.AppendFsync); err != nil {
+		return config, err
+	}
+	return config, nil
+}
+
+func (c *Config) readFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	decoder := json.NewDecoder(f)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(c); err != nil {
+		return fmt.Errorf("config: %s: %s", path, err)
+	}
+	return nil
+}
+
+// ByteSize is a size in bytes which can be written with a KB, MB or GB suffix.
+type ByteSize int
+
+func (b *ByteSize) String() string {
+	return strconv.Itoa(int(*b))
+}
+
+func (b *ByteSize) Set(s string) error {
+	multiplier := 1
+	upper := strings.ToUpper(strings.TrimSpace(s))
+	for _, unit := range []struct {
+		suffix     string
+		multiplier int
+	}{{"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10}, {"B", 1}} {
+		if strings.HasSuffix(upper, unit.suffix) {
+			upper = strings.TrimSpace(strings.TrimSuffix(upper, unit.suffix))
+			multiplier = unit.multiplier
+			break
+		}
+	}
+
+	n, err := strconv.Atoi(upper)
+	if err != nil || n < 0 {
+		return fmt.Errorf("invalid size %q", s)
+	}
+	*b = ByteSize(n * multiplier)
+	return nil
+}
+
+// UnmarshalJSON accepts either a number of bytes or a string with a suffix.
+func (b *ByteSize) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		s = string(data)
+	}
+	return b.Set(s)
+}
+
+// Duration is a time.Duration written as a string such as "30s" or "5m".
+type Duration time.Duration
+
+func (d *Duration) String() string {
+	return time.Duration(*d).String()
+}
+
+func (d *Duration) Set(s string) error {
+	v, err := time.ParseDuration(s)
+	if err != nil || v < 0 {
+		return fmt.Errorf("invalid duration %q", s)
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// UnmarshalJSON accepts either a string such as "5m" or a number of seconds.
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		s = string(data) + "s"
+	}
+	return d.Set(s)
+}
+
+var logLevels = map[string]int{
+	"debug": 0,
+	"info":  1,
+	"warn":  2,
+	"error": 3,
+	"none":  4,
+}
+
+// levelWriter drops log lines below the minimum level. The level of a line is
+// taken from its [DEBUG], [INFO], [WRN] etc. tag; untagged lines are info.
+type levelWriter struct {
+	w     io.Writer
+	level int
+}
+
+func NewLevelWriter(w io.Writer, level string) io.Writer {
+	return &levelWriter{w, logLevels[level]}
+}
+
+func (l *levelWriter) Write(p []byte) (int, error) {
+	if lineLevel(p) < l.level {
+		return len(p), nil
+	}
+	return l.w.Write(p)
+}
+
+func lineLevel(line []byte) int {
+	switch {
+	case bytes.Contains(line, []byte("[DEBUG]")), bytes.Contains(line, []byte("[DBG]")):
+		return logLevels["debug"]
+	case bytes.Contains(line, []byte("[WARN]")), bytes.Contains(line, []byte("[WRN]")):
+		return logLevels["warn"]
+	case bytes.Contains(line, []byte("[ERROR]")), bytes.Contains(line, []byte("[ERR]")):
+		return logLevels["error"]
+	}
+	return logLevels["info"]
+}
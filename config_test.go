@@ -0,0 +1,44 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mulu")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "mulu.json")
+	ioutil.WriteFile(path, []byte(`{"addr": ":1234", "cache_size": "64MB", "log_level": "warn", "seed": 3}`), 0644)
+
+	config, err := LoadConfig([]string{"-config", path, "-seed", "5"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := Config{Addr: ":1234", CacheSize: 64 << 20, LogLevel: "warn", AdminLocalhost: true, Engine: "freecache", AppendFsync: "everysec", Seed: 5}
+	if config != expected {
+		t.Fatalf("expected %+v, got %+v", expected, config)
+	}
+
+	if config, err = LoadConfig(nil); err != nil || config != DefaultConfig() {
+		t.Fatalf("expected defaults, got %+v, %v", config, err)
+	}
+}
+
+func TestByteSize(t *testing.T) {
+	for s, expected := range map[string]ByteSize{"123": 123, "2KB": 2048, "1 gb": 1 << 30, "5B": 5} {
+		var b ByteSize
+		if err := b.Set(s); err != nil || b != expected {
+			t.Errorf("%q: expected %d, got %d (%v)", s, expected, b, err)
+		}
+	}
+	var b ByteSize
+	if b.Set("12XB") == nil || b.Set("-1") == nil {
+		t.Error("invalid sizes accepted")
+	}
+}
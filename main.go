@@ -1,25 +1,76 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"log"
 	"os"
+	"os/signal"
 	"runtime"
+	"syscall"
+	"time"
 
-	"github.com/coocood/freecache"
 	mulu "github.com/eliquious/mulu/server"
+	"golang.org/x/net/context"
 	// "github.com/pkg/profile"
 )
 
 func main() {
-	runtime.GOMAXPROCS(8)
+	config, err := LoadConfig(os.Args[1:])
+	if err == flag.ErrHelp {
+		return
+	} else if err != nil {
+		os.Exit(2)
+	}
+
+	if config.GOMAXPROCS > 0 {
+		runtime.GOMAXPROCS(config.GOMAXPROCS)
+	}
 	// defer profile.Start(profile.MemProfile, profile.ProfilePath(".")).Stop()
 
-	logger := log.New(os.Stdout, "logger: ", log.Lshortfile)
-	cache := freecache.NewCache(512 * 1024 * 1024)
-	for index := 0; index < 128; index++ {
-		cache.Set([]byte(fmt.Sprintf("key%d", index)), []byte("value"), 0)
+	logger := log.New(NewLevelWriter(os.Stdout, config.LogLevel), "logger: ", log.Lshortfile)
+	engine, _ := mulu.ParseEngine(config.Engine)
+	fsync, _ := mulu.ParseFsyncPolicy(config.AppendFsync)
+	server, err := mulu.NewServerWithOptions(mulu.Options{
+		Addr:                   config.Addr,
+		AdminAddr:              config.AdminAddr,
+		AdminLocalhost:         config.AdminLocalhost,
+		AdminPassword:          config.AdminPassword,
+		CacheSize:              int(config.CacheSize),
+		Engine:                 engine,
+		SnapshotPath:           config.Snapshot,
+		SnapshotInterval:       time.Duration(config.SnapshotInterval),
+		AppendLogPath:          config.AppendLog,
+		AppendLogFsync:         fsync,
+		ReplicaOf:              config.ReplicaOf,
+		ReplicationBacklogSize: int(config.ReplicationBacklog),
+		Logger:                 logger,
+	})
+	if err != nil {
+		logger.Fatal(err)
+	}
+
+	// Dummy entries for benchmarking with the bundled clients, logged and
+	// replicated like other writes
+	for index := 0; index < config.Seed; index++ {
+		if err := server.Set([]byte(fmt.Sprintf("key%d", index)), []byte("value"), 0); err != nil {
+			logger.Println("[WRN] Seeding failed", "error", err)
+			break
+		}
+	}
+
+	if err := server.Start(""); err != nil {
+		logger.Fatal(err)
 	}
-	server := mulu.NewServer(cache, logger)
-	server.Start(":9022")
+
+	// Drain connections on SIGINT or SIGTERM
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		server.Stop(ctx)
+	}()
+	server.Wait()
 }
@@ -0,0 +1,356 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+
+	"github.com/coocood/freecache"
+)
+
+// Timeouts of the admin listener, so that slow clients cannot hold its
+// connections open
+const (
+	adminReadTimeout = 30 * time.Second
+	adminIdleTimeout = 2 * time.Minute
+)
+
+// ListenAdmin opens the admin HTTP listener, which serves the Prometheus
+// metrics of the server at /metrics and a JSON API:
+//
+//	GET    /keys/<key>          value and TTL of the key
+//	PUT    /keys/<key>?ttl=<n>  sets the key to the request body
+//	DELETE /keys/<key>          deletes the key
+//	GET    /ttl/<key>           TTL of the key, 0 if it never expires
+//	POST   /clear               removes all entries, with the admin password
+//	POST   /snapshot            writes a snapshot to Options.SnapshotPath
+//	GET    /clients             open connections
+//	GET    /stats               counters of the cache and the server
+//
+// Errors are reported as {"error": "<message>"}. Writes are recorded by the
+// append-only log and sent to replicas, and rejected by replicas. Values
+// larger than the cache can hold are rejected before they are read.
+//
+// Like FLUSHALL, /clear requires Options.AdminPassword, sent as a bearer
+// token, and is disabled without it. The other endpoints, writes to /keys/
+// included, are open to anyone who can reach the listener. With
+// Options.AdminLocalhost, only the port of addr is used and the listener is
+// bound to the loopback interface. It is closed when the server is stopped.
+// This method is non-blocking.
+func (s *Server) ListenAdmin(addr string) error {
+	if addr == "" {
+		return fmt.Errorf("server: Empty admin address")
+	}
+	if s.options.AdminLocalhost {
+		_, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return fmt.Errorf("server: Invalid admin address")
+		}
+		addr = net.JoinHostPort("127.0.0.1", port)
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", s.serveMetrics)
+	mux.HandleFunc("/keys/", s.serveKey)
+	mux.HandleFunc("/ttl/", s.serveTTL)
+	mux.HandleFunc("/clear", s.serveClear)
+	mux.HandleFunc("/snapshot", s.serveSnapshot)
+	mux.HandleFunc("/clients", s.serveClients)
+	mux.HandleFunc("/stats", s.serveStats)
+	admin := &http.Server{
+		Handler:           mux,
+		ErrorLog:          s.logger,
+		ReadHeaderTimeout: adminReadTimeout,
+		ReadTimeout:       adminReadTimeout,
+		IdleTimeout:       adminIdleTimeout,
+	}
+
+	s.mu.Lock()
+	if s.closing {
+		s.mu.Unlock()
+		listener.Close()
+		return fmt.Errorf("server: Server is stopped")
+	} else if s.admin != nil {
+		s.mu.Unlock()
+		listener.Close()
+		return fmt.Errorf("server: Admin listener already open")
+	}
+	s.admin = admin
+	s.adminAddr = listener.Addr().(*net.TCPAddr)
+	s.mu.Unlock()
+	s.logger.Println("Starting admin listener", "addr", addr)
+
+	go func() {
+		if err := admin.Serve(listener); err != nil && err != http.ErrServerClosed {
+			s.logger.Println("[ERR] Admin listener failed", "error", err)
+		}
+	}()
+	return nil
+}
+
+// AdminAddr returns the address of the admin listener, or nil if it is not
+// open.
+func (s *Server) AdminAddr() *net.TCPAddr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.adminAddr
+}
+
+// Set writes an entry to the cache, recording it for the append-only log and
+// replicas. Writing to Cache() directly bypasses both.
+func (s *Server) Set(key, value []byte, expiration int) error {
+	if s.replica != nil {
+		return ErrReplicaWrite
+	}
+	return s.writes.Set(key, value, expiration)
+}
+
+// Clear removes all entries from the cache, recording the removal for the
+// append-only log and replicas.
+func (s *Server) Clear() error {
+	if s.replica != nil {
+		return ErrReplicaWrite
+	}
+	return s.writes.Clear()
+}
+
+// ClientInfo describes an open connection.
+type ClientInfo struct {
+	Addr      string    `json:"addr"`
+	Protocol  string    `json:"protocol"`
+	Connected time.Time `json:"connected"`
+
+	// Bytes read but not yet parsed
+	RingUsed int64 `json:"ring_used"`
+}
+
+// Clients lists the open connections, sorted by address.
+func (s *Server) Clients() []ClientInfo {
+	s.mu.Lock()
+	clients := make([]ClientInfo, 0, len(s.handlers))
+	for h := range s.handlers {
+		clients = append(clients, ClientInfo{
+			Addr:      h.conn.RemoteAddr().String(),
+			Protocol:  h.protocol.String(),
+			Connected: h.connected,
+			RingUsed:  atomic.LoadInt64(&h.committed) - atomic.LoadInt64(&h.consumer.sequence),
+		})
+	}
+	s.mu.Unlock()
+	sort.Slice(clients, func(i, j int) bool { return clients[i].Addr < clients[j].Addr })
+	return clients
+}
+
+// adminEntry is the JSON representation of an entry. Values which are not
+// valid UTF-8 are base64 encoded instead.
+type adminEntry struct {
+	Key         string  `json:"key"`
+	Value       *string `json:"value,omitempty"`
+	ValueBase64 []byte  `json:"value_base64,omitempty"`
+	TTL         uint32  `json:"ttl"`
+}
+
+func (s *Server) serveKey(w http.ResponseWriter, r *http.Request) {
+	key := []byte(strings.TrimPrefix(r.URL.Path, "/keys/"))
+	if len(key) == 0 {
+		writeJSONError(w, http.StatusNotFound, "Missing key")
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		value, err := s.cache.Get(key)
+		if err != nil {
+			writeCacheError(w, err)
+			return
+		}
+		ttl, _ := s.cache.TTL(key)
+		entry := adminEntry{Key: string(key), TTL: ttl}
+		if utf8.Valid(value) {
+			v := string(value)
+			entry.Value = &v
+		} else {
+			entry.ValueBase64 = value
+		}
+		writeJSON(w, http.StatusOK, entry)
+
+	case "PUT":
+		var ttl int
+		if v := r.URL.Query().Get("ttl"); v != "" {
+			var err error
+			if ttl, err = strconv.Atoi(v); err != nil {
+				writeJSONError(w, http.StatusBadRequest, "Invalid key expiration")
+				return
+			}
+		}
+		// The reader only fails at the limit once it returned limit bytes
+		limit := int64(s.cache.MaxEntrySize() - len(key))
+		if limit < 0 {
+			limit = 0
+		}
+		value, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, limit))
+		if err != nil && int64(len(value)) == limit {
+			writeCacheError(w, freecache.ErrLargeEntry)
+			return
+		} else if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if s.replica != nil {
+			writeJSONError(w, http.StatusForbidden, ErrReplicaWrite.Error())
+			return
+		}
+		if err := s.writes.Set(key, value, ttl); err != nil {
+			writeCacheError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]bool{"ok": true})
+
+	case "DELETE":
+		if s.replica != nil {
+			writeJSONError(w, http.StatusForbidden, ErrReplicaWrite.Error())
+			return
+		}
+		ok, err := s.writes.Del(key)
+		if err != nil {
+			writeCacheError(w, err)
+			return
+		} else if !ok {
+			writeCacheError(w, freecache.ErrNotFound)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]bool{"ok": true})
+
+	default:
+		w.Header().Set("Allow", "GET, PUT, DELETE")
+		writeJSONError(w, http.StatusMethodNotAllowed, "Method not allowed")
+	}
+}
+
+func (s *Server) serveTTL(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, "GET") {
+		return
+	}
+	key := strings.TrimPrefix(r.URL.Path, "/ttl/")
+	ttl, err := s.cache.TTL([]byte(key))
+	if err != nil {
+		writeCacheError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"key": key, "ttl": ttl})
+}
+
+func (s *Server) serveClear(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, "POST") || !s.authorizeAdmin(w, r) {
+		return
+	}
+	if err := s.Clear(); err == ErrReplicaWrite {
+		writeJSONError(w, http.StatusForbidden, err.Error())
+		return
+	} else if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]bool{"ok": true})
+}
+
+func (s *Server) serveSnapshot(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, "POST") {
+		return
+	}
+	if err := s.Snapshot(); err == ErrNoSnapshotPath {
+		writeJSONError(w, http.StatusConflict, err.Error())
+		return
+	} else if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	status := s.SnapshotStatus()
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"ok":       true,
+		"entries":  status.Entries,
+		"duration": status.Duration.Seconds(),
+	})
+}
+
+func (s *Server) serveClients(w http.ResponseWriter, r *http.Request) {
+	if allowMethod(w, r, "GET") {
+		writeJSON(w, http.StatusOK, s.Clients())
+	}
+}
+
+func (s *Server) serveStats(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, "GET") {
+		return
+	}
+	cache := s.cache.Stats()
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"uptime":   int64(time.Since(startTime).Seconds()),
+		"cache":    cache,
+		"hit_rate": cache.HitRate(),
+		"server":   s.Stats(),
+	})
+}
+
+// authorizeAdmin responds with 401 Unauthorized unless the request carries
+// the admin password as a bearer token, or 403 Forbidden if there is none.
+func (s *Server) authorizeAdmin(w http.ResponseWriter, r *http.Request) bool {
+	if s.options.AdminPassword == "" {
+		writeJSONError(w, http.StatusForbidden, "Admin password is not configured")
+		return false
+	}
+	header := r.Header.Get("Authorization")
+	token := strings.TrimPrefix(header, "Bearer ")
+	if token == header || subtle.ConstantTimeCompare([]byte(token), []byte(s.options.AdminPassword)) != 1 {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeJSONError(w, http.StatusUnauthorized, "Invalid password")
+		return false
+	}
+	return true
+}
+
+// allowMethod responds with 405 Method Not Allowed unless the request uses
+// the given method.
+func allowMethod(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method == method {
+		return true
+	}
+	w.Header().Set("Allow", method)
+	writeJSONError(w, http.StatusMethodNotAllowed, "Method not allowed")
+	return false
+}
+
+// writeCacheError responds to a failed cache operation.
+func writeCacheError(w http.ResponseWriter, err error) {
+	switch err {
+	case freecache.ErrNotFound:
+		writeJSONError(w, http.StatusNotFound, "Entry not found")
+	case freecache.ErrLargeKey, freecache.ErrLargeEntry:
+		writeJSONError(w, http.StatusRequestEntityTooLarge, err.Error())
+	default:
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+	}
+}
+
+func writeJSONError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
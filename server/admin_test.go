@@ -0,0 +1,204 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// adminRequest sends a request to the admin API and decodes the JSON response.
+func adminRequest(t *testing.T, server *Server, method, path, body string, v interface{}) int {
+	return adminRequestWithPassword(t, server, method, path, body, "", v)
+}
+
+// adminRequestWithPassword sends the password as a bearer token, unless it is
+// empty.
+func adminRequestWithPassword(t *testing.T, server *Server, method, path, body, password string, v interface{}) int {
+	req, err := http.NewRequest(method, "http://"+server.AdminAddr().String()+path, bytes.NewBufferString(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if password != "" {
+		req.Header.Set("Authorization", "Bearer "+password)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.Header.Get("Content-Type") != "application/json" {
+		t.Fatalf("%s %s: unexpected content type %q", method, path, resp.Header.Get("Content-Type"))
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		t.Fatalf("%s %s: %v", method, path, err)
+	}
+	return resp.StatusCode
+}
+
+func TestAdminAPI(t *testing.T) {
+	path, cleanup := tempLogPath(t)
+	defer cleanup()
+	server, err := NewServerWithOptions(Options{
+		CacheSize:      1024 * 1024,
+		AdminAddr:      "0.0.0.0:0",
+		AdminLocalhost: true,
+		AdminPassword:  "secret",
+		SnapshotPath:   filepath.Join(filepath.Dir(path), "mulu.snapshot"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := server.Start("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop(context.Background())
+	if !server.AdminAddr().IP.IsLoopback() {
+		t.Fatalf("expected the admin listener on localhost, got %v", server.AdminAddr())
+	}
+
+	var result map[string]interface{}
+	if status := adminRequest(t, server, "PUT", "/keys/some%2Fkey?ttl=100", "value", &result); status != http.StatusOK {
+		t.Fatalf("PUT: unexpected response %d %v", status, result)
+	}
+	var entry adminEntry
+	if status := adminRequest(t, server, "GET", "/keys/some%2Fkey", "", &entry); status != http.StatusOK {
+		t.Fatalf("GET: unexpected status %d", status)
+	}
+	if entry.Key != "some/key" || entry.Value == nil || *entry.Value != "value" || entry.TTL < 99 || entry.TTL > 100 {
+		t.Fatalf("unexpected entry %+v", entry)
+	}
+	server.Cache().Set([]byte("binary"), []byte{0xff, 0}, 0)
+	entry = adminEntry{}
+	adminRequest(t, server, "GET", "/keys/binary", "", &entry)
+	if entry.Value != nil || !bytes.Equal(entry.ValueBase64, []byte{0xff, 0}) {
+		t.Fatalf("expected a base64 value, got %+v", entry)
+	}
+
+	var ttl struct {
+		Key string
+		TTL uint32
+	}
+	if status := adminRequest(t, server, "GET", "/ttl/binary", "", &ttl); status != http.StatusOK || ttl.Key != "binary" || ttl.TTL != 0 {
+		t.Fatalf("unexpected TTL %d %+v", status, ttl)
+	}
+
+	result = nil
+	if status := adminRequest(t, server, "PUT", "/keys/key?ttl=soon", "value", &result); status != http.StatusBadRequest || result["error"] == nil {
+		t.Fatalf("expected a bad request, got %d %v", status, result)
+	}
+	if status := adminRequest(t, server, "PUT", "/keys/large", string(make([]byte, 2048)), &result); status != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected the entry to be too large, got %d %v", status, result)
+	}
+	if status := adminRequest(t, server, "PUT", "/keys/large", string(make([]byte, 1000)), &result); status != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected the entry to be rejected by the cache, got %d %v", status, result)
+	}
+	if status := adminRequest(t, server, "DELETE", "/keys/binary", "", &result); status != http.StatusOK {
+		t.Fatalf("DELETE: unexpected status %d", status)
+	}
+	for _, path := range []string{"/keys/binary", "/ttl/binary"} {
+		if status := adminRequest(t, server, "GET", path, "", &result); status != http.StatusNotFound {
+			t.Fatalf("%s: expected not found, got %d", path, status)
+		}
+	}
+	if status := adminRequest(t, server, "DELETE", "/keys/binary", "", &result); status != http.StatusNotFound {
+		t.Fatalf("expected not found, got %d", status)
+	}
+	if status := adminRequest(t, server, "GET", "/clear", "", &result); status != http.StatusMethodNotAllowed {
+		t.Fatalf("expected method not allowed, got %d", status)
+	}
+
+	// the connection is listed until it is closed
+	conn, err := net.Dial("tcp", server.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write([]byte("GET some/key\r\n"))
+	conn.Read(make([]byte, 64))
+	var clients []ClientInfo
+	adminRequest(t, server, "GET", "/clients", "", &clients)
+	if len(clients) != 1 || clients[0].Addr != conn.LocalAddr().String() || clients[0].Protocol != "mulu" || clients[0].Connected.IsZero() {
+		t.Fatalf("unexpected clients %+v", clients)
+	}
+	conn.Close()
+
+	var stats struct {
+		Cache  StoreStats
+		Server ServerStats
+	}
+	if status := adminRequest(t, server, "GET", "/stats", "", &stats); status != http.StatusOK {
+		t.Fatalf("unexpected status %d", status)
+	}
+	if stats.Cache.Entries != 1 || stats.Server.TotalConnections != 1 || stats.Server.Commands["GET"] != 1 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+
+	if status := adminRequest(t, server, "POST", "/snapshot", "", &result); status != http.StatusOK || result["entries"] != 1.0 {
+		t.Fatalf("unexpected snapshot response %d %v", status, result)
+	}
+	for _, password := range []string{"", "wrong"} {
+		if status := adminRequestWithPassword(t, server, "POST", "/clear", "", password, &result); status != http.StatusUnauthorized {
+			t.Fatalf("expected %q to be unauthorized, got %d", password, status)
+		}
+	}
+	if entries := server.Cache().Stats().Entries; entries != 1 {
+		t.Fatalf("expected the entries to be kept, got %d", entries)
+	}
+	if status := adminRequestWithPassword(t, server, "POST", "/clear", "", "secret", &result); status != http.StatusOK {
+		t.Fatalf("unexpected clear status %d", status)
+	}
+	if entries := server.Cache().Stats().Entries; entries != 0 {
+		t.Fatalf("expected no entries after clearing, got %d", entries)
+	}
+}
+
+func TestAdminAPIValueLimit(t *testing.T) {
+	logger := log.New(ioutil.Discard, "logger: ", log.Lshortfile)
+	server := NewServer(NewTinyLFUStore(4*1024*1024), logger)
+	if err := server.ListenAdmin("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop(context.Background())
+
+	// the limit is the one of the store, not of Options.CacheSize
+	var result map[string]interface{}
+	limit := server.Cache().MaxEntrySize() - len("key")
+	if status := adminRequest(t, server, "PUT", "/keys/key", strings.Repeat("x", limit), &result); status != http.StatusOK {
+		t.Fatalf("expected %d bytes to be accepted, got %d %v", limit, status, result)
+	}
+	if status := adminRequest(t, server, "PUT", "/keys/key", strings.Repeat("x", limit+1), &result); status != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected %d bytes to be too large, got %d %v", limit+1, status, result)
+	}
+}
+
+func TestAdminAPISnapshotDisabled(t *testing.T) {
+	logger := log.New(ioutil.Discard, "logger: ", log.Lshortfile)
+	server := NewServer(NewFreecacheStore(0), logger)
+	if err := server.ListenAdmin("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop(context.Background())
+	if err := server.ListenAdmin("127.0.0.1:0"); err == nil {
+		t.Fatal("expected a second admin listener to be rejected")
+	}
+	if server.admin.ReadHeaderTimeout == 0 || server.admin.ReadTimeout == 0 || server.admin.IdleTimeout == 0 {
+		t.Fatal("expected the admin listener to time out slow clients")
+	}
+
+	var result map[string]string
+	if status := adminRequest(t, server, "POST", "/snapshot", "", &result); status != http.StatusConflict || result["error"] != ErrNoSnapshotPath.Error() {
+		t.Fatalf("expected a conflict, got %d %v", status, result)
+	}
+	if status := adminRequestWithPassword(t, server, "POST", "/clear", "", "secret", &result); status != http.StatusForbidden {
+		t.Fatalf("expected clearing to be disabled, got %d %v", status, result)
+	}
+}
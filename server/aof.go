@@ -0,0 +1,455 @@
+package server
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// Append-only log layout, all integers big-endian:
+//
+//	header  "MULULOG" uint16(version)
+//	record  uint32(CRC-32C of the rest) byte(op) uint32(key length) uint32(value length) uint32(expire at) key value
+//
+// The op sets or deletes the key, or clears the cache, in which case the key
+// and value are empty.
+// Expiration times are absolute unix seconds, 0 meaning the entry never
+// expires. Records are checksummed individually so a record torn by a crash
+// is detected and dropped on replay.
+const (
+	AppendLogMagic   = "MULULOG"
+	AppendLogVersion = 1
+)
+
+const (
+	appendLogSet   byte = 1
+	appendLogDel   byte = 2
+	appendLogClear byte = 3
+
+	appendLogHeaderSize = len(AppendLogMagic) + 2
+	appendLogRecordSize = 17
+)
+
+// Logs are compacted once they have doubled in size since the last rewrite
+// and are larger than AppendLogRewriteMinSize.
+const AppendLogRewriteMinSize = 64 * 1024 * 1024
+
+var (
+	ErrAppendLogFormat = errors.New("log: Invalid file format")
+	ErrAppendLogClosed = errors.New("log: Log is closed")
+	ErrNoAppendLog     = errors.New("log: No append-only log configured")
+)
+
+// FsyncPolicy determines when the append-only log is flushed to disk.
+type FsyncPolicy int
+
+const (
+	// FsyncEverySecond syncs the log once per second, so an operating system
+	// crash loses at most the last second of writes.
+	FsyncEverySecond FsyncPolicy = iota
+
+	// FsyncAlways syncs the log before every write is acknowledged.
+	FsyncAlways
+
+	// FsyncNever leaves flushing the log to the operating system.
+	FsyncNever
+)
+
+func (f FsyncPolicy) String() string {
+	switch f {
+	case FsyncEverySecond:
+		return "everysec"
+	case FsyncAlways:
+		return "always"
+	case FsyncNever:
+		return "never"
+	}
+	return "unknown"
+}
+
+// ParseFsyncPolicy parses "always", "everysec" or "never".
+func ParseFsyncPolicy(s string) (FsyncPolicy, error) {
+	for _, policy := range []FsyncPolicy{FsyncEverySecond, FsyncAlways, FsyncNever} {
+		if s == policy.String() {
+			return policy, nil
+		}
+	}
+	return 0, fmt.Errorf("log: Unknown fsync policy %q", s)
+}
+
+// AppendLog applies writes to a cache and records them in an append-only log,
+// which is replayed into the cache when it is opened again. Writes are applied
+// and logged under a single lock, so the log order matches the cache.
+type AppendLog struct {
+	cache  Store
+	path   string
+	policy FsyncPolicy
+	logger *log.Logger
+
+	mu     sync.Mutex
+	f      *os.File
+	buf    []byte
+	size   int64
+	dirty  bool
+	closed bool
+
+	// size after the last rewrite, and the records written while a rewrite
+	// is in progress
+	base       int64
+	rewriting  bool
+	rewriteBuf []byte
+}
+
+// OpenAppendLog replays the log at path into the cache and opens it for
+// appending, creating it if necessary. A torn record at the end of the log is
+// truncated.
+func OpenAppendLog(path string, cache Store, policy FsyncPolicy, logger *log.Logger) (l *AppendLog, replayed int, err error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	replayed, size, err := replayAppendLog(f, cache)
+	if err == io.ErrUnexpectedEOF {
+		logger.Println("[WRN] Truncating torn append-only log", "path", path, "offset", size)
+		err = f.Truncate(size)
+	}
+	if err == nil && size == 0 {
+		err = writeAppendLogHeader(f)
+		size = int64(appendLogHeaderSize)
+	}
+	if err == nil {
+		_, err = f.Seek(size, io.SeekStart)
+	}
+	if err != nil {
+		f.Close()
+		return nil, replayed, err
+	}
+
+	l = &AppendLog{
+		cache:  cache,
+		path:   path,
+		policy: policy,
+		logger: logger,
+		f:      f,
+		size:   size,
+		base:   size,
+	}
+	return l, replayed, nil
+}
+
+func writeAppendLogHeader(w io.Writer) error {
+	var header [appendLogHeaderSize]byte
+	copy(header[:], AppendLogMagic)
+	binary.BigEndian.PutUint16(header[len(AppendLogMagic):], AppendLogVersion)
+	_, err := w.Write(header[:])
+	return err
+}
+
+// replayAppendLog applies the records of the log to the cache. It returns the
+// size of the valid part of the log, and io.ErrUnexpectedEOF if the log ends
+// with an incomplete or corrupt record.
+func replayAppendLog(r io.Reader, cache Store) (replayed int, size int64, err error) {
+	br := bufio.NewReader(r)
+	var header [appendLogHeaderSize]byte
+	if _, err := io.ReadFull(br, header[:]); err == io.EOF {
+		return 0, 0, nil
+	} else if err != nil {
+		// a torn header is rewritten
+		return 0, 0, io.ErrUnexpectedEOF
+	} else if string(header[:len(AppendLogMagic)]) != AppendLogMagic {
+		return 0, 0, ErrAppendLogFormat
+	} else if binary.BigEndian.Uint16(header[len(AppendLogMagic):]) != AppendLogVersion {
+		return 0, 0, ErrAppendLogFormat
+	}
+	size = int64(len(header))
+
+	var record [appendLogRecordSize]byte
+	var data []byte
+	for {
+		if _, err = io.ReadFull(br, record[:]); err == io.EOF {
+			return replayed, size, nil
+		} else if err != nil {
+			return replayed, size, io.ErrUnexpectedEOF
+		}
+		keyLen := int(binary.BigEndian.Uint32(record[5:]))
+		valueLen := int(binary.BigEndian.Uint32(record[9:]))
+		if keyLen > 65535 || valueLen < 0 || keyLen+valueLen < 0 {
+			return replayed, size, io.ErrUnexpectedEOF
+		}
+		if cap(data) < keyLen+valueLen {
+			data = make([]byte, keyLen+valueLen)
+		}
+		data = data[:keyLen+valueLen]
+		if _, err = io.ReadFull(br, data); err != nil {
+			return replayed, size, io.ErrUnexpectedEOF
+		}
+
+		crc := crc32.Update(crc32.Checksum(record[4:], snapshotTable), snapshotTable, data)
+		if crc != binary.BigEndian.Uint32(record[:]) {
+			return replayed, size, io.ErrUnexpectedEOF
+		}
+
+		key, value := data[:keyLen], data[keyLen:]
+		if record[4] != appendLogSet && record[4] != appendLogDel && record[4] != appendLogClear {
+			return replayed, size, io.ErrUnexpectedEOF
+		}
+		if err := applyRecord(directWriter{cache}, record[4], key, value, binary.BigEndian.Uint32(record[13:])); err != nil {
+			return replayed, size, err
+		}
+		size += int64(len(record) + len(data))
+		replayed++
+	}
+}
+
+// appendRecord encodes a record at the end of buf.
+func appendRecord(buf []byte, op byte, key, value []byte, expireAt uint32) []byte {
+	offset := len(buf)
+	var record [appendLogRecordSize]byte
+	record[4] = op
+	binary.BigEndian.PutUint32(record[5:], uint32(len(key)))
+	binary.BigEndian.PutUint32(record[9:], uint32(len(value)))
+	binary.BigEndian.PutUint32(record[13:], expireAt)
+	buf = append(buf, record[:]...)
+	buf = append(buf, key...)
+	buf = append(buf, value...)
+	binary.BigEndian.PutUint32(buf[offset:], crc32.Checksum(buf[offset+4:], snapshotTable))
+	return buf
+}
+
+// Set stores the entry in the cache and logs it. The returned error is either
+// a cache error, in which case nothing is logged, or a log error.
+func (l *AppendLog) Set(key, value []byte, expiration int) error {
+	var expireAt uint32
+	if expiration > 0 {
+		expireAt = uint32(time.Now().Unix()) + uint32(expiration)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.cache.Set(key, value, expiration); err != nil {
+		return err
+	}
+	return l.append(appendLogSet, key, value, expireAt)
+}
+
+// Del deletes the entry from the cache and logs the deletion if it existed.
+func (l *AppendLog) Del(key []byte) (affected bool, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.cache.Del(key) {
+		return false, nil
+	}
+	return true, l.append(appendLogDel, key, nil, 0)
+}
+
+// Update applies the update to the cache and logs the updated entry.
+func (l *AppendLog) Update(key []byte, fn UpdateFunc) (found, updated bool, err error) {
+	var entry updatedEntry
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	found, updated, err = l.cache.Update(key, entry.wrap(fn))
+	if err != nil || !updated {
+		return found, updated, err
+	}
+	return found, true, l.append(appendLogSet, key, entry.value, entry.expireAt)
+}
+
+// CompareAndSwap replaces the entry if its version matches and logs the new
+// entry.
+func (l *AppendLog) CompareAndSwap(key []byte, version uint64, value []byte, expiration int) (found, swapped bool, err error) {
+	expireAt := absoluteExpiration(expiration)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	found, swapped, err = l.cache.CompareAndSwap(key, version, value, expiration)
+	if err != nil || !swapped {
+		return found, swapped, err
+	}
+	return found, true, l.append(appendLogSet, key, value, expireAt)
+}
+
+// Clear removes all entries from the cache and logs the removal.
+func (l *AppendLog) Clear() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.cache.Clear()
+	return l.append(appendLogClear, nil, nil, 0)
+}
+
+// append must be called with the lock held.
+func (l *AppendLog) append(op byte, key, value []byte, expireAt uint32) error {
+	if l.closed {
+		return ErrAppendLogClosed
+	}
+	l.buf = appendRecord(l.buf[:0], op, key, value, expireAt)
+	if l.rewriting {
+		l.rewriteBuf = append(l.rewriteBuf, l.buf...)
+	}
+
+	n, err := l.f.Write(l.buf)
+	l.size += int64(n)
+	if err != nil {
+		return err
+	}
+	if l.policy == FsyncAlways {
+		return l.f.Sync()
+	}
+	l.dirty = true
+	return nil
+}
+
+// Size returns the current size of the log in bytes.
+func (l *AppendLog) Size() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.size
+}
+
+// Rewrite compacts the log by replacing it with the live entries of the
+// cache. Writes are not blocked while the entries are written; the ones made
+// in the meantime are appended to the new log before it replaces the old one.
+func (l *AppendLog) Rewrite() error {
+	l.mu.Lock()
+	if l.rewriting {
+		l.mu.Unlock()
+		return fmt.Errorf("log: Rewrite already in progress")
+	}
+	l.rewriting = true
+	l.rewriteBuf = l.rewriteBuf[:0]
+	l.mu.Unlock()
+
+	start := time.Now()
+	f, size, err := l.writeEntries()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.rewriting = false
+	if err == nil && l.closed {
+		err = ErrAppendLogClosed
+	}
+	if err == nil {
+		var n int
+		n, err = f.Write(l.rewriteBuf)
+		size += int64(n)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), l.path)
+	}
+	if err != nil {
+		if f != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+		l.logger.Println("[ERR] Append-only log rewrite failed", "path", l.path, "error", err)
+		return err
+	}
+	if d, e := os.Open(filepath.Dir(l.path)); e == nil {
+		d.Sync()
+		d.Close()
+	}
+
+	l.f.Close()
+	l.f = f
+	l.logger.Println("[INFO] Rewrote append-only log", "path", l.path, "before", l.size, "after", size, "duration", time.Since(start))
+	l.size, l.base = size, size
+	l.dirty = false
+	if cap(l.rewriteBuf) > 1024*1024 {
+		l.rewriteBuf = nil
+	}
+	return nil
+}
+
+// writeEntries writes the live entries of the cache to a new temporary log.
+func (l *AppendLog) writeEntries() (*os.File, int64, error) {
+	dir, name := filepath.Split(l.path)
+	if dir == "" {
+		dir = "."
+	}
+	f, err := ioutil.TempFile(dir, name+".tmp")
+	if err != nil {
+		return nil, 0, err
+	}
+	fail := func(err error) (*os.File, int64, error) {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, 0, err
+	}
+
+	w := bufio.NewWriter(f)
+	if err := writeAppendLogHeader(w); err != nil {
+		return fail(err)
+	}
+	size := int64(appendLogHeaderSize)
+	var buf []byte
+	l.cache.Iterate(func(key, value []byte, expireAt uint32) bool {
+		buf = appendRecord(buf[:0], appendLogSet, key, value, expireAt)
+		if _, err = w.Write(buf); err != nil {
+			return false
+		}
+		size += int64(len(buf))
+		return true
+	})
+	if err != nil {
+		return fail(err)
+	}
+	if err := w.Flush(); err != nil {
+		return fail(err)
+	}
+	return f, size, nil
+}
+
+// run syncs the log every second under FsyncEverySecond and rewrites it when
+// it has grown too large, until ctx is done.
+func (l *AppendLog) run(ctx context.Context) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		l.mu.Lock()
+		f, dirty := l.f, l.dirty && l.policy == FsyncEverySecond
+		l.dirty = false
+		rewrite := !l.rewriting && l.size > AppendLogRewriteMinSize && l.size > 2*l.base
+		l.mu.Unlock()
+
+		if dirty {
+			f.Sync()
+		}
+		if rewrite {
+			go l.Rewrite()
+		}
+	}
+}
+
+// Close syncs and closes the log.
+func (l *AppendLog) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return nil
+	}
+	l.closed = true
+	if err := l.f.Sync(); err != nil {
+		l.f.Close()
+		return err
+	}
+	return l.f.Close()
+}
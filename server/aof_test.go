@@ -0,0 +1,293 @@
+package server
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/coocood/freecache"
+	"golang.org/x/net/context"
+)
+
+func tempLogPath(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "mulu")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filepath.Join(dir, "mulu.log"), func() { os.RemoveAll(dir) }
+}
+
+func TestAppendLogReplay(t *testing.T) {
+	path, cleanup := tempLogPath(t)
+	defer cleanup()
+	logger := log.New(ioutil.Discard, "", 0)
+
+	cache := NewFreecacheStore(1024 * 1024)
+	l, replayed, err := OpenAppendLog(path, cache, FsyncAlways, logger)
+	if err != nil || replayed != 0 {
+		t.Fatalf("expected an empty log, got %d (%v)", replayed, err)
+	}
+
+	// Entries written before a clear are not restored
+	l.Set([]byte("cleared"), []byte("0"), 0)
+	if err := l.Clear(); err != nil {
+		t.Fatal(err)
+	}
+	l.Set([]byte("a"), []byte("1"), 0)
+	l.Set([]byte("b"), []byte("2"), 100)
+	l.Set([]byte("c"), []byte("3"), 0)
+	if ok, err := l.Del([]byte("a")); !ok || err != nil {
+		t.Fatalf("expected delete, got %v (%v)", ok, err)
+	}
+	if ok, _ := l.Del([]byte("missing")); ok {
+		t.Fatal("deleted a missing key")
+	}
+
+	// Updates are logged as sets of the updated entry
+	keep := func(value []byte, expireAt uint32, found bool) ([]byte, int, bool) {
+		return value, 200, found
+	}
+	if found, updated, err := l.Update([]byte("b"), keep); !found || !updated || err != nil {
+		t.Fatalf("expected an update, got %v %v (%v)", found, updated, err)
+	}
+	if found, _, _ := l.Update([]byte("missing"), keep); found {
+		t.Fatal("updated a missing key")
+	}
+
+	// An expired write removes the previous value
+	l.mu.Lock()
+	l.append(appendLogSet, []byte("c"), []byte("4"), uint32(time.Now().Unix()-10))
+	l.mu.Unlock()
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Set([]byte("d"), []byte("5"), 0); err != ErrAppendLogClosed {
+		t.Fatalf("expected closed error, got %v", err)
+	}
+
+	restored := NewFreecacheStore(1024 * 1024)
+	l, replayed, err = OpenAppendLog(path, restored, FsyncNever, logger)
+	if err != nil || replayed != 8 {
+		t.Fatalf("expected 8 records, got %d (%v)", replayed, err)
+	}
+	defer l.Close()
+	if _, err := restored.Get([]byte("cleared")); err != freecache.ErrNotFound {
+		t.Error("cleared key was restored")
+	}
+	if _, err := restored.Get([]byte("a")); err != freecache.ErrNotFound {
+		t.Error("deleted key was restored")
+	}
+	if _, err := restored.Get([]byte("c")); err != freecache.ErrNotFound {
+		t.Error("expired key was restored")
+	}
+	if value, err := restored.Get([]byte("b")); err != nil || string(value) != "2" {
+		t.Errorf("expected %q, got %q (%v)", "2", value, err)
+	}
+	if ttl, _ := restored.TTL([]byte("b")); ttl < 198 || ttl > 200 {
+		t.Errorf("expected the updated TTL, got %d", ttl)
+	}
+}
+
+func TestAppendLogTornRecord(t *testing.T) {
+	path, cleanup := tempLogPath(t)
+	defer cleanup()
+	logger := log.New(ioutil.Discard, "", 0)
+
+	l, _, err := OpenAppendLog(path, NewFreecacheStore(1024*1024), FsyncAlways, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Set([]byte("key"), []byte("value"), 0)
+	size := l.Size()
+	l.Close()
+
+	// Simulate a crash in the middle of a write
+	record := appendRecord(nil, appendLogSet, []byte("other"), []byte("value"), 0)
+	f, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	f.Write(record[:len(record)-2])
+	f.Close()
+
+	cache := NewFreecacheStore(1024 * 1024)
+	l, replayed, err := OpenAppendLog(path, cache, FsyncAlways, logger)
+	if err != nil || replayed != 1 {
+		t.Fatalf("expected 1 record, got %d (%v)", replayed, err)
+	}
+	if l.Size() != size {
+		t.Fatalf("expected the torn record to be truncated to %d, got %d", size, l.Size())
+	}
+	l.Set([]byte("other"), []byte("value"), 0)
+	l.Close()
+
+	l, replayed, err = OpenAppendLog(path, NewFreecacheStore(1024*1024), FsyncAlways, logger)
+	if err != nil || replayed != 2 {
+		t.Fatalf("expected 2 records, got %d (%v)", replayed, err)
+	}
+	l.Close()
+
+	ioutil.WriteFile(path, []byte("MULUSNAP\x00\x01"), 0644)
+	if _, _, err := OpenAppendLog(path, NewFreecacheStore(1024*1024), FsyncAlways, logger); err != ErrAppendLogFormat {
+		t.Fatalf("expected format error, got %v", err)
+	}
+}
+
+func TestAppendLogRewrite(t *testing.T) {
+	path, cleanup := tempLogPath(t)
+	defer cleanup()
+	logger := log.New(ioutil.Discard, "", 0)
+
+	cache := NewFreecacheStore(1024 * 1024)
+	l, _, err := OpenAppendLog(path, cache, FsyncNever, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		l.Set([]byte("key"), []byte("value"), 0)
+	}
+	l.Set([]byte("deleted"), []byte("value"), 0)
+	l.Del([]byte("deleted"))
+	before := l.Size()
+
+	if err := l.Rewrite(); err != nil {
+		t.Fatal(err)
+	}
+	if l.Size() >= before {
+		t.Fatalf("expected the log to shrink from %d, got %d", before, l.Size())
+	}
+	l.Set([]byte("after"), []byte("rewrite"), 0)
+	l.Close()
+
+	if files, _ := ioutil.ReadDir(filepath.Dir(path)); len(files) != 1 {
+		t.Fatalf("expected only the log file, got %d files", len(files))
+	}
+
+	restored := NewFreecacheStore(1024 * 1024)
+	l, replayed, err := OpenAppendLog(path, restored, FsyncNever, logger)
+	if err != nil || replayed != 2 {
+		t.Fatalf("expected 2 records, got %d (%v)", replayed, err)
+	}
+	l.Close()
+	for key, expected := range map[string]string{"key": "value", "after": "rewrite"} {
+		if value, err := restored.Get([]byte(key)); err != nil || string(value) != expected {
+			t.Errorf("%s: expected %q, got %q (%v)", key, expected, value, err)
+		}
+	}
+}
+
+func TestAppendLogRewriteConcurrentWrites(t *testing.T) {
+	path, cleanup := tempLogPath(t)
+	defer cleanup()
+	logger := log.New(ioutil.Discard, "", 0)
+
+	cache := NewFreecacheStore(4 * 1024 * 1024)
+	l, _, err := OpenAppendLog(path, cache, FsyncNever, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 1000; i++ {
+		l.Set([]byte(strconv.Itoa(i)), []byte("before"), 0)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 1000; i++ {
+			if i%3 == 0 {
+				l.Del([]byte(strconv.Itoa(i)))
+			} else {
+				l.Set([]byte(strconv.Itoa(i)), []byte("after"), 0)
+			}
+		}
+	}()
+	if err := l.Rewrite(); err != nil {
+		t.Fatal(err)
+	}
+	<-done
+	l.Close()
+
+	restored := NewFreecacheStore(4 * 1024 * 1024)
+	l, _, err = OpenAppendLog(path, restored, FsyncNever, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+	if restored.Stats().Entries != cache.Stats().Entries {
+		t.Fatalf("expected %d entries, got %d", cache.Stats().Entries, restored.Stats().Entries)
+	}
+	for i := 0; i < 1000; i++ {
+		expected, _ := cache.Get([]byte(strconv.Itoa(i)))
+		if value, _ := restored.Get([]byte(strconv.Itoa(i))); !bytes.Equal(value, expected) {
+			t.Fatalf("%d: expected %q, got %q", i, expected, value)
+		}
+	}
+}
+
+func TestServerAppendLog(t *testing.T) {
+	path, cleanup := tempLogPath(t)
+	defer cleanup()
+	snapshot := filepath.Join(filepath.Dir(path), "mulu.snapshot")
+	logger := log.New(ioutil.Discard, "", 0)
+
+	// A new log starts from the snapshot
+	cache := NewFreecacheStore(1024 * 1024)
+	cache.Set([]byte("snapshot"), []byte("value"), 0)
+	if _, err := SaveSnapshot(snapshot, cache); err != nil {
+		t.Fatal(err)
+	}
+	options := Options{CacheSize: 1024 * 1024, SnapshotPath: snapshot, AppendLogPath: path, Logger: logger}
+	server, err := NewServerWithOptions(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	parser := server.newParser(ProtocolMulu)(&buf)
+	for _, line := range []string{"SET key 0 value", "SET other 0 value", "DEL other"} {
+		if !parser.Parse([]byte(line)) {
+			t.Fatalf("%q failed: %q", line, buf.String())
+		}
+	}
+
+	// writes over the other protocols are logged as well
+	resp := server.newParser(ProtocolRESP)(&buf)
+	for _, line := range []string{"SET redis value", "SET expired value", "EXPIRE expired 0"} {
+		if !resp.Parse([]byte(line)) {
+			t.Fatalf("%q failed: %q", line, buf.String())
+		}
+	}
+	memcache := server.newParser(ProtocolMemcache)(&buf)
+	if !memcache.Parse([]byte("set memcache 0 0 5")) || !memcache.ParsePayload([]byte("value\r\n")) || !memcache.Parse([]byte("touch memcache 100")) {
+		t.Fatalf("memcache set failed: %q", buf.String())
+	}
+	if err := server.Set([]byte("seed"), []byte("value"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := server.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// The log alone restores the entries loaded from the snapshot
+	os.Remove(snapshot)
+	server, err = NewServerWithOptions(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop(context.Background())
+	for key, expected := range map[string]string{"snapshot": "value", "key": "value", "redis": "value", "memcache": "\x00\x00\x00\x00value", "seed": "value"} {
+		if value, err := server.Cache().Get([]byte(key)); err != nil || string(value) != expected {
+			t.Errorf("%s: expected %q, got %q (%v)", key, expected, value, err)
+		}
+	}
+	for _, key := range []string{"other", "expired"} {
+		if _, err := server.Cache().Get([]byte(key)); err != freecache.ErrNotFound {
+			t.Errorf("deleted key %s was restored", key)
+		}
+	}
+	if ttl, _ := server.Cache().TTL([]byte("memcache")); ttl < 98 || ttl > 100 {
+		t.Errorf("expected the touched TTL, got %d", ttl)
+	}
+}
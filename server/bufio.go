@@ -17,25 +17,16 @@ type FixedSizeWriter struct {
 	offset int
 }
 
+// Write buffers p, or writes it along with the buffered bytes if it does not
+// fit. Like io.Writer, it returns the number of bytes of p written.
 func (f *FixedSizeWriter) Write(p []byte) (n int, err error) {
 	if len(p) > len(f.buffer) || len(p) >= f.Available() {
-		if f.offset > 0 {
-			written, e := f.writer.Write(f.buffer[:f.offset])
-			if e != nil {
-				return written, e
-			}
-			n += written
+		if err = f.Flush(); err != nil {
+			return 0, err
 		}
 
 		// write new content
-		written, e := f.writer.Write(p)
-		n += written
-		if e != nil {
-			return n, e
-		}
-
-		f.Reset()
-		return n, e
+		return f.writer.Write(p)
 	}
 
 	n = copy(f.buffer[f.offset:], p)
@@ -0,0 +1,725 @@
+package server
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/coocood/freecache"
+)
+
+var ErrInvalidArgs = []byte("-ERRPARSE Wrong number of arguments\r\n")
+
+// Responses of the snapshot commands
+var ErrSnapshotDisabled = []byte("-ERRSNAPSHOT Snapshots are not enabled\r\n")
+var ErrSnapshotInProgress = []byte("-ERRSNAPSHOT Snapshot already in progress\r\n")
+var ErrSnapshotFailed = []byte("-ERRSNAPSHOT Snapshot failed\r\n")
+var LastSavePrefix = []byte("+LASTSAVE ")
+var ErrLogDisabled = []byte("-ERRLOG Append-only log is not enabled\r\n")
+
+var TTLPrefix = []byte("+TTL ")
+
+// Responses of the version token commands
+var GetsPrefix = []byte("+GETS ")
+var ErrExists = []byte("-ERREXISTS Entry was modified since GETS\r\n")
+var ErrInvalidToken = []byte("-ERRINVTOKEN Invalid version token\r\n")
+
+// Responses of ADD and REPLACE when they do not store the value
+var ErrNotAdded = []byte("-ERRNOTSTORED Entry already exists\r\n")
+var ErrNotReplaced = []byte("-ERRNOTSTORED Entry not found\r\n")
+
+var MissPrefix = []byte("+MISS ")
+
+// Responses of AUTH and the commands requiring the admin permission
+var ErrAuthDisabled = []byte("-ERRAUTH Admin password is not configured\r\n")
+var ErrInvalidPassword = []byte("-ERRAUTH Invalid password\r\n")
+var ErrNoPermission = []byte("-ERRNOPERM Admin permission required\r\n")
+var FlushedPrefix = []byte("+FLUSHED ")
+
+// Responses of the counter commands
+var IntPrefix = []byte("+INT ")
+var ErrNotInteger = []byte("-ERRNOTINT Value is not a 64-bit integer\r\n")
+var ErrOverflow = []byte("-ERROVERFLOW Increment would overflow\r\n")
+var ErrInvalidIncrement = []byte("-ERRINVINCR Invalid increment\r\n")
+
+// command handles a request which is not one of the GET, SET and DEL fast
+// paths. args holds the words following the command name.
+type command func(p *Parser, args [][]byte) bool
+
+var commands map[string]command
+
+func init() {
+	commands = map[string]command{
+		"SAVE":     (*Parser).save,
+		"BGSAVE":   (*Parser).bgsave,
+		"LASTSAVE": (*Parser).lastsave,
+
+		"REWRITELOG": (*Parser).rewritelog,
+
+		"STATS": (*Parser).stats,
+
+		"TTL":     (*Parser).ttl,
+		"EXPIRE":  (*Parser).expire,
+		"PERSIST": (*Parser).persist,
+		"TOUCH":   (*Parser).touch,
+
+		"INCR":   (*Parser).incr,
+		"DECR":   (*Parser).decr,
+		"INCRBY": (*Parser).incrby,
+
+		"GETS": (*Parser).gets,
+		"CAS":  (*Parser).cas,
+
+		"MGET": (*Parser).mget,
+		"MSET": (*Parser).mset,
+		"SCAN": (*Parser).scan,
+
+		"ADD":     (*Parser).add,
+		"REPLACE": (*Parser).replace,
+
+		"AUTH":     (*Parser).auth,
+		"FLUSHALL": (*Parser).flushall,
+		"FLUSH":    (*Parser).flush,
+
+		"SYNC":        (*Parser).sync,
+		"PSYNC":       (*Parser).psync,
+		"ROLE":        (*Parser).role,
+		"REPLICAINFO": (*Parser).replicainfo,
+	}
+}
+
+// command splits the line into words and runs the command named by the first.
+func (p *Parser) command(line []byte) bool {
+	p.args = p.args[:0]
+	for i := 0; i < len(line); {
+		for i < len(line) && (line[i] == ' ' || line[i] == '\t') {
+			i++
+		}
+		offset := i
+		for i < len(line) && line[i] != ' ' && line[i] != '\t' {
+			i++
+		}
+		if i > offset {
+			p.args = append(p.args, line[offset:i])
+		}
+	}
+	if len(p.args) == 0 {
+		return p.fail(ErrEmptyRequest, line)
+	}
+
+	p.line = line
+	name := strings.ToUpper(string(p.args[0]))
+	cmd, ok := commands[name]
+	if !ok {
+		return p.fail(ErrUnknownCmd, line)
+	}
+	p.cmd = name
+	return cmd(p, p.args[1:])
+}
+
+// fail writes an error response.
+func (p *Parser) fail(err []byte, line []byte) bool {
+	p.err = err
+	p.counters.parseError(err)
+	p.writer.Write(err)
+	p.logger.Printf("%s (%s)\r\n", string(err), strconv.Quote(string(line)))
+	return false
+}
+
+// SAVE writes a snapshot and responds once it is complete.
+func (p *Parser) save(args [][]byte) bool {
+	if len(args) != 0 {
+		return p.fail(ErrInvalidArgs, nil)
+	}
+	if p.snapshots == nil {
+		return p.fail(ErrSnapshotDisabled, nil)
+	}
+	// the snapshotter logs the cause
+	if err := p.snapshots.Save(); err != nil {
+		return p.fail(ErrSnapshotFailed, nil)
+	}
+	_, err := p.writer.Write(OKResponse)
+	return err == nil
+}
+
+// BGSAVE starts writing a snapshot and responds immediately.
+func (p *Parser) bgsave(args [][]byte) bool {
+	if len(args) != 0 {
+		return p.fail(ErrInvalidArgs, nil)
+	}
+	if p.snapshots == nil {
+		return p.fail(ErrSnapshotDisabled, nil)
+	}
+	if !p.snapshots.BackgroundSave() {
+		return p.fail(ErrSnapshotInProgress, nil)
+	}
+	_, err := p.writer.Write(OKResponse)
+	return err == nil
+}
+
+// LASTSAVE reports the last snapshot:
+//
+//	+LASTSAVE <unix time> <duration in milliseconds> <entries> <ok|failed|pending>
+//
+// The time is 0 if no snapshot was written yet.
+func (p *Parser) lastsave(args [][]byte) bool {
+	if len(args) != 0 {
+		return p.fail(ErrInvalidArgs, nil)
+	}
+	if p.snapshots == nil {
+		return p.fail(ErrSnapshotDisabled, nil)
+	}
+
+	status := p.snapshots.Status()
+	var unix int64
+	if !status.LastSave.IsZero() {
+		unix = status.LastSave.Unix()
+	}
+	state := "ok"
+	if status.InProgress {
+		state = "pending"
+	} else if status.Err != nil {
+		state = "failed"
+	}
+
+	p.scratch = append(p.scratch[:0], LastSavePrefix...)
+	p.scratch = strconv.AppendInt(p.scratch, unix, 10)
+	p.scratch = append(p.scratch, ' ')
+	p.scratch = strconv.AppendInt(p.scratch, int64(status.Duration/1e6), 10)
+	p.scratch = append(p.scratch, ' ')
+	p.scratch = strconv.AppendInt(p.scratch, int64(status.Entries), 10)
+	p.scratch = append(p.scratch, ' ')
+	p.scratch = append(p.scratch, state...)
+	p.scratch = append(p.scratch, CRLF...)
+	_, err := p.writer.Write(p.scratch)
+	return err == nil
+}
+
+// REWRITELOG starts compacting the append-only log and responds immediately.
+func (p *Parser) rewritelog(args [][]byte) bool {
+	if len(args) != 0 {
+		return p.fail(ErrInvalidArgs, nil)
+	}
+	if p.aof == nil {
+		return p.fail(ErrLogDisabled, nil)
+	}
+	go p.aof.Rewrite()
+	_, err := p.writer.Write(OKResponse)
+	return err == nil
+}
+
+// TTL reports the seconds left before the key expires, 0 if it never expires:
+//
+//	+TTL <seconds>
+func (p *Parser) ttl(args [][]byte) bool {
+	if len(args) != 1 {
+		return p.fail(ErrInvalidArgs, nil)
+	}
+	ttl, err := p.cache.TTL(args[0])
+	if err == freecache.ErrNotFound {
+		return p.fail(ErrNotFound, args[0])
+	} else if err != nil {
+		return p.fail(ErrUnknownCache, args[0])
+	}
+	p.scratch = append(p.scratch[:0], TTLPrefix...)
+	p.scratch = strconv.AppendUint(p.scratch, uint64(ttl), 10)
+	p.scratch = append(p.scratch, CRLF...)
+	_, err = p.writer.Write(p.scratch)
+	return err == nil
+}
+
+// EXPIRE sets the seconds left before the key expires. As in Redis, timeouts
+// which are not positive delete the key.
+func (p *Parser) expire(args [][]byte) bool {
+	if len(args) != 2 {
+		return p.fail(ErrInvalidArgs, nil)
+	}
+	seconds, err := strconv.Atoi(string(args[1]))
+	if err != nil {
+		return p.fail(ErrInvalidExpiration, args[1])
+	}
+	if seconds <= 0 {
+		return p.del(args[0], args[0])
+	}
+	return p.setExpiration(args[0], seconds)
+}
+
+// PERSIST removes the expiration of the key.
+func (p *Parser) persist(args [][]byte) bool {
+	if len(args) != 1 {
+		return p.fail(ErrInvalidArgs, nil)
+	}
+	return p.setExpiration(args[0], 0)
+}
+
+// TOUCH replaces the expiration of the key with one given as for SET, so 0
+// means it never expires.
+func (p *Parser) touch(args [][]byte) bool {
+	if len(args) != 2 {
+		return p.fail(ErrInvalidArgs, nil)
+	}
+	seconds, err := strconv.Atoi(string(args[1]))
+	if err != nil {
+		return p.fail(ErrInvalidExpiration, args[1])
+	}
+	return p.setExpiration(args[0], seconds)
+}
+
+// setExpiration replaces the expiration of the key, keeping its value.
+func (p *Parser) setExpiration(key []byte, expiration int) bool {
+	if p.replica != nil {
+		return p.fail(ErrReadOnly, key)
+	}
+	found, _, err := p.update(key, func(value []byte, expireAt uint32, found bool) ([]byte, int, bool) {
+		return value, expiration, found
+	})
+	if err != nil {
+		return p.writeError(err, key)
+	} else if !found {
+		return p.fail(ErrNotFound, key)
+	}
+	_, err = p.writer.Write(OKResponse)
+	return err == nil
+}
+
+// INCR adds one to the decimal integer stored at the key and responds with the
+// result:
+//
+//	+INT <value>
+//
+// Missing keys count from 0 and never expire; existing keys keep their TTL.
+func (p *Parser) incr(args [][]byte) bool {
+	if len(args) != 1 {
+		return p.fail(ErrInvalidArgs, nil)
+	}
+	return p.increment(args[0], 1)
+}
+
+// DECR subtracts one from the integer stored at the key, like INCR.
+func (p *Parser) decr(args [][]byte) bool {
+	if len(args) != 1 {
+		return p.fail(ErrInvalidArgs, nil)
+	}
+	return p.increment(args[0], -1)
+}
+
+// INCRBY adds a possibly negative increment to the integer stored at the key,
+// like INCR.
+func (p *Parser) incrby(args [][]byte) bool {
+	if len(args) != 2 {
+		return p.fail(ErrInvalidArgs, nil)
+	}
+	delta, err := strconv.ParseInt(string(args[1]), 10, 64)
+	if err != nil {
+		return p.fail(ErrInvalidIncrement, args[1])
+	}
+	return p.increment(args[0], delta)
+}
+
+// increment atomically adds delta to the counter stored at the key.
+func (p *Parser) increment(key []byte, delta int64) bool {
+	if p.replica != nil {
+		return p.fail(ErrReadOnly, key)
+	}
+
+	var counter int64
+	var failure []byte
+	_, _, err := p.update(key, func(value []byte, expireAt uint32, found bool) ([]byte, int, bool) {
+		failure = nil
+		var n int64
+		if found {
+			var err error
+			if n, err = strconv.ParseInt(string(value), 10, 64); err != nil {
+				failure = ErrNotInteger
+				return nil, 0, false
+			}
+		}
+		if (delta > 0 && n > math.MaxInt64-delta) || (delta < 0 && n < math.MinInt64-delta) {
+			failure = ErrOverflow
+			return nil, 0, false
+		}
+		expiration, ok := remaining(expireAt)
+		if !ok {
+			// expiring right now; 0 would make it permanent
+			expiration = 1
+		}
+		counter = n + delta
+		return strconv.AppendInt(nil, counter, 10), expiration, true
+	})
+	if err != nil {
+		return p.writeError(err, key)
+	} else if failure != nil {
+		return p.fail(failure, key)
+	}
+
+	p.scratch = append(p.scratch[:0], IntPrefix...)
+	p.scratch = strconv.AppendInt(p.scratch, counter, 10)
+	p.scratch = append(p.scratch, CRLF...)
+	_, err = p.writer.Write(p.scratch)
+	return err == nil
+}
+
+// GETS responds with the value of the key and its version token:
+//
+//	+GETS <token> <value>
+//	+GETS <token> <length>\r\n<bytes>       with LengthFraming
+func (p *Parser) gets(args [][]byte) bool {
+	if len(args) != 1 {
+		return p.fail(ErrInvalidArgs, nil)
+	}
+	v, version, err := p.cache.GetWithVersion(args[0])
+	if err == freecache.ErrNotFound {
+		return p.fail(ErrNotFound, args[0])
+	} else if err != nil {
+		return p.fail(ErrUnknownCache, args[0])
+	}
+
+	p.scratch = append(p.scratch[:0], GetsPrefix...)
+	p.scratch = strconv.AppendUint(p.scratch, version, 10)
+	p.scratch = append(p.scratch, ' ')
+	if p.framing == LengthFraming {
+		p.scratch = strconv.AppendInt(p.scratch, int64(len(v)), 10)
+		p.scratch = append(p.scratch, CRLF...)
+	}
+	if _, err := p.writer.Write(p.scratch); err != nil {
+		return false
+	}
+	if _, err := p.writer.Write(v); err != nil {
+		return false
+	}
+	_, err = p.writer.Write(CRLF)
+	return err == nil
+}
+
+// CAS <key> <token> <ttl> <value> sets the key only if its version token still
+// matches the one returned by GETS, responding with ErrExists otherwise.
+func (p *Parser) cas(args [][]byte) bool {
+	if len(args) < 3 {
+		return p.fail(ErrInvalidArgs, nil)
+	}
+	token, err := strconv.ParseUint(string(args[1]), 10, 64)
+	if err != nil {
+		return p.fail(ErrInvalidToken, args[1])
+	}
+	p.token = token
+	return p.storeCommand(args, 2, (*Parser).compareAndSet)
+}
+
+// storeCommand completes a request whose expiration is args[ttl] and whose
+// value follows it, either up to the end of the line or length-prefixed.
+func (p *Parser) storeCommand(args [][]byte, ttl int, store storeFunc) bool {
+	if len(args) < ttl+1 {
+		return p.fail(ErrInvalidArgs, nil)
+	}
+	expiration, err := strconv.Atoi(string(args[ttl]))
+	if err != nil {
+		return p.fail(ErrInvalidExpiration, args[ttl])
+	}
+
+	if p.framing == LengthFraming {
+		if len(args) != ttl+2 {
+			return p.fail(ErrInvalidArgs, nil)
+		}
+		return p.expectValue(args[0], args[ttl+1], expiration, store, p.line)
+	}
+
+	// as for SET, the value is the rest of the line after a single separator;
+	// the words are slices of the line, so their capacity gives their offset
+	end := cap(p.line) - cap(args[ttl]) + len(args[ttl])
+	if end >= len(p.line) {
+		return p.fail(ErrIncompleteCmd, p.line)
+	}
+	return store(p, args[0], p.line[end+1:], expiration, p.line)
+}
+
+func (p *Parser) compareAndSet(key, value []byte, expiration int, line []byte) bool {
+	if p.replica != nil {
+		return p.fail(ErrReadOnly, line)
+	}
+	var found, swapped bool
+	var err error
+	if p.writes != nil {
+		found, swapped, err = p.writes.CompareAndSwap(key, p.token, value, expiration)
+	} else {
+		found, swapped, err = p.cache.CompareAndSwap(key, p.token, value, expiration)
+	}
+	if err != nil {
+		return p.writeError(err, line)
+	} else if !found {
+		return p.fail(ErrNotFound, line)
+	} else if !swapped {
+		return p.fail(ErrExists, line)
+	}
+	_, err = p.writer.Write(OKResponse)
+	return err == nil
+}
+
+// ADD <key> <ttl> <value> sets the key only if it does not exist.
+func (p *Parser) add(args [][]byte) bool {
+	return p.storeCommand(args, 1, (*Parser).addValue)
+}
+
+// REPLACE <key> <ttl> <value> sets the key only if it exists.
+func (p *Parser) replace(args [][]byte) bool {
+	return p.storeCommand(args, 1, (*Parser).replaceValue)
+}
+
+func (p *Parser) addValue(key, value []byte, expiration int, line []byte) bool {
+	return p.setIf(false, key, value, expiration, line)
+}
+
+func (p *Parser) replaceValue(key, value []byte, expiration int, line []byte) bool {
+	return p.setIf(true, key, value, expiration, line)
+}
+
+// setIf atomically sets the key if its existence matches exists.
+func (p *Parser) setIf(exists bool, key, value []byte, expiration int, line []byte) bool {
+	if p.replica != nil {
+		return p.fail(ErrReadOnly, line)
+	}
+	_, updated, err := p.update(key, func(current []byte, expireAt uint32, found bool) ([]byte, int, bool) {
+		return value, expiration, found == exists
+	})
+	if err != nil {
+		return p.writeError(err, line)
+	} else if !updated && exists {
+		return p.fail(ErrNotReplaced, line)
+	} else if !updated {
+		return p.fail(ErrNotAdded, line)
+	}
+	_, err = p.writer.Write(OKResponse)
+	return err == nil
+}
+
+// MGET <key> [<key> ...] responds with a line for each key, in order, followed
+// by +END. The lines are indexed by the position of the key in the request:
+//
+//	+VALUE <index> <value>
+//	+VALUE <index> <length>\r\n<bytes>     with LengthFraming
+//	+MISS <index>
+func (p *Parser) mget(args [][]byte) bool {
+	if len(args) == 0 {
+		return p.fail(ErrInvalidArgs, nil)
+	}
+	for i, key := range args {
+		v, err := p.cache.Get(key)
+		if err != nil {
+			p.scratch = append(p.scratch[:0], MissPrefix...)
+			p.scratch = strconv.AppendInt(p.scratch, int64(i), 10)
+			p.scratch = append(p.scratch, CRLF...)
+			if _, err := p.writer.Write(p.scratch); err != nil {
+				return false
+			}
+			continue
+		}
+
+		p.scratch = append(p.scratch[:0], ValuePrefix...)
+		p.scratch = strconv.AppendInt(p.scratch, int64(i), 10)
+		p.scratch = append(p.scratch, ' ')
+		if p.framing == LengthFraming {
+			p.scratch = strconv.AppendInt(p.scratch, int64(len(v)), 10)
+			p.scratch = append(p.scratch, CRLF...)
+		}
+		if _, err := p.writer.Write(p.scratch); err != nil {
+			return false
+		}
+		if _, err := p.writer.Write(v); err != nil {
+			return false
+		}
+		if _, err := p.writer.Write(CRLF); err != nil {
+			return false
+		}
+	}
+	_, err := p.writer.Write(EndResponse)
+	return err == nil
+}
+
+// msetEntry is a pending length-prefixed MSET value. The key is kept in
+// keybuf, since the payload overwrites the request buffer.
+type msetEntry struct {
+	keyStart, keyEnd int
+	expiration       int
+	length           int
+}
+
+// MSET <key> <ttl> <value> [<key> <ttl> <value> ...] sets each key in turn and
+// responds with the response of SET to each triple, followed by +END. The
+// values cannot contain spaces, unless they are sent with LengthFraming:
+//
+//	MSET <key> <ttl> <length> ...\r\n<bytes>\r\n...
+//
+// The whole request is rejected if any triple is malformed.
+func (p *Parser) mset(args [][]byte) bool {
+	if len(args) == 0 || len(args)%3 != 0 {
+		return p.fail(ErrInvalidArgs, nil)
+	} else if p.replica != nil {
+		return p.fail(ErrReadOnly, p.line)
+	}
+
+	p.msets = p.msets[:0]
+	p.keybuf = p.keybuf[:0]
+	expect := 0
+	for i := 0; i < len(args); i += 3 {
+		expiration, err := strconv.Atoi(string(args[i+1]))
+		if err != nil {
+			return p.fail(ErrInvalidExpiration, args[i+1])
+		}
+		entry := msetEntry{keyStart: len(p.keybuf), expiration: expiration}
+		if p.framing == LengthFraming {
+			entry.length, err = strconv.Atoi(string(args[i+2]))
+			if err != nil || entry.length < 0 {
+				return p.fail(ErrInvalidLength, p.line)
+			}
+			expect += entry.length + len(CRLF)
+			p.keybuf = append(p.keybuf, args[i]...)
+			entry.keyEnd = len(p.keybuf)
+		}
+		p.msets = append(p.msets, entry)
+	}
+
+	if p.framing == LengthFraming {
+		// ParsePayload strips the CRLF following the last value, and logs
+		// errors with the first key
+		p.key = p.keybuf[:p.msets[0].keyEnd]
+		p.store = (*Parser).msetValues
+		p.expect = expect
+		return true
+	}
+
+	ok := true
+	for i, entry := range p.msets {
+		ok = p.set(args[3*i], args[3*i+2], entry.expiration, p.line) && ok
+	}
+	_, err := p.writer.Write(EndResponse)
+	return ok && err == nil
+}
+
+// msetValues splits the payload of a length-prefixed MSET into its values,
+// which are only stored once the whole payload is known to be well framed.
+func (p *Parser) msetValues(_, payload []byte, _ int, line []byte) bool {
+	size := 0
+	for _, entry := range p.msets {
+		size += entry.length + len(CRLF)
+	}
+	if size != len(payload)+len(CRLF) {
+		return p.fail(ErrInvalidValueDelimiter, line)
+	}
+	for offset, i := 0, 0; i < len(p.msets)-1; i++ {
+		offset += p.msets[i].length
+		if !bytes.Equal(payload[offset:offset+len(CRLF)], CRLF) {
+			return p.fail(ErrInvalidValueDelimiter, line)
+		}
+		offset += len(CRLF)
+	}
+
+	ok := true
+	for _, entry := range p.msets {
+		key := p.keybuf[entry.keyStart:entry.keyEnd]
+		ok = p.set(key, payload[:entry.length], entry.expiration, line) && ok
+		if len(payload) > entry.length {
+			payload = payload[entry.length+len(CRLF):]
+		}
+	}
+	_, err := p.writer.Write(EndResponse)
+	return ok && err == nil
+}
+
+// AUTH <password> grants the admin permission to the connection if the
+// password matches Options.AdminPassword.
+func (p *Parser) auth(args [][]byte) bool {
+	if len(args) != 1 {
+		return p.fail(ErrInvalidArgs, nil)
+	} else if p.password == "" {
+		return p.fail(ErrAuthDisabled, nil)
+	}
+	p.admin = subtle.ConstantTimeCompare(args[0], []byte(p.password)) == 1
+	if !p.admin {
+		return p.fail(ErrInvalidPassword, nil)
+	}
+	_, err := p.writer.Write(OKResponse)
+	return err == nil
+}
+
+// authorize checks that the connection may run admin commands and write to
+// the cache.
+func (p *Parser) authorize() bool {
+	if !p.admin {
+		return p.fail(ErrNoPermission, p.line)
+	} else if p.replica != nil {
+		return p.fail(ErrReadOnly, p.line)
+	}
+	return true
+}
+
+// authorizeReplication checks that the connection may copy the cache, which
+// requires the admin permission if a password is configured.
+func (p *Parser) authorizeReplication() bool {
+	if p.password != "" && !p.admin {
+		return p.fail(ErrNoPermission, p.line)
+	}
+	return true
+}
+
+// FLUSHALL removes all entries.
+func (p *Parser) flushall(args [][]byte) bool {
+	if len(args) != 0 {
+		return p.fail(ErrInvalidArgs, nil)
+	} else if !p.authorize() {
+		return false
+	}
+
+	if p.writes != nil {
+		if err := p.writes.Clear(); err != nil {
+			return p.fail(ErrLogWrite, p.line)
+		}
+	} else {
+		p.cache.Clear()
+	}
+	_, err := p.writer.Write(OKResponse)
+	return err == nil
+}
+
+// FLUSH <prefix> deletes the keys starting with prefix and responds with
+// +FLUSHED <count>. Keys written during the command may be left in place.
+func (p *Parser) flush(args [][]byte) bool {
+	if len(args) != 1 {
+		return p.fail(ErrInvalidArgs, nil)
+	} else if !p.authorize() {
+		return false
+	}
+
+	// the keys are deleted once the iteration is over, since deleting them
+	// while iterating could skip others
+	prefix := args[0]
+	var keys [][]byte
+	p.cache.Iterate(func(key, value []byte, expireAt uint32) bool {
+		if bytes.HasPrefix(key, prefix) {
+			keys = append(keys, append([]byte(nil), key...))
+		}
+		return true
+	})
+
+	deleted := 0
+	for _, key := range keys {
+		var ok bool
+		if p.writes != nil {
+			var err error
+			if ok, err = p.writes.Del(key); err != nil {
+				return p.fail(ErrLogWrite, p.line)
+			}
+		} else {
+			ok = p.cache.Del(key)
+		}
+		if ok {
+			deleted++
+		}
+	}
+
+	p.scratch = append(p.scratch[:0], FlushedPrefix...)
+	p.scratch = strconv.AppendInt(p.scratch, int64(deleted), 10)
+	p.scratch = append(p.scratch, CRLF...)
+	_, err := p.writer.Write(p.scratch)
+	return err == nil
+}
@@ -4,59 +4,163 @@ import (
 	"io"
 	"log"
 	"net"
+	"sync"
+	"sync/atomic"
+	"time"
 
-	"github.com/coocood/freecache"
 	disruptor "github.com/smartystreets/go-disruptor"
 	"golang.org/x/net/context"
 )
 
-const RingBufferCapacity = 4 * 1024 * 1024
+// Default size of the per-connection ring buffer
+const RingBufferCapacity = 256 * 1024
 const RingBufferMask = RingBufferCapacity - 1
 
-func NewTcpHandler(cache *freecache.Cache, conn net.Conn, logger *log.Logger, ctx context.Context) *tcpHandler {
-	ring := [RingBufferCapacity]byte{}
-	w := NewFixedSizeWriter(conn, 1024*1024)
+// NewTcpHandler creates the handler of a connection. Its ring, read and write
+// buffers are taken from pools, which may be nil, and returned once the
+// connection is closed. The bytes read and written are counted in stats,
+// which may be nil as well.
+func NewTcpHandler(cache Store, conn net.Conn, ctx context.Context, newParser func(io.Writer) RequestParser, options Options, pools *handlerPools, stats *serverStats) *tcpHandler {
+	if pools == nil {
+		pools = newHandlerPools(options)
+	}
+	ring := pools.ring.Get()
+	w := &FixedSizeWriter{deadlineWriter{conn, options.WriteTimeout, stats}, pools.write.Get(), 0}
+	consumer := NewByteConsumer(w, conn, newParser(w), ring, options.MaxRequestSize, options.Logger)
 	controller := disruptor.
-		Configure(RingBufferCapacity).
-		WithConsumerGroup(&ByteConsumer{
-		Writer: w,
-		Closer: conn,
-		Parser: &Parser{logger: logger, writer: w, cache: cache},
-		ring:   &ring,
-		cache:  cache,
-		logger: logger,
-	}).Build()
+		Configure(int64(len(ring))).
+		WithConsumerGroup(consumer).
+		Build()
 	controller.Start()
 
 	c, cancel := context.WithCancel(ctx)
-	return &tcpHandler{cache,
-		logger, conn, &ring, &controller, c, cancel,
+	return &tcpHandler{
+		cache:       cache,
+		logger:      options.Logger,
+		conn:        conn,
+		ring:        ring,
+		mask:        int64(len(ring) - 1),
+		writer:      w,
+		readBuffer:  pools.read.Get(),
+		readTimeout: options.ReadTimeout,
+		pools:       pools,
+		stats:       stats,
+		consumer:    consumer,
+		controller:  &controller,
+		context:     c,
+		cancel:      cancel,
+		committed:   -1,
+		readDone:    make(chan struct{}),
+		killed:      make(chan struct{}),
 	}
 }
 
+// deadlineWriter fails writes which block for longer than the timeout.
+type deadlineWriter struct {
+	conn    net.Conn
+	timeout time.Duration
+	stats   *serverStats
+}
+
+func (d deadlineWriter) Write(p []byte) (int, error) {
+	if d.timeout > 0 {
+		d.conn.SetWriteDeadline(time.Now().Add(d.timeout))
+	}
+	n, err := d.conn.Write(p)
+	d.stats.written(n)
+	return n, err
+}
+
 type tcpHandler struct {
-	cache      *freecache.Cache
+	cache      Store
 	logger     *log.Logger
 	conn       net.Conn
-	ring       *[RingBufferCapacity]byte
+	ring       []byte
+	mask       int64
+	consumer   *ByteConsumer
 	controller *disruptor.Disruptor
 	context    context.Context
 	cancel     context.CancelFunc
+
+	writer      *FixedSizeWriter
+	readBuffer  []byte
+	readTimeout time.Duration
+	pools       *handlerPools
+	stats       *serverStats
+
+	// set by the listener which accepted the connection
+	protocol  Protocol
+	connected time.Time
+
+	// last sequence published by the read loop, updated atomically
+	committed int64
+	readDone  chan struct{}
+
+	killed   chan struct{}
+	killOnce sync.Once
 }
 
+// Execute serves the connection until the client disconnects or the server is
+// stopped. Requests which were already read are processed and their responses
+// flushed before the connection is closed.
 func (t *tcpHandler) Execute() {
 	defer t.conn.Close()
-	defer t.controller.Stop()
 
 	// Read from connection
 	go t.createReadLoop()
 	<-t.context.Done()
+
+	// Stop reading and let the consumer catch up with the ring
+	t.conn.SetReadDeadline(time.Now())
+	<-t.readDone
+	drained := t.drain()
+	t.controller.Stop()
+
+	// The buffers can only be reused once the consumer is done with them
+	if drained {
+		t.pools.ring.Put(t.ring)
+		t.pools.read.Put(t.readBuffer)
+		t.pools.write.Put(t.writer.buffer)
+	}
+}
+
+// discard releases a handler which is not executed because the server is
+// stopping.
+func (t *tcpHandler) discard() {
+	t.cancel()
+	t.controller.Stop()
+	t.conn.Close()
+	t.pools.ring.Put(t.ring)
+	t.pools.read.Put(t.readBuffer)
+	t.pools.write.Put(t.writer.buffer)
+}
+
+// drain waits until the consumer has processed every committed sequence. It
+// returns false if the connection is killed first.
+func (t *tcpHandler) drain() bool {
+	for atomic.LoadInt64(&t.consumer.sequence) < atomic.LoadInt64(&t.committed) {
+		select {
+		case <-t.killed:
+			return false
+		case <-time.After(time.Millisecond):
+		}
+	}
+	return true
+}
+
+// kill closes the connection without waiting for pending requests.
+func (t *tcpHandler) kill() {
+	t.killOnce.Do(func() {
+		close(t.killed)
+		t.conn.Close()
+	})
 }
 
 func (t *tcpHandler) createReadLoop() {
+	defer close(t.readDone)
 	defer t.cancel()
 	writer := t.controller.Writer()
-	buffer := make([]byte, 1024*1024)
+	buffer := t.readBuffer
 	var sequence, reservations int64
 	var idx int
 	for {
@@ -64,20 +168,33 @@ func (t *tcpHandler) createReadLoop() {
 		case <-t.context.Done():
 			return
 		default:
+			// Execute sets an immediate deadline after cancelling the
+			// context, so check again once the idle deadline is set.
+			if t.readTimeout > 0 {
+				t.conn.SetReadDeadline(time.Now().Add(t.readTimeout))
+				if t.context.Err() != nil {
+					return
+				}
+			}
+
 			n, err := t.conn.Read(buffer)
-			if n > 0 {
-				idx = 0
-				reservations = int64(n)
+			t.stats.read(n)
+
+			// reservations cannot exceed the ring capacity
+			for idx = 0; idx < n; {
+				reservations = int64(n - idx)
+				if reservations > int64(len(t.ring)) {
+					reservations = int64(len(t.ring))
+				}
 				sequence = writer.Reserve(reservations)
 				for lower := sequence - reservations + 1; lower <= sequence; lower++ {
-					t.ring[lower&RingBufferMask] = buffer[idx]
+					t.ring[lower&t.mask] = buffer[idx]
 					idx++
 				}
 				writer.Commit(sequence-reservations+1, sequence)
-			} else if err == io.EOF {
-				return
+				atomic.StoreInt64(&t.committed, sequence)
 			}
-			if err != nil && err != io.EOF {
+			if err != nil {
 				return
 			}
 		}
@@ -0,0 +1,133 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"runtime"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// Buffer sizes used before they were configurable
+var legacyBuffers = Options{
+	RingSize:        4 * 1024 * 1024,
+	ReadBufferSize:  1024 * 1024,
+	WriteBufferSize: 1024 * 1024,
+}
+
+func TestTcpHandlerDiscard(t *testing.T) {
+	options := Options{CacheSize: 1024 * 1024, Logger: log.New(ioutil.Discard, "", 0)}.withDefaults()
+	cache := NewTinyLFUStore(1024 * 1024)
+	newParser := func(w io.Writer) RequestParser { return NewParser(cache, w, options.Logger) }
+
+	before := runtime.NumGoroutine()
+	for i := 0; i < 20; i++ {
+		client, conn := net.Pipe()
+		NewTcpHandler(cache, conn, context.Background(), newParser, options, nil, nil).discard()
+		client.Close()
+	}
+
+	// the consumers of discarded handlers are stopped
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if n := runtime.NumGoroutine(); n > before {
+		t.Fatalf("expected %d goroutines, got %d", before, n)
+	}
+}
+
+func startBenchmarkServer(b *testing.B, options Options) *Server {
+	options.CacheSize = 16 * 1024 * 1024
+	options.Logger = log.New(ioutil.Discard, "", 0)
+	server, err := NewServerWithOptions(options)
+	if err != nil {
+		b.Fatal(err)
+	}
+	if err := server.Start("127.0.0.1:0"); err != nil {
+		b.Fatal(err)
+	}
+	server.Cache().Set([]byte("key"), []byte("value"), 0)
+	return server
+}
+
+// benchmarkPipelinedGets measures the throughput of a single connection
+// streaming GET requests.
+func benchmarkPipelinedGets(b *testing.B, options Options) {
+	server := startBenchmarkServer(b, options)
+	defer server.Stop(context.Background())
+
+	conn, err := net.Dial("tcp", server.Addr().String())
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer conn.Close()
+
+	request := []byte("GET key\r\n")
+	batch := bytes.Repeat(request, 1024)
+	b.SetBytes(int64(len(request)))
+	b.ResetTimer()
+
+	go func() {
+		w := bufio.NewWriterSize(conn, 64*1024)
+		for i := 0; i < b.N; i += 1024 {
+			n := b.N - i
+			if n > 1024 {
+				n = 1024
+			}
+			w.Write(batch[:n*len(request)])
+		}
+		w.Flush()
+	}()
+
+	r := bufio.NewReaderSize(conn, 64*1024)
+	for i := 0; i < b.N; i++ {
+		if _, err := r.ReadSlice('\n'); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkPipelinedGetsLegacyBuffers(b *testing.B) {
+	benchmarkPipelinedGets(b, legacyBuffers)
+}
+
+func BenchmarkPipelinedGetsDefaultBuffers(b *testing.B) {
+	benchmarkPipelinedGets(b, Options{})
+}
+
+// benchmarkConnections measures the cost of opening a connection and serving
+// a single request.
+func benchmarkConnections(b *testing.B, options Options) {
+	server := startBenchmarkServer(b, options)
+	defer server.Stop(context.Background())
+
+	response := make([]byte, len("+VALUE value\r\n"))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		conn, err := net.Dial("tcp", server.Addr().String())
+		if err != nil {
+			b.Fatal(err)
+		}
+		conn.Write([]byte("GET key\r\n"))
+		if _, err := conn.Read(response); err != nil {
+			b.Fatal(err)
+		}
+		conn.Close()
+	}
+}
+
+func BenchmarkConnectionsLegacyBuffers(b *testing.B) {
+	benchmarkConnections(b, legacyBuffers)
+}
+
+func BenchmarkConnectionsDefaultBuffers(b *testing.B) {
+	benchmarkConnections(b, Options{})
+}
@@ -0,0 +1,421 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/coocood/freecache"
+)
+
+// Expiration times larger than this are absolute unix timestamps
+const MemcacheMaxRelativeExpiration = 60 * 60 * 24 * 30
+
+// Length of the client flags stored in front of every value
+const MemcacheFlagsSize = 4
+
+// Memcache responses
+var MemcacheErr = []byte("ERROR\r\n")
+var MemcacheErrFormat = []byte("CLIENT_ERROR bad command line format\r\n")
+var MemcacheErrDataChunk = []byte("CLIENT_ERROR bad data chunk\r\n")
+var MemcacheErrNonNumeric = []byte("CLIENT_ERROR cannot increment or decrement non-numeric value\r\n")
+var MemcacheErrInvalidDelta = []byte("CLIENT_ERROR invalid numeric delta argument\r\n")
+var MemcacheErrLargeKey = []byte("CLIENT_ERROR key is larger than 65535 bytes\r\n")
+var MemcacheErrTooLarge = []byte("SERVER_ERROR object too large for cache\r\n")
+var MemcacheErrUnknownCache = []byte("SERVER_ERROR unknown cache error\r\n")
+var MemcacheErrReadOnly = []byte("SERVER_ERROR replicas do not accept writes\r\n")
+
+var MemcacheStored = []byte("STORED\r\n")
+var MemcacheDeleted = []byte("DELETED\r\n")
+var MemcacheTouched = []byte("TOUCHED\r\n")
+var MemcacheNotFound = []byte("NOT_FOUND\r\n")
+var MemcacheEnd = []byte("END\r\n")
+var MemcacheVersion = []byte("VERSION mulu\r\n")
+var MemcacheValuePrefix = []byte("VALUE ")
+var MemcacheStatPrefix = []byte("STAT ")
+
+var memcacheNoReply = []byte("noreply")
+
+// NewMemcacheParser creates a parser for the memcached text protocol.
+func NewMemcacheParser(cache Store, w io.Writer, logger *log.Logger) *MemcacheParser {
+	return &MemcacheParser{cache: cache, writer: w, logger: logger, writes: directWriter{cache}}
+}
+
+// MemcacheParser serves get, gets, set, delete, incr, decr, touch, stats and
+// version to memcached clients.
+//
+// Values are stored with the 32-bit client flags in a 4 byte big-endian header,
+// so entries written through this protocol are not interchangeable with the
+// other protocols.
+type MemcacheParser struct {
+	logger *log.Logger
+	writer io.Writer
+	cache  Store
+
+	// applies the writes, recording them for the append-only log and
+	// replicas when created by a server
+	writes cacheWriter
+
+	// non-nil on replicas, which reject writes
+	replica *replica
+
+	// nil unless the parser is created by a server, which then measures
+	// the latency of each command from start
+	counters *serverStats
+	start    time.Time
+
+	// pending set
+	key        []byte
+	value      []byte
+	expiration int
+	noreply    bool
+	expect     int
+
+	fields  [][]byte
+	scratch []byte
+}
+
+// Expect returns the number of raw bytes, including the trailing CRLF, of the
+// data block of a pending set. Zero means the parser is waiting for a line.
+func (p *MemcacheParser) Expect() int {
+	return p.expect
+}
+
+// Reject abandons the current request because it does not fit in the request
+// buffer.
+func (p *MemcacheParser) Reject() {
+	p.expect = 0
+	p.fail(MemcacheErrTooLarge, p.key)
+}
+
+// Closed reports whether the connection must be closed. Invalid data blocks
+// are skipped like their command line, so it never is.
+func (p *MemcacheParser) Closed() bool {
+	return false
+}
+
+// Parse handles a single command line. A set is measured until its data block
+// is handled by ParsePayload.
+func (p *MemcacheParser) Parse(line []byte) bool {
+	if p.counters == nil {
+		return p.parse(line)
+	}
+	p.start = time.Now()
+	ok := p.parse(line)
+	if p.expect == 0 && len(p.fields) > 0 {
+		p.counters.commandFold(p.fields[0], time.Since(p.start))
+	}
+	return ok
+}
+
+func (p *MemcacheParser) parse(line []byte) bool {
+	p.expect = 0
+	p.fields = p.fields[:0]
+	for _, field := range bytes.Fields(line) {
+		p.fields = append(p.fields, field)
+	}
+	if len(p.fields) == 0 {
+		return p.fail(MemcacheErr, line)
+	}
+
+	cmd, args := p.fields[0], p.fields[1:]
+	switch string(cmd) {
+	case "get":
+		return p.get(args, false)
+	case "gets":
+		return p.get(args, true)
+	case "set":
+		return p.set(args, line)
+	case "delete":
+		return p.delete(args, line)
+	case "incr":
+		return p.incr(args, line, false)
+	case "decr":
+		return p.incr(args, line, true)
+	case "touch":
+		return p.touch(args, line)
+	case "stats":
+		return p.stats()
+	case "version":
+		return p.write(MemcacheVersion)
+	}
+	return p.fail(MemcacheErr, line)
+}
+
+// ParsePayload stores the data block of a pending set.
+func (p *MemcacheParser) ParsePayload(data []byte) bool {
+	ok := p.parsePayload(data)
+	if p.counters != nil {
+		p.counters.command("SET", time.Since(p.start))
+	}
+	return ok
+}
+
+func (p *MemcacheParser) parsePayload(data []byte) bool {
+	p.expect = 0
+	if !bytes.HasSuffix(data, CRLF) {
+		return p.fail(MemcacheErrDataChunk, p.key)
+	}
+	p.value = append(p.value, data[:len(data)-len(CRLF)]...)
+
+	// the data block is read before rejecting the write, so that it is not
+	// taken for a command
+	if p.replica != nil {
+		return p.fail(MemcacheErrReadOnly, p.key)
+	}
+
+	// negative expiration times expire the entry immediately
+	if p.expiration < 0 {
+		if _, err := p.writes.Del(p.key); err != nil {
+			return p.cacheError(err, p.key)
+		}
+		return p.reply(MemcacheStored)
+	}
+	if err := p.writes.Set(p.key, p.value, p.expiration); err != nil {
+		return p.cacheError(err, p.key)
+	}
+	return p.reply(MemcacheStored)
+}
+
+func (p *MemcacheParser) get(keys [][]byte, cas bool) bool {
+	if len(keys) == 0 {
+		return p.fail(MemcacheErr, nil)
+	}
+
+	for _, key := range keys {
+		v, version, err := p.cache.GetWithVersion(key)
+		if err != nil || len(v) < MemcacheFlagsSize {
+			continue
+		}
+
+		p.scratch = append(p.scratch[:0], MemcacheValuePrefix...)
+		p.scratch = append(p.scratch, key...)
+		p.scratch = append(p.scratch, ' ')
+		p.scratch = strconv.AppendUint(p.scratch, uint64(binary.BigEndian.Uint32(v)), 10)
+		p.scratch = append(p.scratch, ' ')
+		p.scratch = strconv.AppendInt(p.scratch, int64(len(v)-MemcacheFlagsSize), 10)
+		if cas {
+			p.scratch = append(p.scratch, ' ')
+			p.scratch = strconv.AppendUint(p.scratch, version, 10)
+		}
+		p.scratch = append(p.scratch, CRLF...)
+		if !p.write(p.scratch) || !p.write(v[MemcacheFlagsSize:]) || !p.write(CRLF) {
+			return false
+		}
+	}
+	return p.write(MemcacheEnd)
+}
+
+// set parses: set <key> <flags> <exptime> <bytes> [noreply]
+func (p *MemcacheParser) set(args [][]byte, line []byte) bool {
+	args = p.parseNoReply(args, 4)
+	if len(args) != 4 {
+		return p.fail(MemcacheErrFormat, line)
+	}
+	flags, err := strconv.ParseUint(string(args[1]), 10, 32)
+	if err != nil {
+		return p.fail(MemcacheErrFormat, line)
+	}
+	expiration, ok := memcacheExpiration(args[2])
+	if !ok {
+		return p.fail(MemcacheErrFormat, line)
+	}
+	length, err := strconv.Atoi(string(args[3]))
+	if err != nil || length < 0 {
+		return p.fail(MemcacheErrFormat, line)
+	}
+
+	// The key points into the request buffer, which the data block will
+	// overwrite, so keep a copy until the data arrives.
+	p.key = append(p.key[:0], args[0]...)
+	p.value = append(p.value[:0], 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(p.value, uint32(flags))
+	p.expiration = expiration
+	p.expect = length + len(CRLF)
+	return true
+}
+
+// delete parses: delete <key> [noreply]
+func (p *MemcacheParser) delete(args [][]byte, line []byte) bool {
+	args = p.parseNoReply(args, 1)
+	if len(args) != 1 {
+		return p.fail(MemcacheErrFormat, line)
+	} else if p.replica != nil {
+		return p.fail(MemcacheErrReadOnly, line)
+	}
+	if ok, err := p.writes.Del(args[0]); err != nil {
+		return p.cacheError(err, line)
+	} else if !ok {
+		return p.reply(MemcacheNotFound)
+	}
+	return p.reply(MemcacheDeleted)
+}
+
+// incr parses: incr|decr <key> <value> [noreply]
+//
+// The counter is a decimal unsigned 64-bit integer. Increments wrap around on
+// overflow while decrements stop at 0, as in memcached.
+func (p *MemcacheParser) incr(args [][]byte, line []byte, decr bool) bool {
+	args = p.parseNoReply(args, 2)
+	if len(args) != 2 {
+		return p.fail(MemcacheErrFormat, line)
+	}
+	delta, err := strconv.ParseUint(string(args[1]), 10, 64)
+	if err != nil {
+		return p.fail(MemcacheErrInvalidDelta, line)
+	} else if p.replica != nil {
+		return p.fail(MemcacheErrReadOnly, line)
+	}
+
+	var counter uint64
+	found, numeric, err := p.writes.Update(args[0], func(v []byte, expireAt uint32, found bool) ([]byte, int, bool) {
+		if !found || len(v) < MemcacheFlagsSize {
+			return nil, 0, false
+		}
+		n, err := strconv.ParseUint(string(v[MemcacheFlagsSize:]), 10, 64)
+		if err != nil {
+			return nil, 0, false
+		}
+		expiration, ok := remaining(expireAt)
+		if !ok {
+			return nil, 0, false
+		}
+		if !decr {
+			counter = n + delta
+		} else if n > delta {
+			counter = n - delta
+		} else {
+			counter = 0
+		}
+		return strconv.AppendUint(append([]byte(nil), v[:MemcacheFlagsSize]...), counter, 10), expiration, true
+	})
+	if err != nil {
+		return p.cacheError(err, line)
+	} else if !found {
+		return p.reply(MemcacheNotFound)
+	} else if !numeric {
+		return p.fail(MemcacheErrNonNumeric, line)
+	}
+
+	p.scratch = strconv.AppendUint(p.scratch[:0], counter, 10)
+	p.scratch = append(p.scratch, CRLF...)
+	return p.reply(p.scratch)
+}
+
+// touch parses: touch <key> <exptime> [noreply]
+func (p *MemcacheParser) touch(args [][]byte, line []byte) bool {
+	args = p.parseNoReply(args, 2)
+	if len(args) != 2 {
+		return p.fail(MemcacheErrFormat, line)
+	}
+	expiration, ok := memcacheExpiration(args[1])
+	if !ok {
+		return p.fail(MemcacheErrFormat, line)
+	} else if p.replica != nil {
+		return p.fail(MemcacheErrReadOnly, line)
+	}
+
+	var found bool
+	var err error
+	if expiration < 0 {
+		found, err = p.writes.Del(args[0])
+	} else {
+		found, _, err = p.writes.Update(args[0], func(value []byte, expireAt uint32, found bool) ([]byte, int, bool) {
+			return value, expiration, found
+		})
+	}
+	if err != nil {
+		return p.cacheError(err, line)
+	} else if !found {
+		return p.reply(MemcacheNotFound)
+	}
+	return p.reply(MemcacheTouched)
+}
+
+func (p *MemcacheParser) stats() bool {
+	now := time.Now().Unix()
+	cache := p.cache.Stats()
+	stats := []struct {
+		name  string
+		value int64
+	}{
+		{"pid", int64(os.Getpid())},
+		{"uptime", now - startTime.Unix()},
+		{"time", now},
+		{"curr_items", cache.Entries},
+		{"get_hits", cache.Hits},
+		{"get_misses", cache.Misses},
+		{"evictions", cache.Evictions},
+		{"expired_unfetched", cache.Expired},
+	}
+	for _, stat := range stats {
+		p.scratch = append(p.scratch[:0], MemcacheStatPrefix...)
+		p.scratch = append(p.scratch, stat.name...)
+		p.scratch = append(p.scratch, ' ')
+		p.scratch = strconv.AppendInt(p.scratch, stat.value, 10)
+		p.scratch = append(p.scratch, CRLF...)
+		if !p.write(p.scratch) {
+			return false
+		}
+	}
+	return p.write(MemcacheEnd)
+}
+
+// parseNoReply strips a trailing noreply argument from a command which
+// takes n arguments.
+func (p *MemcacheParser) parseNoReply(args [][]byte, n int) [][]byte {
+	p.noreply = len(args) == n+1 && bytes.Equal(args[n], memcacheNoReply)
+	if p.noreply {
+		return args[:n]
+	}
+	return args
+}
+
+func (p *MemcacheParser) cacheError(err error, line []byte) bool {
+	switch err {
+	case freecache.ErrLargeKey:
+		return p.fail(MemcacheErrLargeKey, line)
+	case freecache.ErrLargeEntry:
+		return p.fail(MemcacheErrTooLarge, line)
+	}
+	return p.fail(MemcacheErrUnknownCache, line)
+}
+
+func (p *MemcacheParser) fail(err []byte, line []byte) bool {
+	p.writer.Write(err)
+	p.logger.Printf("%s (%s)\r\n", string(err[:len(err)-len(CRLF)]), strconv.Quote(string(line)))
+	return false
+}
+
+// reply writes a response unless the command asked for noreply.
+func (p *MemcacheParser) reply(b []byte) bool {
+	if p.noreply {
+		return true
+	}
+	return p.write(b)
+}
+
+func (p *MemcacheParser) write(b []byte) bool {
+	_, err := p.writer.Write(b)
+	return err == nil
+}
+
+// memcacheExpiration converts a memcached exptime to seconds from now. Negative
+// results mean the entry is already expired.
+func memcacheExpiration(b []byte) (int, bool) {
+	exptime, err := strconv.ParseInt(string(b), 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	if exptime > MemcacheMaxRelativeExpiration {
+		exptime -= time.Now().Unix()
+		if exptime <= 0 {
+			return -1, true
+		}
+	}
+	return int(exptime), true
+}
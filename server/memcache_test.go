@@ -0,0 +1,86 @@
+package server
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestMemcacheParser(t *testing.T) {
+	cache := NewFreecacheStore(0)
+	logger := log.New(ioutil.Discard, "logger: ", log.Lshortfile)
+	past := strconv.FormatInt(time.Now().Unix()-10, 10)
+
+	tests := []struct {
+		request, response string
+	}{
+		{"set key 42 0 4\r\na\r\nb\r\n", "STORED\r\n"},
+		{"get key\r\n", "VALUE key 42 4\r\na\r\nb\r\nEND\r\n"},
+		{"get missing\r\n", "END\r\n"},
+		{"set other 0 100 1 noreply\r\nx\r\n", ""},
+		{"get key missing other\r\n", "VALUE key 42 4\r\na\r\nb\r\nVALUE other 0 1\r\nx\r\nEND\r\n"},
+		{"set counter 7 0 2\r\n10\r\n", "STORED\r\n"},
+		{"incr counter 5\r\n", "15\r\n"},
+		{"decr counter 20\r\n", "0\r\n"},
+		{"incr counter 18446744073709551615\r\n", "18446744073709551615\r\n"},
+		{"incr counter 2\r\n", "1\r\n"},
+		{"get counter\r\n", "VALUE counter 7 1\r\n1\r\nEND\r\n"},
+		{"incr key 1\r\n", string(MemcacheErrNonNumeric)},
+		{"incr missing 1\r\n", "NOT_FOUND\r\n"},
+		{"incr counter x\r\n", string(MemcacheErrInvalidDelta)},
+		{"incr counter 1 noreply\r\n", ""},
+		{"touch key 100\r\n", "TOUCHED\r\n"},
+		{"touch missing 100\r\n", "NOT_FOUND\r\n"},
+		{"delete other\r\n", "DELETED\r\n"},
+		{"delete other\r\n", "NOT_FOUND\r\n"},
+		{"delete key noreply\r\n", ""},
+		{"set expired 0 " + past + " 1\r\nx\r\n", "STORED\r\n"},
+		{"get expired\r\n", "END\r\n"},
+		{"set key 0 0 1\r\nxyz\r\n", string(MemcacheErrDataChunk) + string(MemcacheErr)},
+		{"set key 0 0\r\n", string(MemcacheErrFormat)},
+		{"version\r\n", "VERSION mulu\r\n"},
+		{"bogus\r\n", "ERROR\r\n"},
+	}
+
+	for _, test := range tests {
+		var buf bytes.Buffer
+		w := nopFlusher{&buf}
+		b := NewByteConsumer(w, nil, NewMemcacheParser(cache, w, logger), make([]byte, RingBufferCapacity), DefaultMaxRequestSize, logger)
+		consume(b, []byte(test.request), 5)
+		if buf.String() != test.response {
+			t.Errorf("%q: expected %q, got %q", test.request, test.response, buf.String())
+		}
+	}
+}
+
+func TestMemcacheParserGets(t *testing.T) {
+	cache := NewFreecacheStore(0)
+	logger := log.New(ioutil.Discard, "logger: ", log.Lshortfile)
+	var buf bytes.Buffer
+	parser := NewMemcacheParser(cache, &buf, logger)
+
+	gets := func() string {
+		buf.Reset()
+		parser.Parse([]byte("gets key"))
+		fields := bytes.Fields(buf.Bytes())
+		if len(fields) < 5 {
+			t.Fatalf("unexpected gets response %q", buf.String())
+		}
+		return string(fields[4])
+	}
+
+	parser.Parse([]byte("set key 0 0 1"))
+	parser.ParsePayload([]byte("a\r\n"))
+	first := gets()
+	if first != gets() {
+		t.Fatal("cas unique changed without a write")
+	}
+	parser.Parse([]byte("set key 0 0 1"))
+	parser.ParsePayload([]byte("b\r\n"))
+	if first == gets() {
+		t.Fatal("cas unique did not change after a write")
+	}
+}
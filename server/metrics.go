@@ -0,0 +1,154 @@
+package server
+
+import (
+	"bufio"
+	"net/http"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// metricsWriter writes metrics in the Prometheus text exposition format.
+type metricsWriter struct {
+	*bufio.Writer
+}
+
+// header describes the metric which the following samples belong to.
+func (m metricsWriter) header(name, kind, help string) {
+	m.WriteString("# HELP " + name + " " + help + "\n")
+	m.WriteString("# TYPE " + name + " " + kind + "\n")
+}
+
+// sample writes a sample, with labels such as `command="GET"` if not empty.
+func (m metricsWriter) sample(name, labels string, value float64) {
+	m.WriteString(name)
+	if labels != "" {
+		m.WriteString("{" + labels + "}")
+	}
+	m.WriteByte(' ')
+	m.WriteString(strconv.FormatFloat(value, 'g', -1, 64))
+	m.WriteByte('\n')
+}
+
+func (m metricsWriter) metric(name, kind, help string, value float64) {
+	m.header(name, kind, help)
+	m.sample(name, "", value)
+}
+
+// labelEscaper escapes the characters which the exposition format does not
+// allow in label values. Other bytes, including invalid UTF-8, are kept as is.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// label formats a label, escaping its value.
+func label(name, value string) string {
+	return name + `="` + labelEscaper.Replace(value) + `"`
+}
+
+// serveMetrics responds with the metrics of the cache, the server, its
+// connections and the Go runtime. Only the connection registry is locked, as
+// the parsers update their counters atomically.
+func (s *Server) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	m := metricsWriter{bufio.NewWriter(w)}
+	defer m.Flush()
+
+	m.metric("mulu_uptime_seconds", "gauge", "Time since the process started.", time.Since(startTime).Seconds())
+
+	cache := s.cache.Stats()
+	m.metric("mulu_cache_entries", "gauge", "Entries in the cache.", float64(cache.Entries))
+	m.metric("mulu_cache_hits_total", "counter", "Lookups which found their key.", float64(cache.Hits))
+	m.metric("mulu_cache_misses_total", "counter", "Lookups which did not find their key.", float64(cache.Misses))
+	m.metric("mulu_cache_hit_rate", "gauge", "Ratio of lookups which found their key.", cache.HitRate())
+	m.metric("mulu_cache_evictions_total", "counter", "Entries evicted to make room for others.", float64(cache.Evictions))
+	m.metric("mulu_cache_expired_total", "counter", "Entries removed once expired.", float64(cache.Expired))
+	m.metric("mulu_cache_overwrites_total", "counter", "Entries replaced by a write.", float64(cache.Overwrites))
+
+	stats := s.stats.snapshot()
+	m.metric("mulu_connections", "gauge", "Open client connections.", float64(stats.Connections))
+	m.metric("mulu_connections_total", "counter", "Client connections accepted.", float64(stats.TotalConnections))
+	m.metric("mulu_read_bytes_total", "counter", "Bytes read from client connections.", float64(stats.BytesIn))
+	m.metric("mulu_written_bytes_total", "counter", "Bytes written to client connections.", float64(stats.BytesOut))
+
+	m.header("mulu_parse_errors_total", "counter", "Requests rejected by the parser, by error.")
+	for _, name := range sortedNames(stats.ParseErrors) {
+		m.sample("mulu_parse_errors_total", label("error", name), float64(stats.ParseErrors[name]))
+	}
+	s.writeCommandMetrics(m)
+	s.writeRingMetrics(m)
+	writeRuntimeMetrics(m)
+}
+
+// writeCommandMetrics writes the request counters and latency histograms of
+// the commands, over every protocol.
+func (s *Server) writeCommandMetrics(m metricsWriter) {
+	names := make([]string, 0, len(s.stats.commands))
+	for name := range s.stats.commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	m.header("mulu_command_duration_seconds", "histogram", "Latency of the requests over every protocol, by command.")
+	for _, name := range names {
+		c := s.stats.commands[name]
+		command := label("command", name)
+
+		// buckets first, so that none exceeds the count
+		var buckets [len(latencyBuckets)]int64
+		for i := range buckets {
+			buckets[i] = atomic.LoadInt64(&c.buckets[i])
+		}
+		count := atomic.LoadInt64(&c.count)
+		duration := atomic.LoadInt64(&c.duration)
+
+		var cumulative int64
+		for i, bound := range latencyBuckets {
+			cumulative += buckets[i]
+			m.sample("mulu_command_duration_seconds_bucket", command+","+label("le", strconv.FormatFloat(bound.Seconds(), 'g', -1, 64)), float64(cumulative))
+		}
+		m.sample("mulu_command_duration_seconds_bucket", command+`,le="+Inf"`, float64(count))
+		m.sample("mulu_command_duration_seconds_sum", command, time.Duration(duration).Seconds())
+		m.sample("mulu_command_duration_seconds_count", command, float64(count))
+	}
+}
+
+// writeRingMetrics writes the number of bytes waiting in the ring of each
+// connection, between the read loop and the parser.
+func (s *Server) writeRingMetrics(m metricsWriter) {
+	m.metric("mulu_ring_size_bytes", "gauge", "Size of the ring of each connection.", float64(s.options.RingSize))
+	m.header("mulu_ring_used_bytes", "gauge", "Bytes read but not yet parsed, by connection.")
+	for _, client := range s.Clients() {
+		m.sample("mulu_ring_used_bytes", label("conn", client.Addr), float64(client.RingUsed))
+	}
+}
+
+// writeRuntimeMetrics writes the metrics of the Go runtime, named as by the
+// Prometheus Go client.
+func writeRuntimeMetrics(m metricsWriter) {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	m.metric("go_goroutines", "gauge", "Number of goroutines that currently exist.", float64(runtime.NumGoroutine()))
+	m.header("go_info", "gauge", "Information about the Go environment.")
+	m.sample("go_info", label("version", runtime.Version()), 1)
+	m.metric("go_memstats_alloc_bytes", "gauge", "Number of bytes allocated and still in use.", float64(mem.Alloc))
+	m.metric("go_memstats_alloc_bytes_total", "counter", "Total number of bytes allocated, even if freed.", float64(mem.TotalAlloc))
+	m.metric("go_memstats_sys_bytes", "gauge", "Number of bytes obtained from system.", float64(mem.Sys))
+	m.metric("go_memstats_heap_inuse_bytes", "gauge", "Number of heap bytes that are in use.", float64(mem.HeapInuse))
+	m.metric("go_memstats_heap_objects", "gauge", "Number of allocated objects.", float64(mem.HeapObjects))
+	m.metric("go_memstats_next_gc_bytes", "gauge", "Number of heap bytes when next garbage collection will take place.", float64(mem.NextGC))
+	m.metric("go_memstats_last_gc_time_seconds", "gauge", "Number of seconds since 1970 of last garbage collection.", float64(mem.LastGC)/1e9)
+	m.metric("go_gc_cycles_total", "counter", "Number of completed garbage collection cycles.", float64(mem.NumGC))
+	m.metric("go_gc_pause_seconds_total", "counter", "Total time spent in stop-the-world garbage collection pauses.", time.Duration(mem.PauseTotalNs).Seconds())
+}
+
+// sortedNames returns the keys of the counters in alphabetical order.
+func sortedNames(counters map[string]int64) []string {
+	names := make([]string, 0, len(counters))
+	for name := range counters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,110 @@
+package server
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestServerMetrics(t *testing.T) {
+	server, err := NewServerWithOptions(Options{CacheSize: 1024 * 1024, AdminAddr: "127.0.0.1:0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := server.Start("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop(context.Background())
+
+	conn, err := net.Dial("tcp", server.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write([]byte("SET key 0 value\r\nGET key\r\nGET key\r\nNOPE\r\n"))
+	r := bufio.NewReader(conn)
+	for i := 0; i < 4; i++ {
+		if _, err := r.ReadString('\n'); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	resp, err := http.Get("http://" + server.AdminAddr().String() + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/plain") {
+		t.Fatalf("unexpected content type %q", resp.Header.Get("Content-Type"))
+	}
+
+	metrics := make(map[string]string)
+	for _, line := range strings.Split(string(body), "\n") {
+		if i := strings.LastIndexByte(line, ' '); i > 0 && !strings.HasPrefix(line, "#") {
+			metrics[line[:i]] = line[i+1:]
+		}
+	}
+	expected := map[string]string{
+		"mulu_cache_entries":                                            "1",
+		"mulu_cache_hits_total":                                         "2",
+		"mulu_connections":                                              "1",
+		"mulu_connections_total":                                        "1",
+		`mulu_parse_errors_total{error="unknown_cmd"}`:                  "1",
+		`mulu_command_duration_seconds_count{command="GET"}`:            "2",
+		`mulu_command_duration_seconds_bucket{command="GET",le="+Inf"}`: "2",
+		`mulu_command_duration_seconds_bucket{command="SET",le="+Inf"}`: "1",
+		`mulu_command_duration_seconds_count{command="DEL"}`:            "0",
+		"mulu_ring_size_bytes":                                          "262144",
+	}
+	for name, value := range expected {
+		if metrics[name] != value {
+			t.Errorf("expected %s to be %s, got %q", name, value, metrics[name])
+		}
+	}
+	present := []string{
+		"go_goroutines",
+		"go_memstats_alloc_bytes",
+		`mulu_command_duration_seconds_bucket{command="GET",le="0.1"}`,
+		`mulu_ring_used_bytes{conn="` + conn.LocalAddr().String() + `"}`,
+	}
+	for _, name := range present {
+		if _, ok := metrics[name]; !ok {
+			t.Errorf("missing %s", name)
+		}
+	}
+
+	// the admin listener is closed with the server
+	addr := server.AdminAddr().String()
+	server.Stop(context.Background())
+	if _, err := net.Dial("tcp", addr); err == nil {
+		t.Fatal("admin listener still open after Stop")
+	}
+}
+
+func TestMetricsLabel(t *testing.T) {
+	tests := []struct {
+		value, expected string
+	}{
+		{"GET", `conn="GET"`},
+		{`a\b`, `conn="a\\b"`},
+		{`say "hi"`, `conn="say \"hi\""`},
+		{"line\nbreak", `conn="line\nbreak"`},
+		{"tab\té", "conn=\"tab\té\""},
+	}
+	for _, test := range tests {
+		if actual := label("conn", test.value); actual != test.expected {
+			t.Errorf("%q: expected %s, got %s", test.value, test.expected, actual)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package server
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"time"
+)
+
+// Defaults used for zero Options fields
+const (
+	DefaultCacheSize       = 512 * 1024 * 1024
+	DefaultAddr            = ":9022"
+	DefaultRingSize        = RingBufferCapacity
+	DefaultReadBufferSize  = 64 * 1024
+	DefaultWriteBufferSize = 64 * 1024
+	DefaultMaxRequestSize  = 64 * 1024
+	DefaultAcceptTimeout   = time.Second
+)
+
+// Options configures a Server. Zero values are replaced by the defaults.
+//
+// Each connection holds RingSize + ReadBufferSize + WriteBufferSize bytes, plus
+// a request buffer which starts at 4KB and grows up to MaxRequestSize as large
+// requests arrive. With the defaults this is about 390KB per connection. The
+// ring, read and write buffers are recycled between connections.
+type Options struct {
+	// Size of the cache in bytes
+	CacheSize int
+
+	// Storage engine holding CacheSize bytes, unless Store is set
+	Engine Engine
+	Store  Store
+
+	// Address of the mulu protocol listener when Start or Serve are called
+	// with an empty address
+	Addr string
+
+	// Address of the admin HTTP listener opened by Start, which serves the
+	// Prometheus metrics at /metrics and the API described by ListenAdmin.
+	// Empty disables it. AdminLocalhost binds it to the loopback interface
+	// whatever the host of AdminAddr.
+	AdminAddr      string
+	AdminLocalhost bool
+
+	// Password granting the admin permission to mulu protocol connections
+	// through AUTH, which FLUSHALL and FLUSH require. Empty disables them.
+	// When set, replicas must authenticate before SYNC and PSYNC, and a
+	// replica authenticates to its primary with its own password.
+	AdminPassword string
+
+	// Framing of values on mulu protocol listeners
+	Framing Framing
+
+	// Size of the per-connection ring buffer between the read loop and the
+	// parser. It must be a power of two.
+	RingSize int
+
+	// Size of the per-connection socket read and response write buffers
+	ReadBufferSize  int
+	WriteBufferSize int
+
+	// Largest request line, or length-prefixed value, accepted by the parser
+	MaxRequestSize int
+
+	// How often listeners check whether the server is stopping
+	AcceptTimeout time.Duration
+
+	// Connections idle for longer than ReadTimeout are closed, and writes
+	// blocked for longer than WriteTimeout fail. Zero disables the timeout.
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+
+	// Snapshot file loaded by NewServerWithOptions before the server accepts
+	// connections, and written by Stop, the SAVE and BGSAVE commands and every
+	// SnapshotInterval if it is not zero. A missing file is not an error.
+	SnapshotPath     string
+	SnapshotInterval time.Duration
+
+	// Append-only log of the writes made over the mulu protocol, replayed
+	// on startup instead of the snapshot unless it does not exist yet
+	AppendLogPath  string
+	AppendLogFsync FsyncPolicy
+
+	// Size of the ring of recent writes kept for replicas to catch up. Zero
+	// disables serving replicas.
+	ReplicationBacklogSize int
+
+	// Address of the primary to replicate. Replicas reject writes made over
+	// the mulu protocol.
+	ReplicaOf string
+
+	// Logger defaults to discarding all output
+	Logger *log.Logger
+}
+
+// withDefaults returns a copy of the options with the defaults filled in.
+func (o Options) withDefaults() Options {
+	if o.CacheSize == 0 {
+		o.CacheSize = DefaultCacheSize
+	}
+	if o.Addr == "" {
+		o.Addr = DefaultAddr
+	}
+	if o.RingSize == 0 {
+		o.RingSize = DefaultRingSize
+	}
+	if o.ReadBufferSize == 0 {
+		o.ReadBufferSize = DefaultReadBufferSize
+	}
+	if o.WriteBufferSize == 0 {
+		o.WriteBufferSize = DefaultWriteBufferSize
+	}
+	if o.MaxRequestSize == 0 {
+		o.MaxRequestSize = DefaultMaxRequestSize
+	}
+	if o.AcceptTimeout == 0 {
+		o.AcceptTimeout = DefaultAcceptTimeout
+	}
+	if o.Logger == nil {
+		o.Logger = log.New(ioutil.Discard, "", 0)
+	}
+	return o
+}
+
+func (o Options) validate() error {
+	if o.RingSize < 0 || o.RingSize&(o.RingSize-1) != 0 {
+		return fmt.Errorf("server: Ring size must be a power of two")
+	}
+	if o.CacheSize < 0 || o.ReadBufferSize < 0 || o.WriteBufferSize < 0 || o.MaxRequestSize < 0 || o.ReplicationBacklogSize < 0 {
+		return fmt.Errorf("server: Negative size")
+	}
+	if o.AcceptTimeout < 0 || o.ReadTimeout < 0 || o.WriteTimeout < 0 || o.SnapshotInterval < 0 {
+		return fmt.Errorf("server: Negative timeout")
+	}
+	if o.Engine != EngineFreecache && o.Engine != EngineTinyLFU {
+		return fmt.Errorf("server: Unknown storage engine %d", int(o.Engine))
+	}
+	if o.SnapshotInterval > 0 && o.SnapshotPath == "" {
+		return fmt.Errorf("server: Snapshot interval without a snapshot path")
+	}
+	return nil
+}
@@ -1,9 +1,11 @@
 package server
 
 import (
+	"bytes"
 	"io"
 	"log"
 	"strconv"
+	"time"
 
 	"github.com/coocood/freecache"
 )
@@ -17,6 +19,9 @@ const (
 	OP_SE
 	OP_SET
 	OP_SET_KEY
+	OP_D
+	OP_DE
+	OP_DEL
 )
 
 // Errors
@@ -30,25 +35,175 @@ var ErrLargeKey = []byte("-ERRLARGEKEY The key is larger than 65535\r\n")
 var ErrLargeEntry = []byte("-ERRLARGEENTRY The entry size is larger than 1/1024 of cache size\r\n")
 var ErrNotFound = []byte("-ERRNOTFOUND Entry not found\r\n")
 var ErrInvalidExpiration = []byte("-ERRINVEXP Invalid key expiration\r\n")
+var ErrInvalidLength = []byte("-ERRINVLEN Invalid value length\r\n")
+var ErrInvalidValueDelimiter = []byte("-ERRPARSE Missing CRLF after value\r\n")
 var ErrUnknownCache = []byte("-ERRCACHE Unknown cache error\r\n")
+var ErrLogWrite = []byte("-ERRLOG Append-only log write failed\r\n")
 
 var OKResponse = []byte("+OK\r\n")
 var ValuePrefix = []byte("+VALUE ")
 var CRLF = []byte("\r\n")
 
-func NewParser(cache *freecache.Cache, w io.Writer, logger *log.Logger) *Parser {
+// Framing determines how values are delimited on the wire.
+type Framing int
+
+const (
+	// LineFraming treats everything after the expiration as the value, up to
+	// the end of the line. Values cannot contain CR or LF bytes.
+	LineFraming Framing = iota
+
+	// LengthFraming sends values as an explicit byte count followed by the raw
+	// bytes, so values may contain arbitrary binary data:
+	//
+	//	SET <key> <expiration> <length>\r\n<bytes>\r\n
+	//	+VALUE <length>\r\n<bytes>\r\n
+	LengthFraming
+)
+
+func NewParser(cache Store, w io.Writer, logger *log.Logger) *Parser {
 	return &Parser{cache: cache, writer: w, logger: logger}
 }
 
+// NewFramedParser creates a parser which uses LengthFraming for values.
+func NewFramedParser(cache Store, w io.Writer, logger *log.Logger) *Parser {
+	return &Parser{cache: cache, writer: w, logger: logger, framing: LengthFraming}
+}
+
 type Parser struct {
 	logger          *log.Logger
 	writer          io.Writer
-	cache           *freecache.Cache
+	cache           Store
+	framing         Framing
 	key, value, err []byte
+
+	// pending length-prefixed write
+	keybuf     []byte
+	expiration int
+	expect     int
+	store      storeFunc
+	token      uint64
+	msets      []msetEntry
+	scratch    []byte
+
+	// keys collected ahead of the next page of a SCAN
+	scanning *scanBatch
+
+	// request handled by the command table, and its words
+	line []byte
+	args [][]byte
+
+	// Options.AdminPassword, and whether the connection authenticated with
+	// it to run admin commands
+	password string
+	admin    bool
+
+	// nil unless the server writes snapshots or an append-only log
+	snapshots *snapshotter
+	aof       *AppendLog
+
+	// records the writes for the append-only log and replicas, nil if they
+	// are applied to the cache directly
+	writes cacheWriter
+
+	// nil unless the server serves replicas or is a replica
+	backlog *replicationBacklog
+	replica *replica
+	records []byte
+
+	// the response could not be completed, so the connection is closed
+	closed bool
+
+	// nil unless the parser is created by a server, which then measures
+	// the latency of the request named cmd from start
+	counters *serverStats
+	cmd      string
+	start    time.Time
+}
+
+// Expect returns the number of raw bytes, including the trailing CRLF, which
+// must be passed to ParsePayload before the next line is parsed. Zero means
+// the parser is waiting for a line.
+func (p *Parser) Expect() int {
+	return p.expect
+}
+
+// ParsePayload completes a length-prefixed write with the value bytes
+// announced by the preceding header line.
+func (p *Parser) ParsePayload(data []byte) bool {
+	ok := p.parsePayload(data)
+	if p.counters != nil {
+		p.counters.command(p.cmd, time.Since(p.start))
+	}
+	return ok
+}
+
+func (p *Parser) parsePayload(data []byte) bool {
+	p.expect = 0
+	if !bytes.HasSuffix(data, CRLF) {
+		p.err = ErrInvalidValueDelimiter
+		p.counters.parseError(p.err)
+		p.writer.Write(p.err)
+		p.logger.Printf("%s (%s)\r\n", string(p.err), strconv.Quote(string(p.key)))
+		return false
+	}
+	return p.store(p, p.key, data[:len(data)-len(CRLF)], p.expiration, p.key)
 }
 
+// storeFunc writes a value once it has been read from the request.
+type storeFunc func(p *Parser, key, value []byte, expiration int, line []byte) bool
+
+// expectValue parses the length of a length-prefixed value, which is passed to
+// store once ParsePayload receives it.
+func (p *Parser) expectValue(key, length []byte, expiration int, store storeFunc, line []byte) bool {
+	n, err := strconv.Atoi(string(length))
+	if err != nil || n < 0 {
+		return p.fail(ErrInvalidLength, line)
+	}
+
+	// The key points into the request buffer, which the payload will
+	// overwrite, so keep a copy until the value arrives.
+	p.keybuf = append(p.keybuf[:0], key...)
+	p.key = p.keybuf
+	p.expiration = expiration
+	p.store = store
+	p.expect = n + len(CRLF)
+	return true
+}
+
+// Reject abandons the current request because it does not fit in the request
+// buffer.
+func (p *Parser) Reject() {
+	p.expect = 0
+	p.counters.parseError(ErrMaxSize)
+	p.writer.Write(ErrMaxSize)
+	p.logger.Printf("ERR %s\r\n", string(ErrMaxSize))
+}
+
+// Closed reports whether the connection must be closed. Requests are lines,
+// so the parser can always resume after an invalid one, but a replica cannot
+// resume after a snapshot which was cut short.
+func (p *Parser) Closed() bool {
+	return p.closed
+}
+
+// Parse handles a request line. Requests with a length-prefixed value are
+// measured until the value is handled by ParsePayload.
 func (p *Parser) Parse(line []byte) bool {
+	if p.counters == nil {
+		return p.parse(line)
+	}
+	p.cmd, p.start = "", time.Now()
+	ok := p.parse(line)
+	if p.expect == 0 {
+		p.counters.command(p.cmd, time.Since(p.start))
+	}
+	return ok
+}
+
+func (p *Parser) parse(line []byte) bool {
+	p.expect = 0
 	if len(line) == 0 {
+		p.counters.parseError(ErrEmptyRequest)
 		p.writer.Write(ErrEmptyRequest)
 		return false
 	}
@@ -71,28 +226,24 @@ func (p *Parser) Parse(line []byte) bool {
 				state = OP_G
 			case 'S', 's':
 				state = OP_S
+			case 'D', 'd':
+				state = OP_D
 			default:
-				p.logger.Printf("OP_START: (%s) %s\r\n", c, strconv.Quote(string(line)))
-				p.err = ErrUnknownCmd
-				goto PARSE_ERR
+				goto PERFORM_COMMAND
 			}
 		case OP_G:
 			switch c {
 			case 'E', 'e':
 				state = OP_GE
 			default:
-				p.logger.Printf("OP_G: (%s) %s\r\n", c, strconv.Quote(string(line)))
-				p.err = ErrUnknownCmd
-				goto PARSE_ERR
+				goto PERFORM_COMMAND
 			}
 		case OP_GE:
 			switch c {
 			case 'T', 't':
 				state = OP_GET
 			default:
-				p.logger.Printf("OP_GE: (%s) %s\r\n", c, strconv.Quote(string(line)))
-				p.err = ErrUnknownCmd
-				goto PARSE_ERR
+				goto PERFORM_COMMAND
 			}
 		case OP_GET:
 			switch c {
@@ -101,8 +252,34 @@ func (p *Parser) Parse(line []byte) bool {
 				// b.logger.Printf("KEY: %s\r\n", strconv.Quote(string(key)))
 				goto PERFORM_GET
 			default:
-				p.err = ErrInvalidCmdDelimiter
-				goto PARSE_ERR
+				goto PERFORM_COMMAND
+			}
+
+		case OP_D:
+			switch c {
+			case 'E', 'e':
+				state = OP_DE
+			default:
+				goto PERFORM_COMMAND
+			}
+		case OP_DE:
+			switch c {
+			case 'L', 'l':
+				state = OP_DEL
+			default:
+				goto PERFORM_COMMAND
+			}
+		case OP_DEL:
+			switch c {
+			case '\t', ' ':
+				p.key = (line)[i+1:]
+				if len(p.key) == 0 {
+					p.err = ErrIncompleteCmd
+					goto PARSE_ERR
+				}
+				goto PERFORM_DEL
+			default:
+				goto PERFORM_COMMAND
 			}
 
 		case OP_S:
@@ -110,26 +287,21 @@ func (p *Parser) Parse(line []byte) bool {
 			case 'E', 'e':
 				state = OP_SE
 			default:
-				p.logger.Printf("OP_S: (%s) %s\r\n", c, strconv.Quote(string(line)))
-				p.err = ErrUnknownCmd
-				goto PARSE_ERR
+				goto PERFORM_COMMAND
 			}
 		case OP_SE:
 			switch c {
 			case 'T', 't':
 				state = OP_SET
 			default:
-				p.logger.Printf("OP_GE: (%s) %s\r\n", c, strconv.Quote(string(line)))
-				p.err = ErrUnknownCmd
-				goto PARSE_ERR
+				goto PERFORM_COMMAND
 			}
 		case OP_SET:
 			switch c {
 			case '\t', ' ':
 				state = OP_SET_KEY
 			default:
-				p.err = ErrInvalidCmdDelimiter
-				goto PARSE_ERR
+				goto PERFORM_COMMAND
 			}
 
 		case OP_SET_KEY:
@@ -158,7 +330,6 @@ func (p *Parser) Parse(line []byte) bool {
 			offset = i
 			for i < len(line) {
 				if line[i] == '\t' || line[i] == ' ' {
-					i++
 					break
 				}
 				i++
@@ -170,14 +341,19 @@ func (p *Parser) Parse(line []byte) bool {
 				goto PARSE_ERR
 			}
 
-			exp, e := strconv.Atoi(string(line[offset : i-1]))
+			exp, e := strconv.Atoi(string(line[offset:i]))
 			if e != nil {
 				p.err = ErrInvalidExpiration
 				goto PARSE_ERR
 			}
 			expiration = exp
-			p.value = line[i-1:]
 
+			// skip space
+			p.value = line[i+1:]
+
+			if p.framing == LengthFraming {
+				goto PARSE_LENGTH
+			}
 			goto PERFORM_SET
 
 			// 	key = line[offset:i]
@@ -191,15 +367,20 @@ func (p *Parser) Parse(line []byte) bool {
 		}
 	}
 
+	// Ran out of input before the command was complete
+	p.err = ErrIncompleteCmd
+
 PARSE_ERR:
 
 	// Ignoring all write errors here, because we are going to return false
 	// and close the connection due to the parse error anyway.
+	p.counters.parseError(p.err)
 	p.writer.Write(p.err)
 	p.logger.Printf("%s (%s)\r\n", string(p.err), strconv.Quote(string(line)))
 	return false
 
 PERFORM_GET:
+	p.cmd = "GET"
 	v, e = p.cache.Get(p.key)
 	if e == freecache.ErrLargeKey {
 		p.err = ErrLargeKey
@@ -217,6 +398,13 @@ PERFORM_GET:
 		if _, err := p.writer.Write(ValuePrefix); err != nil {
 			return false
 		}
+		if p.framing == LengthFraming {
+			p.scratch = strconv.AppendInt(p.scratch[:0], int64(len(v)), 10)
+			p.scratch = append(p.scratch, CRLF...)
+			if _, err := p.writer.Write(p.scratch); err != nil {
+				return false
+			}
+		}
 		if _, err := p.writer.Write(v); err != nil {
 			return false
 		}
@@ -226,25 +414,76 @@ PERFORM_GET:
 		return true
 	}
 
+PARSE_LENGTH:
+	p.cmd = "SET"
+	return p.expectValue(p.key, p.value, expiration, (*Parser).set, line)
+
 PERFORM_SET:
-	e = p.cache.Set(p.key, p.value, expiration)
-	if e == freecache.ErrLargeKey {
-		p.err = ErrLargeKey
-		goto PARSE_ERR
-	} else if e == freecache.ErrLargeEntry {
-		p.err = ErrLargeEntry
-		goto PARSE_ERR
-	} else if e != nil {
-		p.err = ErrUnknownCache
-		goto PARSE_ERR
+	p.cmd = "SET"
+	return p.set(p.key, p.value, expiration, line)
+
+PERFORM_COMMAND:
+	return p.command(line)
+
+PERFORM_DEL:
+	p.cmd = "DEL"
+	return p.del(p.key, line)
+}
+
+func (p *Parser) set(key, value []byte, expiration int, line []byte) bool {
+	var e error
+	if p.replica != nil {
+		p.err = ErrReadOnly
+		p.writer.Write(p.err)
+		return false
+	} else if p.writes != nil {
+		e = p.writes.Set(key, value, expiration)
 	} else {
-		if _, err := p.writer.Write(OKResponse); err != nil {
-			return false
-		}
-		return true
+		e = p.cache.Set(key, value, expiration)
+	}
+	if e != nil {
+		return p.writeError(e, line)
+	}
+	_, err := p.writer.Write(OKResponse)
+	return err == nil
+}
+
+func (p *Parser) del(key, line []byte) bool {
+	var ok bool
+	var e error
+	if p.replica != nil {
+		return p.fail(ErrReadOnly, line)
+	} else if p.writes != nil {
+		ok, e = p.writes.Del(key)
+	} else {
+		ok = p.cache.Del(key)
+	}
+	if e != nil {
+		return p.fail(ErrLogWrite, line)
+	} else if !ok {
+		return p.fail(ErrNotFound, line)
+	}
+	_, err := p.writer.Write(OKResponse)
+	return err == nil
+}
+
+// update atomically replaces the entry of key, recording the new entry for the
+// append-only log and replicas.
+func (p *Parser) update(key []byte, fn UpdateFunc) (found, updated bool, err error) {
+	if p.writes != nil {
+		return p.writes.Update(key, fn)
 	}
+	return p.cache.Update(key, fn)
+}
 
-	p.logger.Printf("END %s\r\n", c)
-	p.err = ErrUnknownCmd
-	goto PARSE_ERR
+// writeError responds to a failed write.
+func (p *Parser) writeError(e error, line []byte) bool {
+	if e == freecache.ErrLargeKey {
+		return p.fail(ErrLargeKey, line)
+	} else if e == freecache.ErrLargeEntry {
+		return p.fail(ErrLargeEntry, line)
+	} else if p.writes != nil {
+		return p.fail(ErrLogWrite, line)
+	}
+	return p.fail(ErrUnknownCache, line)
 }
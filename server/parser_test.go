@@ -1,8 +1,13 @@
 package server
 
 import (
+	"bytes"
 	"io/ioutil"
 	"log"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 
 	"github.com/coocood/freecache"
@@ -11,8 +16,288 @@ import (
 func TestParser(t *testing.T) {
 }
 
+func TestParserDel(t *testing.T) {
+	cache := NewFreecacheStore(0)
+	logger := log.New(ioutil.Discard, "logger: ", log.Lshortfile)
+	var buf bytes.Buffer
+	parser := NewParser(cache, &buf, logger)
+
+	cache.Set([]byte("key"), []byte("value"), 0)
+	if !parser.Parse([]byte("DEL key")) {
+		t.Fatalf("DEL of existing key failed: %q", buf.String())
+	}
+	if !bytes.Equal(buf.Bytes(), OKResponse) {
+		t.Fatalf("expected %q, got %q", OKResponse, buf.String())
+	}
+	if _, err := cache.Get([]byte("key")); err != freecache.ErrNotFound {
+		t.Fatalf("key still present after DEL: %v", err)
+	}
+
+	buf.Reset()
+	if parser.Parse([]byte("del key")) {
+		t.Fatal("DEL of missing key succeeded")
+	}
+	if !bytes.Equal(buf.Bytes(), ErrNotFound) {
+		t.Fatalf("expected %q, got %q", ErrNotFound, buf.String())
+	}
+
+	for _, line := range []string{"DEL", "DEL ", "DELkey", "DEX key"} {
+		buf.Reset()
+		if parser.Parse([]byte(line)) {
+			t.Fatalf("%q should not parse", line)
+		}
+		if buf.Len() == 0 || buf.Bytes()[0] != '-' {
+			t.Fatalf("%q: expected error response, got %q", line, buf.String())
+		}
+	}
+}
+
+func TestParserExpiration(t *testing.T) {
+	cache := NewFreecacheStore(0)
+	logger := log.New(ioutil.Discard, "logger: ", log.Lshortfile)
+	var buf bytes.Buffer
+	parser := NewParser(cache, &buf, logger)
+	cache.Set([]byte("key"), []byte("value"), 0)
+	cache.Set([]byte("deleted"), []byte("value"), 0)
+
+	tests := []struct {
+		request, response string
+	}{
+		{"TTL key", "+TTL 0\r\n"},
+		{"EXPIRE key 100", "+OK\r\n"},
+		{"TOUCH key 50", "+OK\r\n"},
+		{"PERSIST key", "+OK\r\n"},
+		{"TTL key", "+TTL 0\r\n"},
+		{"ttl key", "+TTL 0\r\n"},
+		{"GET key", "+VALUE value\r\n"},
+		{"EXPIRE deleted 0", "+OK\r\n"},
+		{"GET deleted", string(ErrNotFound)},
+		{"TTL missing", string(ErrNotFound)},
+		{"EXPIRE missing 100", string(ErrNotFound)},
+		{"PERSIST missing", string(ErrNotFound)},
+		{"TOUCH missing 100", string(ErrNotFound)},
+		{"EXPIRE key soon", string(ErrInvalidExpiration)},
+		{"TOUCH key", string(ErrInvalidArgs)},
+		{"TTL", string(ErrInvalidArgs)},
+	}
+	for _, test := range tests {
+		buf.Reset()
+		parser.Parse([]byte(test.request))
+		if buf.String() != test.response {
+			t.Errorf("%q: expected %q, got %q", test.request, test.response, buf.String())
+		}
+	}
+
+	buf.Reset()
+	parser.Parse([]byte("EXPIRE key 100"))
+	parser.Parse([]byte("TTL key"))
+	if response := buf.String(); response != "+OK\r\n+TTL 100\r\n" && response != "+OK\r\n+TTL 99\r\n" {
+		t.Errorf("expected the new TTL, got %q", response)
+	}
+	if value, err := cache.Get([]byte("key")); err != nil || string(value) != "value" {
+		t.Errorf("expected the value to be kept, got %q (%v)", value, err)
+	}
+}
+
+func TestParserCounters(t *testing.T) {
+	cache := NewFreecacheStore(0)
+	logger := log.New(ioutil.Discard, "logger: ", log.Lshortfile)
+	var buf bytes.Buffer
+	parser := NewParser(cache, &buf, logger)
+	cache.Set([]byte("text"), []byte("value"), 0)
+	cache.Set([]byte("max"), []byte(strconv.FormatInt(math.MaxInt64-1, 10)), 0)
+	cache.Set([]byte("ttl"), []byte("10"), 100)
+
+	tests := []struct {
+		request, response string
+	}{
+		{"INCR counter", "+INT 1\r\n"},
+		{"INCR counter", "+INT 2\r\n"},
+		{"INCRBY counter 40", "+INT 42\r\n"},
+		{"INCRBY counter -50", "+INT -8\r\n"},
+		{"DECR counter", "+INT -9\r\n"},
+		{"GET counter", "+VALUE -9\r\n"},
+		{"decr new", "+INT -1\r\n"},
+		{"INCR ttl", "+INT 11\r\n"},
+		{"INCR text", string(ErrNotInteger)},
+		{"GET text", "+VALUE value\r\n"},
+		{"INCR max", "+INT 9223372036854775807\r\n"},
+		{"INCR max", string(ErrOverflow)},
+		{"INCRBY max -9223372036854775807", "+INT 0\r\n"},
+		{"INCRBY max -9223372036854775808", "+INT -9223372036854775808\r\n"},
+		{"DECR max", string(ErrOverflow)},
+		{"INCRBY counter 1.5", string(ErrInvalidIncrement)},
+		{"INCRBY counter", string(ErrInvalidArgs)},
+		{"INCR", string(ErrInvalidArgs)},
+	}
+	for _, test := range tests {
+		buf.Reset()
+		parser.Parse([]byte(test.request))
+		if buf.String() != test.response {
+			t.Errorf("%q: expected %q, got %q", test.request, test.response, buf.String())
+		}
+	}
+	if ttl, _ := cache.TTL([]byte("ttl")); ttl < 98 || ttl > 100 {
+		t.Errorf("expected the TTL to be kept, got %d", ttl)
+	}
+
+	// Concurrent increments are not lost
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			parser := NewParser(cache, ioutil.Discard, logger)
+			for j := 0; j < 100; j++ {
+				parser.Parse([]byte("INCR concurrent"))
+			}
+		}()
+	}
+	wg.Wait()
+	if value, _ := cache.Get([]byte("concurrent")); string(value) != "800" {
+		t.Errorf("expected 800, got %q", value)
+	}
+}
+
+func TestParserCAS(t *testing.T) {
+	cache := NewFreecacheStore(0)
+	logger := log.New(ioutil.Discard, "logger: ", log.Lshortfile)
+	var buf bytes.Buffer
+	parser := NewParser(cache, &buf, logger)
+	cache.Set([]byte("key"), []byte("v1"), 100)
+	request := func(request, response string) {
+		buf.Reset()
+		parser.Parse([]byte(request))
+		if buf.String() != response {
+			t.Errorf("%q: expected %q, got %q", request, response, buf.String())
+		}
+	}
+	token := func() string {
+		_, version, _ := cache.GetWithVersion([]byte("key"))
+		return strconv.FormatUint(version, 10)
+	}
+
+	v1 := token()
+	request("GETS key", "+GETS "+v1+" v1\r\n")
+	request("CAS key "+v1+" 0 hello world", "+OK\r\n")
+	request("CAS key "+v1+" 0 other", string(ErrExists))
+	v2 := token()
+	request("gets key", "+GETS "+v2+" hello world\r\n")
+	request("CAS missing "+v1+" 0 value", string(ErrNotFound))
+	request("GETS missing", string(ErrNotFound))
+	request("CAS key token 0 value", string(ErrInvalidToken))
+	request("CAS key "+v2+" soon value", string(ErrInvalidExpiration))
+	request("CAS key "+v2+" 0", string(ErrIncompleteCmd))
+	request("CAS key "+v2, string(ErrInvalidArgs))
+	request("GETS", string(ErrInvalidArgs))
+	if ttl, _ := cache.TTL([]byte("key")); ttl != 0 {
+		t.Errorf("expected CAS to replace the TTL, got %d", ttl)
+	}
+
+	// Writing back the same value invalidates the tokens
+	request("SET key 0 hello world", "+OK\r\n")
+	if token() == v2 {
+		t.Fatal("rewriting the value kept its token")
+	}
+	request("CAS key "+v2+" 0 other", string(ErrExists))
+
+	// Length-prefixed values are compared once they arrive
+	framed := NewFramedParser(cache, &buf, logger)
+	buf.Reset()
+	if !framed.Parse([]byte("CAS key "+token()+" 0 4")) || framed.Expect() != 6 {
+		t.Fatalf("expected a 6 byte payload, got %d (%q)", framed.Expect(), buf.String())
+	}
+	framed.ParsePayload([]byte("a\r\nb\r\n"))
+	framed.Parse([]byte("GETS key"))
+	if expected := "+OK\r\n+GETS " + token() + " 4\r\na\r\nb\r\n"; buf.String() != expected {
+		t.Errorf("expected %q, got %q", expected, buf.String())
+	}
+
+	// Only one of the writers holding the same token wins
+	v3 := token()
+	if wins := concurrentWins(cache, func(i int) string {
+		return "CAS key " + v3 + " 0 writer" + strconv.Itoa(i)
+	}); wins != 1 {
+		t.Errorf("expected a single successful CAS, got %d", wins)
+	}
+}
+
+// concurrentWins sends the requests returned by request from 8 connections at
+// once, and returns the number of them which responded with OK.
+func concurrentWins(cache Store, request func(i int) string) int {
+	logger := log.New(ioutil.Discard, "logger: ", log.Lshortfile)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	wins := 0
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			var out bytes.Buffer
+			parser := NewParser(cache, &out, logger)
+			parser.Parse([]byte(request(i)))
+			if out.String() == string(OKResponse) {
+				mu.Lock()
+				wins++
+				mu.Unlock()
+			}
+		}(i)
+	}
+	wg.Wait()
+	return wins
+}
+
+func TestParserConditionalSet(t *testing.T) {
+	cache := NewFreecacheStore(0)
+	logger := log.New(ioutil.Discard, "logger: ", log.Lshortfile)
+	var buf bytes.Buffer
+	parser := NewParser(cache, &buf, logger)
+
+	tests := []struct {
+		request, response string
+	}{
+		{"REPLACE key 0 value", string(ErrNotReplaced)},
+		{"GET key", string(ErrNotFound)},
+		{"ADD key 0 first value", "+OK\r\n"},
+		{"ADD key 0 second", string(ErrNotAdded)},
+		{"GET key", "+VALUE first value\r\n"},
+		{"REPLACE key 100 third", "+OK\r\n"},
+		{"add key 0 fourth", string(ErrNotAdded)},
+		{"GET key", "+VALUE third\r\n"},
+		{"DEL key", "+OK\r\n"},
+		{"ADD key 0 fifth", "+OK\r\n"},
+		{"ADD key soon value", string(ErrInvalidExpiration)},
+		{"REPLACE key", string(ErrInvalidArgs)},
+		{"ADD other 0 " + strings.Repeat("x", 1024), string(ErrLargeEntry)},
+	}
+	for _, test := range tests {
+		buf.Reset()
+		parser.Parse([]byte(test.request))
+		if buf.String() != test.response {
+			t.Errorf("%q: expected %q, got %q", test.request, test.response, buf.String())
+		}
+	}
+
+	// Only one of the concurrent ADDs wins, and REPLACE never creates the key
+	cache.Del([]byte("lock"))
+	for _, test := range []struct {
+		command string
+		wins    int
+	}{
+		{"REPLACE", 0},
+		{"ADD", 1},
+		{"REPLACE", 8},
+	} {
+		if wins := concurrentWins(cache, func(i int) string {
+			return test.command + " lock 10 owner" + strconv.Itoa(i)
+		}); wins != test.wins {
+			t.Errorf("expected %d successful %s, got %d", test.wins, test.command, wins)
+		}
+	}
+}
+
 func BenchmarkParserGet(b *testing.B) {
-	cache := freecache.NewCache(0)
+	cache := NewFreecacheStore(0)
 	logger := log.New(ioutil.Discard, "logger: ", log.Lshortfile)
 	parser := Parser{logger: logger, writer: ioutil.Discard, cache: cache}
 	line := []byte("GET key")
@@ -23,7 +308,7 @@ func BenchmarkParserGet(b *testing.B) {
 }
 
 func BenchmarkParserSet(b *testing.B) {
-	cache := freecache.NewCache(0)
+	cache := NewFreecacheStore(0)
 	logger := log.New(ioutil.Discard, "logger: ", log.Lshortfile)
 	parser := Parser{logger: logger, writer: ioutil.Discard, cache: cache}
 	line := []byte("SET key 0 value")
@@ -32,3 +317,275 @@ func BenchmarkParserSet(b *testing.B) {
 		parser.Parse(line)
 	}
 }
+
+func BenchmarkParserDel(b *testing.B) {
+	cache := NewFreecacheStore(0)
+	logger := log.New(ioutil.Discard, "logger: ", log.Lshortfile)
+	parser := Parser{logger: logger, writer: ioutil.Discard, cache: cache}
+	line := []byte("DEL key")
+	value := []byte("value")
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		cache.Set(line[4:], value, 0)
+		parser.Parse(line)
+	}
+}
+
+type nopFlusher struct{ *bytes.Buffer }
+
+func (nopFlusher) Flush() error { return nil }
+
+// consume pushes raw request bytes through a ByteConsumer, split into chunks
+// of the given size to simulate partial reads.
+func consume(b *ByteConsumer, data []byte, chunk int) {
+	var sequence int64
+	for len(data) > 0 {
+		n := chunk
+		if n > len(data) {
+			n = len(data)
+		}
+		for i := 0; i < n; i++ {
+			b.ring[(sequence+int64(i))&b.mask] = data[i]
+		}
+		b.Consume(sequence, sequence+int64(n)-1)
+		sequence += int64(n)
+		data = data[n:]
+	}
+}
+
+func TestParserMulti(t *testing.T) {
+	cache := NewFreecacheStore(0)
+	logger := log.New(ioutil.Discard, "logger: ", log.Lshortfile)
+	var buf bytes.Buffer
+	parser := NewParser(cache, &buf, logger)
+
+	large := strings.Repeat("x", 1024)
+	tests := []struct {
+		request, response string
+	}{
+		{"MSET a 0 1 b 100 2", "+OK\r\n+OK\r\n+END\r\n"},
+		{"MGET a missing b", "+VALUE 0 1\r\n+MISS 1\r\n+VALUE 2 2\r\n+END\r\n"},
+
+		// the other triples are stored when one of them fails
+		{"MSET c 0 3 d 0 " + large + " e 0 5", "+OK\r\n" + string(ErrLargeEntry) + "+OK\r\n+END\r\n"},
+		{"mget c d e", "+VALUE 0 3\r\n+MISS 1\r\n+VALUE 2 5\r\n+END\r\n"},
+
+		// malformed requests store nothing
+		{"MSET f 0 6 g 0", string(ErrInvalidArgs)},
+		{"MSET f 0 6 g soon 7", string(ErrInvalidExpiration)},
+		{"MGET f", "+MISS 0\r\n+END\r\n"},
+		{"MSET", string(ErrInvalidArgs)},
+		{"MGET", string(ErrInvalidArgs)},
+	}
+	for _, test := range tests {
+		buf.Reset()
+		parser.Parse([]byte(test.request))
+		if buf.String() != test.response {
+			t.Errorf("%q: expected %q, got %q", test.request, test.response, buf.String())
+		}
+	}
+	if ttl, _ := cache.TTL([]byte("b")); ttl < 99 || ttl > 100 {
+		t.Errorf("expected the TTL of b to be set, got %d", ttl)
+	}
+
+	// Length-prefixed values follow the request in a single payload
+	framed := NewFramedParser(cache, &buf, logger)
+	buf.Reset()
+	if !framed.Parse([]byte("MSET h 0 4 i 0 0 j 0 1024")) || framed.Expect() != 4+2+2+1024+2 {
+		t.Fatalf("unexpected payload length %d (%q)", framed.Expect(), buf.String())
+	}
+	framed.ParsePayload([]byte("a\r\nb\r\n\r\n" + large + "\r\n"))
+	if expected := "+OK\r\n+OK\r\n" + string(ErrLargeEntry) + "+END\r\n"; buf.String() != expected {
+		t.Fatalf("expected %q, got %q", expected, buf.String())
+	}
+	buf.Reset()
+	framed.Parse([]byte("MGET h i j"))
+	if expected := "+VALUE 0 4\r\na\r\nb\r\n+VALUE 1 0\r\n\r\n+MISS 2\r\n+END\r\n"; buf.String() != expected {
+		t.Fatalf("expected %q, got %q", expected, buf.String())
+	}
+
+	buf.Reset()
+	framed.Parse([]byte("MSET k 0 1 l 0 1"))
+	framed.ParsePayload([]byte("ab\r\n\r\n"))
+	if buf.String() != string(ErrInvalidValueDelimiter) {
+		t.Fatalf("expected a delimiter error, got %q", buf.String())
+	}
+	if _, err := cache.Get([]byte("k")); err != freecache.ErrNotFound {
+		t.Fatalf("expected a misframed MSET to store nothing, got %v", err)
+	}
+}
+
+func TestParserFlush(t *testing.T) {
+	cache := NewFreecacheStore(0)
+	logger := log.New(ioutil.Discard, "logger: ", log.Lshortfile)
+	var buf bytes.Buffer
+	parser := NewParser(cache, &buf, logger)
+
+	for _, key := range []string{"user:1", "user:2", "session:1", "use"} {
+		cache.Set([]byte(key), []byte("value"), 0)
+	}
+	request := func(request, response string) {
+		buf.Reset()
+		parser.Parse([]byte(request))
+		if buf.String() != response {
+			t.Fatalf("%q: expected %q, got %q", request, response, buf.String())
+		}
+	}
+
+	// Without an admin password the commands are disabled
+	request("AUTH secret", string(ErrAuthDisabled))
+	request("FLUSHALL", string(ErrNoPermission))
+
+	parser.password = "secret"
+	request("FLUSH user:", string(ErrNoPermission))
+	request("AUTH wrong", string(ErrInvalidPassword))
+	request("FLUSHALL", string(ErrNoPermission))
+	request("AUTH secret", "+OK\r\n")
+	request("FLUSH", string(ErrInvalidArgs))
+	request("FLUSH user:", "+FLUSHED 2\r\n")
+	request("flush user:", "+FLUSHED 0\r\n")
+	if stats := cache.Stats(); stats.Entries != 2 {
+		t.Fatalf("expected 2 entries left, got %d", stats.Entries)
+	}
+	request("FLUSHALL", "+OK\r\n")
+	if stats := cache.Stats(); stats.Entries != 0 {
+		t.Fatalf("expected no entries left, got %d", stats.Entries)
+	}
+
+	// A failed AUTH revokes the permission
+	request("AUTH wrong", string(ErrInvalidPassword))
+	request("FLUSHALL", string(ErrNoPermission))
+}
+
+func TestParserLengthFraming(t *testing.T) {
+	cache := NewFreecacheStore(0)
+	logger := log.New(ioutil.Discard, "logger: ", log.Lshortfile)
+	var buf bytes.Buffer
+	parser := NewFramedParser(cache, &buf, logger)
+
+	if !parser.Parse([]byte("SET key 0 5")) {
+		t.Fatalf("SET header failed: %q", buf.String())
+	}
+	if parser.Expect() != 7 {
+		t.Fatalf("expected 7 payload bytes, got %d", parser.Expect())
+	}
+	if !parser.ParsePayload([]byte("a\r\nb\n\r\n")) {
+		t.Fatalf("SET payload failed: %q", buf.String())
+	}
+	if parser.Expect() != 0 {
+		t.Fatal("parser still expects a payload")
+	}
+
+	buf.Reset()
+	if !parser.Parse([]byte("GET key")) {
+		t.Fatalf("GET failed: %q", buf.String())
+	}
+	if expected := "+VALUE 5\r\na\r\nb\n\r\n"; buf.String() != expected {
+		t.Fatalf("expected %q, got %q", expected, buf.String())
+	}
+
+	for _, line := range []string{"SET key 0 x", "SET key 0 -1", "SET key 0 "} {
+		buf.Reset()
+		if parser.Parse([]byte(line)) || !bytes.Equal(buf.Bytes(), ErrInvalidLength) {
+			t.Fatalf("%q: expected %q, got %q", line, ErrInvalidLength, buf.String())
+		}
+	}
+
+	buf.Reset()
+	parser.Parse([]byte("SET key 0 1"))
+	if parser.ParsePayload([]byte("abc")) || !bytes.Equal(buf.Bytes(), ErrInvalidValueDelimiter) {
+		t.Fatalf("expected %q, got %q", ErrInvalidValueDelimiter, buf.String())
+	}
+}
+
+func TestByteConsumerBinaryValues(t *testing.T) {
+	cache := NewFreecacheStore(0)
+	logger := log.New(ioutil.Discard, "logger: ", log.Lshortfile)
+	value := make([]byte, 256)
+	for i := range value {
+		value[i] = byte(i)
+	}
+
+	var request bytes.Buffer
+	request.WriteString("SET bin 0 256\r\n")
+	request.Write(value)
+	request.WriteString("\r\nSET empty 0 0\r\n\r\nGET bin\r\nGET empty\r\n")
+
+	for _, chunk := range []int{1, 7, request.Len()} {
+		var buf bytes.Buffer
+		w := nopFlusher{&buf}
+		b := NewByteConsumer(w, nil, NewFramedParser(cache, w, logger), make([]byte, RingBufferCapacity), DefaultMaxRequestSize, logger)
+		consume(b, request.Bytes(), chunk)
+
+		var expected bytes.Buffer
+		expected.Write(OKResponse)
+		expected.Write(OKResponse)
+		expected.WriteString("+VALUE 256\r\n")
+		expected.Write(value)
+		expected.WriteString("\r\n+VALUE 0\r\n\r\n")
+		if !bytes.Equal(buf.Bytes(), expected.Bytes()) {
+			t.Fatalf("chunk %d: unexpected response %q", chunk, buf.String())
+		}
+	}
+}
+
+func TestByteConsumerPayloadTooLarge(t *testing.T) {
+	cache := NewFreecacheStore(0)
+	logger := log.New(ioutil.Discard, "logger: ", log.Lshortfile)
+	var buf bytes.Buffer
+	w := nopFlusher{&buf}
+	b := NewByteConsumer(w, nil, NewFramedParser(cache, w, logger), make([]byte, RingBufferCapacity), DefaultMaxRequestSize, logger)
+
+	var request bytes.Buffer
+	request.WriteString("SET big 0 100000\r\n")
+	request.Write(bytes.Repeat([]byte{'\n'}, 100000))
+	request.WriteString("\r\nDEL big\r\n")
+	consume(b, request.Bytes(), 4096)
+
+	expected := string(ErrMaxSize) + string(ErrNotFound)
+	if buf.String() != expected {
+		t.Fatalf("expected %q, got %q", expected, buf.String())
+	}
+}
+
+func TestParserSetValue(t *testing.T) {
+	cache := NewFreecacheStore(0)
+	logger := log.New(ioutil.Discard, "logger: ", log.Lshortfile)
+	parser := NewParser(cache, ioutil.Discard, logger)
+
+	parser.Parse([]byte("SET key 0 some value"))
+	if v, _ := cache.Get([]byte("key")); string(v) != "some value" {
+		t.Fatalf("expected %q, got %q", "some value", v)
+	}
+}
+
+func TestByteConsumerLineTooLarge(t *testing.T) {
+	cache := NewFreecacheStore(0)
+	logger := log.New(ioutil.Discard, "logger: ", log.Lshortfile)
+	var buf bytes.Buffer
+	w := nopFlusher{&buf}
+	b := NewByteConsumer(w, nil, NewParser(cache, w, logger), make([]byte, 1024), 16, logger)
+
+	consume(b, []byte("SET key 0 "+strings.Repeat("x", 100)+"\r\nSET key 0 value\r\nGET key\r\n"), 7)
+	expected := string(ErrMaxSize) + string(OKResponse) + "+VALUE value\r\n"
+	if buf.String() != expected {
+		t.Fatalf("expected %q, got %q", expected, buf.String())
+	}
+}
+
+func TestByteConsumerGrowsBuffer(t *testing.T) {
+	cache := NewFreecacheStore(64 * 1024 * 1024)
+	logger := log.New(ioutil.Discard, "logger: ", log.Lshortfile)
+	var buf bytes.Buffer
+	w := nopFlusher{&buf}
+	b := NewByteConsumer(w, nil, NewFramedParser(cache, w, logger), make([]byte, 1024), DefaultMaxRequestSize, logger)
+
+	value := bytes.Repeat([]byte("x\n"), 10*1024)
+	consume(b, []byte("SET key 0 "+strconv.Itoa(len(value))+"\r\n"+string(value)+"\r\n"), 1000)
+	if !bytes.Equal(buf.Bytes(), OKResponse) {
+		t.Fatalf("expected %q, got %q", OKResponse, buf.String())
+	}
+	if v, _ := cache.Get([]byte("key")); !bytes.Equal(v, value) {
+		t.Fatal("value corrupted")
+	}
+}
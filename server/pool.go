@@ -0,0 +1,41 @@
+package server
+
+import "sync"
+
+// bufferPool recycles equally sized buffers between connections, so opening a
+// connection does not allocate and zero several megabytes.
+type bufferPool struct {
+	size int
+	pool sync.Pool
+}
+
+func newBufferPool(size int) *bufferPool {
+	p := &bufferPool{size: size}
+	p.pool.New = func() interface{} {
+		return make([]byte, size)
+	}
+	return p
+}
+
+func (p *bufferPool) Get() []byte {
+	return p.pool.Get().([]byte)
+}
+
+func (p *bufferPool) Put(b []byte) {
+	if len(b) == p.size {
+		p.pool.Put(b)
+	}
+}
+
+// handlerPools holds the pools for the buffers of a tcpHandler.
+type handlerPools struct {
+	ring, read, write *bufferPool
+}
+
+func newHandlerPools(options Options) *handlerPools {
+	return &handlerPools{
+		ring:  newBufferPool(options.RingSize),
+		read:  newBufferPool(options.ReadBufferSize),
+		write: newBufferPool(options.WriteBufferSize),
+	}
+}
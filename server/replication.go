@@ -0,0 +1,785 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// Replication
+//
+// A replica connects to the mulu listener of its primary and requests a full
+// copy of the cache:
+//
+//	SYNC <replica id>
+//	+SYNC <run id> <offset>\r\n<snapshot>
+//
+// The snapshot reflects every write before offset, and possibly some after
+// it. The replica then polls for the writes from offset onwards, which the
+// primary keeps in a ring buffer:
+//
+//	PSYNC <replica id> <run id> <offset>
+//	+PSYNC <offset> <primary offset> <length>\r\n<records>\r\n
+//
+// Records use the append-only log encoding and may be split across responses.
+// The primary waits up to ReplicationPollInterval for new writes before
+// responding with no records. It answers -ERRRESYNC if the run id changed or
+// offset has left the ring, and the replica starts over with SYNC.
+
+const (
+	ReplicationPollInterval = 100 * time.Millisecond
+
+	// largest number of record bytes sent in a single PSYNC response
+	replicationMaxChunk = 1024 * 1024
+
+	// replicas which have not polled for this long are no longer listed
+	replicationReplicaTimeout = 10 * time.Second
+)
+
+// Responses of the replication commands
+var ErrReplicationDisabled = []byte("-ERRREPL Replication is not enabled\r\n")
+var ErrResync = []byte("-ERRRESYNC Full resynchronization required\r\n")
+var ErrReadOnly = []byte("-ERRREADONLY Replicas do not accept writes\r\n")
+var ErrInvalidOffset = []byte("-ERRREPL Invalid offset\r\n")
+var SyncPrefix = []byte("+SYNC ")
+var PSyncPrefix = []byte("+PSYNC ")
+var StatPrefix = []byte("+STAT ")
+var EndResponse = []byte("+END\r\n")
+
+var errResync = errors.New("replication: Full resynchronization required")
+
+// ErrReplicaWrite is returned by the write methods of a Server which is a
+// replica.
+var ErrReplicaWrite = errors.New("replication: Replicas do not accept writes")
+
+// cacheWriter applies the writes made over the mulu protocol. The append-only
+// log and the replication backlog wrap the cache to record the writes in the
+// order they are applied.
+type cacheWriter interface {
+	Set(key, value []byte, expiration int) error
+	Del(key []byte) (bool, error)
+
+	// Update and CompareAndSwap are recorded as sets of the new entry.
+	Update(key []byte, fn UpdateFunc) (found, updated bool, err error)
+	CompareAndSwap(key []byte, version uint64, value []byte, expiration int) (found, swapped bool, err error)
+
+	Clear() error
+}
+
+// updatedEntry keeps the entry returned by the last call of an UpdateFunc so
+// it can be recorded once the update is applied.
+type updatedEntry struct {
+	value    []byte
+	expireAt uint32
+}
+
+func (u *updatedEntry) wrap(fn UpdateFunc) UpdateFunc {
+	return func(value []byte, expireAt uint32, found bool) ([]byte, int, bool) {
+		newValue, expiration, ok := fn(value, expireAt, found)
+		u.value, u.expireAt = newValue, absoluteExpiration(expiration)
+		return newValue, expiration, ok
+	}
+}
+
+// directWriter applies writes to the cache without recording them.
+type directWriter struct {
+	cache Store
+}
+
+func (d directWriter) Set(key, value []byte, expiration int) error {
+	return d.cache.Set(key, value, expiration)
+}
+
+func (d directWriter) Del(key []byte) (bool, error) {
+	return d.cache.Del(key), nil
+}
+
+func (d directWriter) Update(key []byte, fn UpdateFunc) (bool, bool, error) {
+	return d.cache.Update(key, fn)
+}
+
+func (d directWriter) CompareAndSwap(key []byte, version uint64, value []byte, expiration int) (bool, bool, error) {
+	return d.cache.CompareAndSwap(key, version, value, expiration)
+}
+
+func (d directWriter) Clear() error {
+	d.cache.Clear()
+	return nil
+}
+
+// applyRecord applies a decoded append-only log record. Entries which have
+// expired since they were written are deleted.
+func applyRecord(w cacheWriter, op byte, key, value []byte, expireAt uint32) error {
+	switch op {
+	case appendLogSet:
+		expiration := 0
+		if expireAt != 0 {
+			if expiration = int(int64(expireAt) - time.Now().Unix()); expiration <= 0 {
+				_, err := w.Del(key)
+				return err
+			}
+		}
+		return w.Set(key, value, expiration)
+	case appendLogDel:
+		_, err := w.Del(key)
+		return err
+	case appendLogClear:
+		return w.Clear()
+	}
+	return ErrAppendLogFormat
+}
+
+// decodeRecord decodes the first record of data. It returns n == 0 if data
+// does not hold a complete record.
+func decodeRecord(data []byte) (op byte, key, value []byte, expireAt uint32, n int, err error) {
+	if len(data) < appendLogRecordSize {
+		return
+	}
+	keyLen := int(binary.BigEndian.Uint32(data[5:]))
+	valueLen := int(binary.BigEndian.Uint32(data[9:]))
+	if keyLen > 65535 || valueLen < 0 || keyLen+valueLen < 0 {
+		err = ErrAppendLogFormat
+		return
+	}
+	size := appendLogRecordSize + keyLen + valueLen
+	if len(data) < size {
+		return
+	}
+	if crc32.Checksum(data[4:size], snapshotTable) != binary.BigEndian.Uint32(data) {
+		err = ErrAppendLogFormat
+		return
+	}
+	key = data[appendLogRecordSize : appendLogRecordSize+keyLen]
+	value = data[appendLogRecordSize+keyLen : size]
+	return data[4], key, value, binary.BigEndian.Uint32(data[13:]), size, nil
+}
+
+// ReplicaStatus describes a replica, as seen by the primary or by the replica
+// itself.
+type ReplicaStatus struct {
+	// Address of the replica on the primary, or of the primary on the replica
+	Addr string
+
+	// connecting, syncing or online
+	State string
+
+	// Offset of the replica, and of the primary when it was last contacted
+	Offset        int64
+	PrimaryOffset int64
+
+	// Bytes and time by which the replica is behind the primary
+	LagBytes int64
+	Lag      time.Duration
+}
+
+// replicationBacklog keeps the last writes made on a primary so replicas can
+// catch up with them. Writes to a key are applied to the cache and recorded
+// under the lock of its stripe, in the order of the cache. The ring itself is
+// only locked to append them, so replicas reading it do not wait for the
+// append-only log to be synced.
+type replicationBacklog struct {
+	next    cacheWriter
+	runid   string
+	stripes [backlogStripes]sync.Mutex
+
+	mu     sync.Mutex
+	ring   []byte
+	buf    []byte
+	end    int64
+	notify chan struct{}
+
+	replicas map[string]*backlogReplica
+}
+
+// Number of locks ordering the writes of the backlog by key
+const backlogStripes = 256
+
+type backlogReplica struct {
+	offset   int64
+	seen     time.Time
+	caughtUp time.Time
+}
+
+func newReplicationBacklog(next cacheWriter, size int) *replicationBacklog {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return &replicationBacklog{
+		next:     next,
+		runid:    hex.EncodeToString(id),
+		ring:     make([]byte, size),
+		notify:   make(chan struct{}),
+		replicas: make(map[string]*backlogReplica),
+	}
+}
+
+func (b *replicationBacklog) Set(key, value []byte, expiration int) error {
+	var expireAt uint32
+	if expiration > 0 {
+		expireAt = uint32(time.Now().Unix()) + uint32(expiration)
+	}
+
+	stripe := b.stripe(key)
+	stripe.Lock()
+	defer stripe.Unlock()
+	if err := b.next.Set(key, value, expiration); err != nil {
+		return err
+	}
+	b.append(appendLogSet, key, value, expireAt)
+	return nil
+}
+
+func (b *replicationBacklog) Del(key []byte) (bool, error) {
+	stripe := b.stripe(key)
+	stripe.Lock()
+	defer stripe.Unlock()
+	ok, err := b.next.Del(key)
+	if ok {
+		b.append(appendLogDel, key, nil, 0)
+	}
+	return ok, err
+}
+
+func (b *replicationBacklog) Update(key []byte, fn UpdateFunc) (found, updated bool, err error) {
+	var entry updatedEntry
+	stripe := b.stripe(key)
+	stripe.Lock()
+	defer stripe.Unlock()
+	found, updated, err = b.next.Update(key, entry.wrap(fn))
+	if updated && err == nil {
+		b.append(appendLogSet, key, entry.value, entry.expireAt)
+	}
+	return found, updated, err
+}
+
+func (b *replicationBacklog) CompareAndSwap(key []byte, version uint64, value []byte, expiration int) (found, swapped bool, err error) {
+	expireAt := absoluteExpiration(expiration)
+	stripe := b.stripe(key)
+	stripe.Lock()
+	defer stripe.Unlock()
+	found, swapped, err = b.next.CompareAndSwap(key, version, value, expiration)
+	if swapped && err == nil {
+		b.append(appendLogSet, key, value, expireAt)
+	}
+	return found, swapped, err
+}
+
+// Clear waits for the writes in progress on every key.
+func (b *replicationBacklog) Clear() error {
+	for i := range b.stripes {
+		b.stripes[i].Lock()
+		defer b.stripes[i].Unlock()
+	}
+	if err := b.next.Clear(); err != nil {
+		return err
+	}
+	b.append(appendLogClear, nil, nil, 0)
+	return nil
+}
+
+// stripe returns the lock ordering the writes of key.
+func (b *replicationBacklog) stripe(key []byte) *sync.Mutex {
+	return &b.stripes[hashKey(key)%backlogStripes]
+}
+
+// append records a write which was applied to the cache.
+func (b *replicationBacklog) append(op byte, key, value []byte, expireAt uint32) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.buf = appendRecord(b.buf[:0], op, key, value, expireAt)
+	data := b.buf
+	if len(data) > len(b.ring) {
+		// only the tail fits, replicas before it have to resync
+		b.end += int64(len(data) - len(b.ring))
+		data = data[len(data)-len(b.ring):]
+	}
+	for len(data) > 0 {
+		n := copy(b.ring[b.end%int64(len(b.ring)):], data)
+		data = data[n:]
+		b.end += int64(n)
+	}
+	close(b.notify)
+	b.notify = make(chan struct{})
+}
+
+// offset returns the offset of the next write.
+func (b *replicationBacklog) offset() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.end
+}
+
+// read appends the records from offset onwards to dst, waiting up to timeout
+// for new writes if there are none. It returns errResync if offset is no
+// longer in the ring.
+func (b *replicationBacklog) read(id string, offset int64, dst []byte, timeout time.Duration) ([]byte, int64, error) {
+	b.mu.Lock()
+	if offset == b.end && timeout > 0 {
+		notify := b.notify
+		b.mu.Unlock()
+		select {
+		case <-notify:
+		case <-time.After(timeout):
+		}
+		b.mu.Lock()
+	}
+	defer b.mu.Unlock()
+
+	start := b.end - int64(len(b.ring))
+	if start < 0 {
+		start = 0
+	}
+	if offset < start || offset > b.end {
+		return dst, b.end, errResync
+	}
+
+	n := b.end - offset
+	if n > replicationMaxChunk {
+		n = replicationMaxChunk
+	}
+	for pos := offset; pos < offset+n; {
+		i := pos % int64(len(b.ring))
+		j := i + (offset + n - pos)
+		if j > int64(len(b.ring)) {
+			j = int64(len(b.ring))
+		}
+		dst = append(dst, b.ring[i:j]...)
+		pos += j - i
+	}
+
+	// The poll acknowledges everything before offset
+	now := time.Now()
+	r := b.replicas[id]
+	if r == nil {
+		r = &backlogReplica{caughtUp: now}
+		b.replicas[id] = r
+	}
+	r.offset, r.seen = offset, now
+	if offset == b.end {
+		r.caughtUp = now
+	}
+	return dst, b.end, nil
+}
+
+// register starts tracking a replica which is about to receive a snapshot.
+func (b *replicationBacklog) register(id string, offset int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	b.replicas[id] = &backlogReplica{offset: offset, seen: now, caughtUp: now}
+}
+
+// status lists the replicas which polled recently.
+func (b *replicationBacklog) status() (offset int64, replicas []ReplicaStatus) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	for id, r := range b.replicas {
+		if now.Sub(r.seen) > replicationReplicaTimeout {
+			delete(b.replicas, id)
+			continue
+		}
+		status := ReplicaStatus{Addr: id, State: "online", Offset: r.offset, PrimaryOffset: b.end, LagBytes: b.end - r.offset}
+		if status.LagBytes > 0 {
+			status.Lag = now.Sub(r.caughtUp)
+		}
+		replicas = append(replicas, status)
+	}
+	return b.end, replicas
+}
+
+// replica keeps the cache of a server in sync with a primary.
+type replica struct {
+	cache    Store
+	writes   cacheWriter
+	addr     string
+	password string
+	logger   *log.Logger
+
+	// reads from the primary fail after this long without data
+	timeout time.Duration
+
+	// called after a full resynchronization replaced the cache
+	synced func()
+
+	mu            sync.Mutex
+	state         string
+	runid         string
+	offset        int64
+	primaryOffset int64
+	caughtUp      time.Time
+
+	done chan struct{}
+}
+
+// newReplica creates a replica of the primary at addr, which it authenticates
+// to with the password unless it is empty.
+func newReplica(cache Store, writes cacheWriter, addr, password string, logger *log.Logger) *replica {
+	return &replica{
+		cache:    cache,
+		writes:   writes,
+		addr:     addr,
+		password: password,
+		logger:   logger,
+		timeout:  replicationReplicaTimeout,
+		state:    "connecting",
+		done:     make(chan struct{}),
+	}
+}
+
+// run replicates the primary until ctx is done, reconnecting with a growing
+// delay when the connection fails.
+func (r *replica) run(ctx context.Context) {
+	defer close(r.done)
+	delay := 100 * time.Millisecond
+	for {
+		start := time.Now()
+		err := r.replicate(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		r.setState("connecting")
+		r.logger.Println("[WRN] Replication failed", "primary", r.addr, "error", err)
+
+		if time.Since(start) > 10*time.Second {
+			delay = 100 * time.Millisecond
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		if delay *= 2; delay > 5*time.Second {
+			delay = 5 * time.Second
+		}
+	}
+}
+
+func (r *replica) setState(state string) {
+	r.mu.Lock()
+	r.state = state
+	r.mu.Unlock()
+}
+
+// replicate runs a single connection to the primary.
+func (r *replica) replicate(ctx context.Context) error {
+	conn, err := net.DialTimeout("tcp", r.addr, 5*time.Second)
+	if err != nil {
+		return err
+	}
+	closed := make(chan struct{})
+	defer close(closed)
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-closed:
+		}
+		conn.Close()
+	}()
+
+	// A snapshot may take longer than the timeout to arrive, so the read
+	// deadline is renewed for each chunk rather than each response
+	id := conn.LocalAddr().String()
+	reader := bufio.NewReader(deadlineReader{conn, r.timeout})
+	if r.password != "" {
+		conn.SetDeadline(time.Now().Add(r.timeout))
+		fmt.Fprintf(conn, "AUTH %s\r\n", r.password)
+		line, err := readLine(reader)
+		if err != nil {
+			return err
+		} else if !bytes.Equal(line, OKResponse[:len(OKResponse)-len(CRLF)]) {
+			return fmt.Errorf("replication: Authentication failed: %s", line)
+		}
+	}
+	r.mu.Lock()
+	runid, offset := r.runid, r.offset
+	r.mu.Unlock()
+
+	if runid == "" {
+		if runid, offset, err = r.fullSync(conn, reader, id); err != nil {
+			return err
+		}
+	}
+
+	var pending, line []byte
+	for {
+		conn.SetDeadline(time.Now().Add(r.timeout))
+		received := offset + int64(len(pending))
+		fmt.Fprintf(conn, "PSYNC %s %s %d\r\n", id, runid, received)
+
+		if line, err = readLine(reader); err != nil {
+			return err
+		}
+		if bytes.HasPrefix(line, []byte("-ERRRESYNC")) {
+			r.logger.Println("[INFO] Replica lost its position, resynchronizing", "primary", r.addr, "offset", received)
+			pending = pending[:0]
+			if runid, offset, err = r.fullSync(conn, reader, id); err != nil {
+				return err
+			}
+			continue
+		}
+		fields := strings.Fields(string(line))
+		if len(fields) != 4 || fields[0] != strings.TrimSpace(string(PSyncPrefix)) {
+			return fmt.Errorf("replication: Unexpected response %q", line)
+		}
+		end, e1 := strconv.ParseInt(fields[2], 10, 64)
+		length, e2 := strconv.Atoi(fields[3])
+		if e1 != nil || e2 != nil || length < 0 {
+			return fmt.Errorf("replication: Unexpected response %q", line)
+		}
+
+		start := len(pending)
+		pending = append(pending, make([]byte, length+len(CRLF))...)
+		if _, err = io.ReadFull(reader, pending[start:]); err != nil {
+			return err
+		}
+		pending = pending[:len(pending)-len(CRLF)]
+
+		// Apply the complete records and keep the rest for the next poll
+		applied := 0
+		for {
+			op, key, value, expireAt, n, err := decodeRecord(pending[applied:])
+			if err != nil {
+				return err
+			} else if n == 0 {
+				break
+			}
+			if err := applyRecord(r.writes, op, key, value, expireAt); err != nil {
+				r.logger.Println("[WRN] Replicated write failed", "key", strconv.Quote(string(key)), "error", err)
+			}
+			applied += n
+		}
+		offset += int64(applied)
+		pending = append(pending[:0], pending[applied:]...)
+
+		r.mu.Lock()
+		r.offset, r.primaryOffset, r.state = offset, end, "online"
+		if offset+int64(len(pending)) >= end {
+			r.caughtUp = time.Now()
+		}
+		r.mu.Unlock()
+	}
+}
+
+// fullSync replaces the cache with a snapshot of the primary.
+func (r *replica) fullSync(conn net.Conn, reader *bufio.Reader, id string) (runid string, offset int64, err error) {
+	r.setState("syncing")
+	conn.SetDeadline(time.Now().Add(r.timeout))
+	fmt.Fprintf(conn, "SYNC %s\r\n", id)
+
+	line, err := readLine(reader)
+	if err != nil {
+		return
+	}
+	fields := strings.Fields(string(line))
+	if len(fields) != 3 || fields[0] != strings.TrimSpace(string(SyncPrefix)) {
+		return "", 0, fmt.Errorf("replication: Unexpected response %q", line)
+	}
+	if offset, err = strconv.ParseInt(fields[2], 10, 64); err != nil {
+		return
+	}
+	runid = fields[1]
+
+	start := time.Now()
+	r.cache.Clear()
+	loaded, _, err := ReadSnapshot(reader, r.cache)
+	if err != nil {
+		return
+	}
+	r.logger.Println("[INFO] Replica synchronized", "primary", r.addr, "entries", loaded, "offset", offset, "duration", time.Since(start))
+	if r.synced != nil {
+		r.synced()
+	}
+
+	r.mu.Lock()
+	r.runid, r.offset, r.primaryOffset = runid, offset, offset
+	r.mu.Unlock()
+	return
+}
+
+// status describes the replication from the replica side.
+func (r *replica) status() ReplicaStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	status := ReplicaStatus{
+		Addr:          r.addr,
+		State:         r.state,
+		Offset:        r.offset,
+		PrimaryOffset: r.primaryOffset,
+		LagBytes:      r.primaryOffset - r.offset,
+	}
+	if status.LagBytes > 0 || r.state != "online" {
+		if !r.caughtUp.IsZero() {
+			status.Lag = time.Since(r.caughtUp)
+		}
+	}
+	return status
+}
+
+// deadlineReader fails reads which block for longer than the timeout, so that
+// a replica reconnects to a primary which stalled.
+type deadlineReader struct {
+	conn    net.Conn
+	timeout time.Duration
+}
+
+func (d deadlineReader) Read(p []byte) (int, error) {
+	d.conn.SetReadDeadline(time.Now().Add(d.timeout))
+	return d.conn.Read(p)
+}
+
+// readLine reads a response line without its terminator.
+func readLine(reader *bufio.Reader) ([]byte, error) {
+	line, err := reader.ReadSlice('\n')
+	if err != nil {
+		return nil, err
+	}
+	return bytes.TrimRight(line, "\r\n"), nil
+}
+
+// SYNC sends a snapshot of the cache to a replica.
+func (p *Parser) sync(args [][]byte) bool {
+	if len(args) != 1 {
+		return p.fail(ErrInvalidArgs, nil)
+	} else if !p.authorizeReplication() {
+		return false
+	}
+	if p.backlog == nil {
+		return p.fail(ErrReplicationDisabled, nil)
+	}
+
+	// Writes after offset are replayed by the replica, so it does not matter
+	// whether the snapshot includes them.
+	offset := p.backlog.offset()
+	p.backlog.register(string(args[0]), offset)
+	p.scratch = append(p.scratch[:0], SyncPrefix...)
+	p.scratch = append(p.scratch, p.backlog.runid...)
+	p.scratch = append(p.scratch, ' ')
+	p.scratch = strconv.AppendInt(p.scratch, offset, 10)
+	p.scratch = append(p.scratch, CRLF...)
+	if _, err := p.writer.Write(p.scratch); err != nil {
+		return false
+	}
+	p.logger.Println("[INFO] Sending snapshot to replica", "replica", string(args[0]), "offset", offset)
+	if _, err := WriteSnapshot(p.writer, p.cache); err != nil {
+		p.logger.Println("[ERR] Failed to send snapshot to replica", "replica", string(args[0]), "error", err)
+		p.closed = true
+		return false
+	}
+	return true
+}
+
+// PSYNC sends the writes since the given offset to a replica.
+func (p *Parser) psync(args [][]byte) bool {
+	if len(args) != 3 {
+		return p.fail(ErrInvalidArgs, nil)
+	} else if !p.authorizeReplication() {
+		return false
+	}
+	if p.backlog == nil {
+		return p.fail(ErrReplicationDisabled, nil)
+	}
+	offset, err := strconv.ParseInt(string(args[2]), 10, 64)
+	if err != nil || offset < 0 {
+		return p.fail(ErrInvalidOffset, nil)
+	}
+	if string(args[1]) != p.backlog.runid {
+		return p.fail(ErrResync, nil)
+	}
+
+	// Records are written after the header, reusing the scratch buffer
+	records, end, err := p.backlog.read(string(args[0]), offset, p.records[:0], ReplicationPollInterval)
+	p.records = records
+	if err != nil {
+		return p.fail(ErrResync, nil)
+	}
+	p.scratch = append(p.scratch[:0], PSyncPrefix...)
+	p.scratch = strconv.AppendInt(p.scratch, offset, 10)
+	p.scratch = append(p.scratch, ' ')
+	p.scratch = strconv.AppendInt(p.scratch, end, 10)
+	p.scratch = append(p.scratch, ' ')
+	p.scratch = strconv.AppendInt(p.scratch, int64(len(records)), 10)
+	p.scratch = append(p.scratch, CRLF...)
+	if _, err := p.writer.Write(p.scratch); err != nil {
+		return false
+	}
+	if _, err := p.writer.Write(records); err != nil {
+		return false
+	}
+	_, err = p.writer.Write(CRLF)
+	return err == nil
+}
+
+// ROLE responds with +ROLE primary or +ROLE replica.
+func (p *Parser) role(args [][]byte) bool {
+	if len(args) != 0 {
+		return p.fail(ErrInvalidArgs, nil)
+	}
+	role := "+ROLE primary\r\n"
+	if p.replica != nil {
+		role = "+ROLE replica\r\n"
+	}
+	_, err := io.WriteString(p.writer, role)
+	return err == nil
+}
+
+// REPLICAINFO describes the replication state as +STAT <name> <value> lines
+// followed by +END. Lag is reported in bytes and seconds.
+func (p *Parser) replicainfo(args [][]byte) bool {
+	if len(args) != 0 {
+		return p.fail(ErrInvalidArgs, nil)
+	}
+
+	p.scratch = p.scratch[:0]
+	if p.replica != nil {
+		status := p.replica.status()
+		p.appendStat("role", "replica")
+		p.appendStat("primary", status.Addr)
+		p.appendStat("state", status.State)
+		p.appendStat("offset", strconv.FormatInt(status.Offset, 10))
+		p.appendStat("primary_offset", strconv.FormatInt(status.PrimaryOffset, 10))
+		p.appendStat("lag_bytes", strconv.FormatInt(status.LagBytes, 10))
+		p.appendStat("lag_seconds", strconv.FormatFloat(status.Lag.Seconds(), 'f', 3, 64))
+	} else {
+		var offset int64
+		var replicas []ReplicaStatus
+		if p.backlog != nil {
+			offset, replicas = p.backlog.status()
+		}
+		p.appendStat("role", "primary")
+		p.appendStat("offset", strconv.FormatInt(offset, 10))
+		p.appendStat("replicas", strconv.Itoa(len(replicas)))
+		for i, status := range replicas {
+			prefix := "replica" + strconv.Itoa(i) + "_"
+			p.appendStat(prefix+"addr", status.Addr)
+			p.appendStat(prefix+"offset", strconv.FormatInt(status.Offset, 10))
+			p.appendStat(prefix+"lag_bytes", strconv.FormatInt(status.LagBytes, 10))
+			p.appendStat(prefix+"lag_seconds", strconv.FormatFloat(status.Lag.Seconds(), 'f', 3, 64))
+		}
+	}
+	p.scratch = append(p.scratch, EndResponse...)
+	_, err := p.writer.Write(p.scratch)
+	return err == nil
+}
+
+// appendStat appends a +STAT line to the scratch buffer.
+func (p *Parser) appendStat(name, value string) {
+	p.scratch = append(p.scratch, StatPrefix...)
+	p.scratch = append(p.scratch, name...)
+	p.scratch = append(p.scratch, ' ')
+	p.scratch = append(p.scratch, value...)
+	p.scratch = append(p.scratch, CRLF...)
+}
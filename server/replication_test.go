@@ -0,0 +1,484 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/coocood/freecache"
+	"golang.org/x/net/context"
+)
+
+// testClient sends mulu requests over a connection.
+type testClient struct {
+	t      *testing.T
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func dialTestClient(t *testing.T, addr string) *testClient {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testClient{t, conn, bufio.NewReader(conn)}
+}
+
+// do sends a request and returns the first response line.
+func (c *testClient) do(request string) string {
+	c.conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := c.conn.Write([]byte(request + "\r\n")); err != nil {
+		c.t.Fatal(err)
+	}
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return line
+}
+
+// stats sends a request answered by +STAT lines and returns them as a map.
+func (c *testClient) stats(request string) map[string]string {
+	stats := make(map[string]string)
+	for line := c.do(request); line != string(EndResponse); line = c.readLine() {
+		fields := strings.SplitN(strings.TrimSpace(line), " ", 3)
+		if len(fields) != 3 || fields[0] != "+STAT" {
+			c.t.Fatalf("unexpected stat line %q", line)
+		}
+		stats[fields[1]] = fields[2]
+	}
+	return stats
+}
+
+func (c *testClient) readLine() string {
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return line
+}
+
+// eventually retries the condition for up to 5 seconds.
+func eventually(t *testing.T, message string, condition func() bool) {
+	for deadline := time.Now().Add(5 * time.Second); !condition(); {
+		if time.Now().After(deadline) {
+			t.Fatal(message)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func hasValue(cache Store, key, expected string) bool {
+	value, err := cache.Get([]byte(key))
+	return err == nil && string(value) == expected
+}
+
+func startReplicationPair(t *testing.T, addr string) (primary, replica *Server) {
+	logger := log.New(ioutil.Discard, "", 0)
+	primary, err := NewServerWithOptions(Options{CacheSize: 1024 * 1024, ReplicationBacklogSize: 64 * 1024, Logger: logger})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := primary.Start(addr); err != nil {
+		t.Fatal(err)
+	}
+	replica, err = NewServerWithOptions(Options{CacheSize: 1024 * 1024, ReplicaOf: primary.Addr().String(), Logger: logger})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := replica.Start("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	return primary, replica
+}
+
+func TestReplication(t *testing.T) {
+	primary, replica := startReplicationPair(t, "127.0.0.1:0")
+	defer primary.Stop(context.Background())
+	defer replica.Stop(context.Background())
+
+	// Entries written before the replica connected arrive with the snapshot
+	primary.Cache().Set([]byte("before"), []byte("snapshot"), 0)
+	eventually(t, "snapshot not replicated", func() bool {
+		return hasValue(replica.Cache(), "before", "snapshot")
+	})
+
+	client := dialTestClient(t, primary.Addr().String())
+	defer client.conn.Close()
+	for _, request := range []string{"SET key 0 value", "SET ttl 100 expiring", "SET deleted 0 value", "DEL deleted", "EXPIRE key 500"} {
+		if response := client.do(request); response != string(OKResponse) {
+			t.Fatalf("%q: unexpected response %q", request, response)
+		}
+	}
+	eventually(t, "writes not replicated", func() bool {
+		_, err := replica.Cache().Get([]byte("deleted"))
+		ttl, _ := replica.Cache().TTL([]byte("key"))
+		return hasValue(replica.Cache(), "key", "value") && err == freecache.ErrNotFound && ttl > 0
+	})
+	if ttl, _ := replica.Cache().TTL([]byte("ttl")); ttl < 98 || ttl > 100 {
+		t.Errorf("expected the TTL to be replicated, got %d", ttl)
+	}
+	if ttl, _ := replica.Cache().TTL([]byte("key")); ttl < 498 || ttl > 500 {
+		t.Errorf("expected the expiration to be replicated, got %d", ttl)
+	}
+
+	if response := client.do("ROLE"); response != "+ROLE primary\r\n" {
+		t.Errorf("unexpected primary role %q", response)
+	}
+	eventually(t, "replica still lagging", func() bool {
+		stats := client.stats("REPLICAINFO")
+		return stats["role"] == "primary" && stats["replicas"] == "1" && stats["replica0_lag_bytes"] == "0"
+	})
+
+	replicaClient := dialTestClient(t, replica.Addr().String())
+	defer replicaClient.conn.Close()
+	if response := replicaClient.do("ROLE"); response != "+ROLE replica\r\n" {
+		t.Errorf("unexpected replica role %q", response)
+	}
+	if response := replicaClient.do("SET key 0 other"); response != string(ErrReadOnly) {
+		t.Errorf("expected %q, got %q", ErrReadOnly, response)
+	}
+
+	// The other protocols are read-only on replicas too, and replicated on
+	// primaries
+	var buf bytes.Buffer
+	resp, memcache := replica.newParser(ProtocolRESP)(&buf), replica.newParser(ProtocolMemcache)(&buf)
+	resp.Parse([]byte("DEL key"))
+	memcache.Parse([]byte("set key 0 0 5"))
+	memcache.ParsePayload([]byte("other\r\n"))
+	memcache.Parse([]byte("version"))
+	if expected := string(RESPErrReadOnly) + string(MemcacheErrReadOnly) + string(MemcacheVersion); buf.String() != expected {
+		t.Errorf("expected %q, got %q", expected, buf.String())
+	}
+	if !hasValue(replica.Cache(), "key", "value") {
+		t.Error("replica accepted a write")
+	}
+	primary.newParser(ProtocolRESP)(&buf).Parse([]byte("SET redis value"))
+	eventually(t, "RESP write not replicated", func() bool {
+		return hasValue(replica.Cache(), "redis", "value")
+	})
+	stats := replicaClient.stats("REPLICAINFO")
+	if stats["role"] != "replica" || stats["state"] != "online" || stats["primary"] != primary.Addr().String() {
+		t.Errorf("unexpected replica info %v", stats)
+	}
+	if stats["offset"] != stats["primary_offset"] {
+		t.Errorf("expected no lag, got %v", stats)
+	}
+
+	if err := replica.Set([]byte("key"), []byte("other"), 0); err != ErrReplicaWrite {
+		t.Errorf("expected replicas to reject sets, got %v", err)
+	}
+	if err := primary.Set([]byte("seed"), []byte("value"), 0); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "set not replicated", func() bool {
+		return hasValue(replica.Cache(), "seed", "value")
+	})
+	if err := replica.Clear(); err != ErrReplicaWrite {
+		t.Errorf("expected replicas to reject clears, got %v", err)
+	}
+	if err := primary.Clear(); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "clear not replicated", func() bool {
+		return replica.Cache().Stats().Entries == 0
+	})
+}
+
+func TestReplicationAuth(t *testing.T) {
+	logger := log.New(ioutil.Discard, "", 0)
+	primary, err := NewServerWithOptions(Options{CacheSize: 1024 * 1024, ReplicationBacklogSize: 64 * 1024, AdminPassword: "secret", Logger: logger})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := primary.Start("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	defer primary.Stop(context.Background())
+	primary.Cache().Set([]byte("key"), []byte("value"), 0)
+
+	// Copying the cache requires the admin permission
+	client := dialTestClient(t, primary.Addr().String())
+	defer client.conn.Close()
+	for _, request := range []string{"SYNC replica", "PSYNC replica runid 0"} {
+		if response := client.do(request); response != string(ErrNoPermission) {
+			t.Errorf("%s: expected %q, got %q", request, ErrNoPermission, response)
+		}
+	}
+
+	// Replicas authenticate with their own password
+	start := func(password string) *Server {
+		replica, err := NewServerWithOptions(Options{CacheSize: 1024 * 1024, ReplicaOf: primary.Addr().String(), AdminPassword: password, Logger: logger})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := replica.Start("127.0.0.1:0"); err != nil {
+			t.Fatal(err)
+		}
+		return replica
+	}
+	replica := start("secret")
+	defer replica.Stop(context.Background())
+	eventually(t, "snapshot not replicated", func() bool {
+		return hasValue(replica.Cache(), "key", "value")
+	})
+
+	rejected := start("wrong")
+	defer rejected.Stop(context.Background())
+	time.Sleep(100 * time.Millisecond)
+	if status := rejected.replica.status(); status.State != "connecting" || rejected.Cache().Stats().Entries != 0 {
+		t.Errorf("replica with a wrong password synchronized: %v", status)
+	}
+}
+
+func TestReplicationLargeSnapshot(t *testing.T) {
+	logger := log.New(ioutil.Discard, "", 0)
+	options := Options{CacheSize: 16 * 1024 * 1024, ReplicationBacklogSize: 64 * 1024, Logger: logger}
+	primary, err := NewServerWithOptions(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := primary.Start("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	defer primary.Stop(context.Background())
+
+	// the snapshot is several times larger than the write buffer
+	value := strings.Repeat("x", 200)
+	for i := 0; i < 2000; i++ {
+		primary.Cache().Set([]byte("key"+strconv.Itoa(i)), []byte(value), 0)
+	}
+	options.ReplicaOf = primary.Addr().String()
+	replica, err := NewServerWithOptions(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := replica.Start("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	defer replica.Stop(context.Background())
+
+	eventually(t, "snapshot not replicated", func() bool {
+		return replica.Cache().Stats().Entries == 2000
+	})
+	for i := 0; i < 2000; i++ {
+		if key := "key" + strconv.Itoa(i); !hasValue(replica.Cache(), key, value) {
+			t.Fatalf("%s not replicated", key)
+		}
+	}
+}
+
+// limitedWriter fails once it has written n bytes.
+type limitedWriter struct{ n int }
+
+func (l *limitedWriter) Write(p []byte) (int, error) {
+	if len(p) > l.n {
+		n := l.n
+		l.n = 0
+		return n, io.ErrShortWrite
+	}
+	l.n -= len(p)
+	return len(p), nil
+}
+
+func TestReplicationSnapshotFailure(t *testing.T) {
+	primary, err := NewServerWithOptions(Options{CacheSize: 1024 * 1024, ReplicationBacklogSize: 64 * 1024, Logger: log.New(ioutil.Discard, "", 0)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer primary.Stop(context.Background())
+	primary.Cache().Set([]byte("key"), []byte(strings.Repeat("x", 500)), 0)
+
+	// the replica could not tell the rest of the snapshot from responses
+	parser := primary.newParser(ProtocolMulu)(&limitedWriter{100})
+	if parser.Parse([]byte("SYNC replica")) || !parser.Closed() {
+		t.Fatal("expected the connection to be closed")
+	}
+}
+
+func TestReplicationStalledSync(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	// the primary stops in the middle of the snapshot
+	syncs := make(chan net.Conn, 2)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			bufio.NewReader(conn).ReadString('\n')
+			conn.Write([]byte("+SYNC runid 0\r\n" + SnapshotMagic))
+			syncs <- conn
+		}
+	}()
+
+	cache := NewFreecacheStore(0)
+	replica := newReplica(cache, directWriter{cache}, listener.Addr().String(), "", log.New(ioutil.Discard, "", 0))
+	replica.timeout = 100 * time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	go replica.run(ctx)
+	defer func() {
+		cancel()
+		<-replica.done
+	}()
+
+	for i := 0; i < 2; i++ {
+		select {
+		case conn := <-syncs:
+			defer conn.Close()
+		case <-time.After(5 * time.Second):
+			t.Fatal("replica did not retry the stalled SYNC")
+		}
+	}
+}
+
+func TestReplicationResync(t *testing.T) {
+	primary, replica := startReplicationPair(t, "127.0.0.1:0")
+	defer replica.Stop(context.Background())
+
+	client := dialTestClient(t, primary.Addr().String())
+	client.do("SET old 0 value")
+	client.conn.Close()
+	eventually(t, "write not replicated", func() bool {
+		return hasValue(replica.Cache(), "old", "value")
+	})
+
+	// A restarted primary has a new run id, so the replica starts over
+	addr := primary.Addr().String()
+	primary.Stop(context.Background())
+	primary, err := NewServerWithOptions(Options{CacheSize: 1024 * 1024, ReplicationBacklogSize: 64 * 1024, Logger: log.New(ioutil.Discard, "", 0)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	primary.Cache().Set([]byte("new"), []byte("value"), 0)
+	if err := primary.Start(addr); err != nil {
+		t.Fatal(err)
+	}
+	defer primary.Stop(context.Background())
+
+	eventually(t, "replica did not resynchronize", func() bool {
+		_, err := replica.Cache().Get([]byte("old"))
+		return hasValue(replica.Cache(), "new", "value") && err == freecache.ErrNotFound
+	})
+}
+
+func TestReplicationBacklog(t *testing.T) {
+	cache := NewFreecacheStore(1024 * 1024)
+	backlog := newReplicationBacklog(directWriter{cache}, 64)
+
+	backlog.Set([]byte("key"), []byte("value"), 0)
+	records, end, err := backlog.read("replica", 0, nil, 0)
+	if err != nil || int64(len(records)) != end {
+		t.Fatalf("expected %d bytes of records, got %d (%v)", end, len(records), err)
+	}
+	op, key, value, _, n, err := decodeRecord(records)
+	if err != nil || n != len(records) || op != appendLogSet || string(key) != "key" || string(value) != "value" {
+		t.Fatalf("unexpected record %d %q %q %d (%v)", op, key, value, n, err)
+	}
+	if _, _, _, _, n, _ := decodeRecord(records[:len(records)-1]); n != 0 {
+		t.Fatal("decoded an incomplete record")
+	}
+
+	// Offsets which left the ring require a full resynchronization
+	for i := 0; i < 4; i++ {
+		backlog.Set([]byte("key"), []byte("value"), 0)
+	}
+	if _, _, err := backlog.read("replica", 0, nil, 0); err != errResync {
+		t.Fatalf("expected resync, got %v", err)
+	}
+	records, end2, err := backlog.read("replica", end*4, nil, 0)
+	if err != nil || end2 != end*5 || int64(len(records)) != end {
+		t.Fatalf("expected the last record, got %d bytes up to %d (%v)", len(records), end2, err)
+	}
+
+	// Polls wait for new writes
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		backlog.Del([]byte("key"))
+	}()
+	records, _, err = backlog.read("replica", end2, nil, 5*time.Second)
+	if op, _, _, _, _, _ := decodeRecord(records); err != nil || op != appendLogDel {
+		t.Fatalf("expected a delete record, got %d (%v)", op, err)
+	}
+}
+
+// blockingWriter holds up the writes until unblocked.
+type blockingWriter struct {
+	cacheWriter
+	blocked chan struct{}
+}
+
+func (w blockingWriter) Set(key, value []byte, expiration int) error {
+	<-w.blocked
+	return w.cacheWriter.Set(key, value, expiration)
+}
+
+func TestReplicationBacklogConcurrentWrites(t *testing.T) {
+	cache := NewFreecacheStore(1024 * 1024)
+	next := blockingWriter{directWriter{cache}, make(chan struct{})}
+	backlog := newReplicationBacklog(next, 1024*1024)
+
+	// A slow write does not hold up the replicas
+	done := make(chan struct{})
+	go func() {
+		backlog.Set([]byte("slow"), []byte("value"), 0)
+		close(done)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	if _, end, err := backlog.read("replica", 0, nil, 0); err != nil || end != 0 {
+		t.Fatalf("expected no records, got %d (%v)", end, err)
+	}
+	close(next.blocked)
+	<-done
+
+	// Writes to the same key are recorded in the order of the cache
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				key := []byte("key" + strconv.Itoa(i%4))
+				if i%5 == 0 {
+					backlog.Del(key)
+				} else {
+					backlog.Set(key, []byte(strconv.Itoa(w)), 0)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	records, _, err := backlog.read("replica", 0, nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	replica := NewFreecacheStore(1024 * 1024)
+	for len(records) > 0 {
+		op, key, value, expireAt, n, err := decodeRecord(records)
+		if err != nil || n == 0 {
+			t.Fatalf("invalid record (%v)", err)
+		}
+		applyRecord(directWriter{replica}, op, key, value, expireAt)
+		records = records[n:]
+	}
+	for _, key := range []string{"slow", "key0", "key1", "key2", "key3"} {
+		expected, _ := cache.Get([]byte(key))
+		if value, _ := replica.Get([]byte(key)); !bytes.Equal(value, expected) {
+			t.Errorf("%s: expected %q, got %q", key, expected, value)
+		}
+	}
+}
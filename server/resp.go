@@ -0,0 +1,381 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/coocood/freecache"
+)
+
+// Limits matching the defaults of redis-server
+const (
+	RESPMaxArgs     = 1024 * 1024
+	RESPMaxBulkSize = 512 * 1024 * 1024
+)
+
+// RESP errors
+var RESPErrMaxSize = []byte("-ERR Protocol error: request too large\r\n")
+var RESPErrProtocol = []byte("-ERR Protocol error\r\n")
+var RESPErrMultiBulkLength = []byte("-ERR Protocol error: invalid multibulk length\r\n")
+var RESPErrBulkLength = []byte("-ERR Protocol error: invalid bulk length\r\n")
+var RESPErrUnknownCmd = []byte("-ERR unknown command\r\n")
+var RESPErrArgs = []byte("-ERR wrong number of arguments for command\r\n")
+var RESPErrSyntax = []byte("-ERR syntax error\r\n")
+var RESPErrInteger = []byte("-ERR value is not an integer or out of range\r\n")
+var RESPErrExpire = []byte("-ERR invalid expire time\r\n")
+var RESPErrLargeKey = []byte("-ERR key is larger than 65535 bytes\r\n")
+var RESPErrLargeEntry = []byte("-ERR entry is larger than 1/1024 of cache size\r\n")
+var RESPErrUnknownCache = []byte("-ERR unknown cache error\r\n")
+var RESPErrReadOnly = []byte("-READONLY You can't write against a read only replica.\r\n")
+
+var RESPOK = []byte("+OK\r\n")
+var RESPPong = []byte("+PONG\r\n")
+var RESPNil = []byte("$-1\r\n")
+
+// NewRESPParser creates a parser for the Redis serialization protocol (RESP2).
+func NewRESPParser(cache Store, w io.Writer, logger *log.Logger) *RESPParser {
+	return &RESPParser{cache: cache, writer: w, logger: logger, writes: directWriter{cache}}
+}
+
+// RESPParser serves GET, SET, DEL, EXPIRE, TTL, PING and MGET to Redis
+// clients. Both multi-bulk requests and inline commands are accepted.
+type RESPParser struct {
+	logger *log.Logger
+	writer io.Writer
+	cache  Store
+
+	// applies the writes, recording them for the append-only log and
+	// replicas when created by a server
+	writes cacheWriter
+
+	// non-nil on replicas, which reject writes
+	replica *replica
+
+	// nil unless the parser is created by a server, which then measures
+	// the latency of each command
+	counters *serverStats
+
+	// multi-bulk request being collected; args are offsets into argbuf
+	argc    int
+	offsets []int
+	argbuf  []byte
+	args    [][]byte
+	expect  int
+	scratch []byte
+
+	// the request was rejected, so its remaining arguments are skipped
+	rejected bool
+
+	// a protocol error was found, after which requests cannot be told apart
+	closed bool
+}
+
+// Closed reports whether a protocol error was found, in which case the
+// connection is closed like redis-server does.
+func (p *RESPParser) Closed() bool {
+	return p.closed
+}
+
+// Expect returns the number of raw bytes, including the trailing CRLF, of the
+// next bulk string. Zero means the parser is waiting for a line.
+func (p *RESPParser) Expect() int {
+	return p.expect
+}
+
+// Parse handles a single line: a multi-bulk header, a bulk length or an
+// inline command.
+func (p *RESPParser) Parse(line []byte) bool {
+	p.expect = 0
+
+	// bulk length of the next argument
+	if p.argc > 0 {
+		if len(line) == 0 || line[0] != '$' {
+			return p.protocolError(RESPErrProtocol, line)
+		}
+		n, err := strconv.Atoi(string(line[1:]))
+		if err != nil || n < 0 || n > RESPMaxBulkSize {
+			return p.protocolError(RESPErrBulkLength, line)
+		}
+		p.expect = n + len(CRLF)
+		return true
+	}
+
+	if len(line) == 0 {
+		return true
+	}
+
+	// multi-bulk header
+	if line[0] == '*' {
+		n, err := strconv.Atoi(string(line[1:]))
+		if err != nil || n > RESPMaxArgs {
+			return p.protocolError(RESPErrMultiBulkLength, line)
+		}
+		if n <= 0 {
+			return true
+		}
+		p.argc = n
+		p.argbuf = p.argbuf[:0]
+		p.offsets = p.offsets[:0]
+		return true
+	}
+
+	// inline command
+	p.args = p.args[:0]
+	for _, field := range bytes.Fields(line) {
+		p.args = append(p.args, field)
+	}
+	return p.execute()
+}
+
+// ParsePayload receives a bulk string announced by the preceding length line.
+func (p *RESPParser) ParsePayload(data []byte) bool {
+	p.expect = 0
+	if !bytes.HasSuffix(data, CRLF) {
+		return p.protocolError(RESPErrProtocol, data)
+	}
+
+	// The data points into the request buffer, so it is copied until the
+	// whole request has arrived.
+	if !p.rejected {
+		p.argbuf = append(p.argbuf, data[:len(data)-len(CRLF)]...)
+	}
+	p.offsets = append(p.offsets, len(p.argbuf))
+	if len(p.offsets) < p.argc {
+		return true
+	} else if p.rejected {
+		p.argc = 0
+		p.rejected = false
+		return true
+	}
+
+	p.args = p.args[:0]
+	start := 0
+	for _, end := range p.offsets {
+		p.args = append(p.args, p.argbuf[start:end])
+		start = end
+	}
+	p.argc = 0
+	return p.execute()
+}
+
+// Reject abandons the current request because it does not fit in the request
+// buffer. If a bulk string is too large, it is skipped by the consumer and the
+// remaining arguments of the request are read and ignored, so that they are not
+// taken for inline commands.
+func (p *RESPParser) Reject() {
+	if p.argc == 0 || p.expect == 0 {
+		p.fail(RESPErrMaxSize, nil)
+		return
+	}
+	p.expect = 0
+	p.writer.Write(RESPErrMaxSize)
+	p.logger.Printf("%s\r\n", string(RESPErrMaxSize[:len(RESPErrMaxSize)-len(CRLF)]))
+	p.offsets = append(p.offsets, len(p.argbuf))
+	if p.rejected = len(p.offsets) < p.argc; !p.rejected {
+		p.argc = 0
+	}
+}
+
+func (p *RESPParser) fail(err []byte, line []byte) bool {
+	p.argc = 0
+	p.expect = 0
+	p.rejected = false
+	p.writer.Write(err)
+	p.logger.Printf("%s (%s)\r\n", string(err[:len(err)-len(CRLF)]), strconv.Quote(string(line)))
+	return false
+}
+
+// protocolError fails a request which is not valid RESP, and closes the
+// connection since the rest of the request would be taken for new ones.
+func (p *RESPParser) protocolError(err []byte, line []byte) bool {
+	p.closed = true
+	return p.fail(err, line)
+}
+
+func (p *RESPParser) execute() bool {
+	if len(p.args) == 0 {
+		return true
+	} else if p.counters == nil {
+		return p.run(p.args[0], p.args[1:])
+	}
+	start := time.Now()
+	ok := p.run(p.args[0], p.args[1:])
+	p.counters.commandFold(p.args[0], time.Since(start))
+	return ok
+}
+
+func (p *RESPParser) run(cmd []byte, args [][]byte) bool {
+	switch {
+	case bytes.EqualFold(cmd, []byte("GET")):
+		if len(args) != 1 {
+			return p.fail(RESPErrArgs, cmd)
+		}
+		v, err := p.cache.Get(args[0])
+		if err == freecache.ErrNotFound {
+			return p.write(RESPNil)
+		} else if err != nil {
+			return p.cacheError(err, cmd)
+		}
+		return p.writeBulk(v)
+
+	case bytes.EqualFold(cmd, []byte("SET")):
+		return p.set(args)
+
+	case bytes.EqualFold(cmd, []byte("DEL")):
+		if len(args) == 0 {
+			return p.fail(RESPErrArgs, cmd)
+		} else if p.replica != nil {
+			return p.fail(RESPErrReadOnly, cmd)
+		}
+		var n int64
+		for _, key := range args {
+			if ok, err := p.writes.Del(key); err != nil {
+				return p.cacheError(err, cmd)
+			} else if ok {
+				n++
+			}
+		}
+		return p.writeInt(n)
+
+	case bytes.EqualFold(cmd, []byte("EXPIRE")):
+		if len(args) != 2 {
+			return p.fail(RESPErrArgs, cmd)
+		}
+		seconds, err := strconv.Atoi(string(args[1]))
+		if err != nil {
+			return p.fail(RESPErrInteger, cmd)
+		} else if p.replica != nil {
+			return p.fail(RESPErrReadOnly, cmd)
+		}
+
+		// non-positive timeouts delete the key immediately
+		var found bool
+		if seconds <= 0 {
+			found, err = p.writes.Del(args[0])
+		} else {
+			found, _, err = p.writes.Update(args[0], func(value []byte, expireAt uint32, found bool) ([]byte, int, bool) {
+				return value, seconds, found
+			})
+		}
+		if err != nil {
+			return p.cacheError(err, cmd)
+		} else if !found {
+			return p.writeInt(0)
+		}
+		return p.writeInt(1)
+
+	case bytes.EqualFold(cmd, []byte("TTL")):
+		if len(args) != 1 {
+			return p.fail(RESPErrArgs, cmd)
+		}
+		ttl, err := p.cache.TTL(args[0])
+		if err == freecache.ErrNotFound {
+			return p.writeInt(-2)
+		} else if err != nil {
+			return p.cacheError(err, cmd)
+		} else if ttl == 0 {
+			return p.writeInt(-1)
+		}
+		return p.writeInt(int64(ttl))
+
+	case bytes.EqualFold(cmd, []byte("PING")):
+		switch len(args) {
+		case 0:
+			return p.write(RESPPong)
+		case 1:
+			return p.writeBulk(args[0])
+		}
+		return p.fail(RESPErrArgs, cmd)
+
+	case bytes.EqualFold(cmd, []byte("MGET")):
+		if len(args) == 0 {
+			return p.fail(RESPErrArgs, cmd)
+		}
+		if !p.writeHeader('*', int64(len(args))) {
+			return false
+		}
+		for _, key := range args {
+			if v, err := p.cache.Get(key); err != nil {
+				if !p.write(RESPNil) {
+					return false
+				}
+			} else if !p.writeBulk(v) {
+				return false
+			}
+		}
+		return true
+	}
+	return p.fail(RESPErrUnknownCmd, cmd)
+}
+
+// set handles SET key value [EX seconds | PX milliseconds]
+func (p *RESPParser) set(args [][]byte) bool {
+	if len(args) < 2 {
+		return p.fail(RESPErrArgs, []byte("SET"))
+	}
+
+	var expiration int
+	for i := 2; i < len(args); i++ {
+		if i+1 == len(args) {
+			return p.fail(RESPErrSyntax, args[i])
+		}
+		n, err := strconv.Atoi(string(args[i+1]))
+		if err != nil {
+			return p.fail(RESPErrInteger, args[i+1])
+		} else if n <= 0 {
+			return p.fail(RESPErrExpire, args[i+1])
+		}
+
+		switch {
+		case bytes.EqualFold(args[i], []byte("EX")):
+			expiration = n
+		case bytes.EqualFold(args[i], []byte("PX")):
+			// freecache has a resolution of one second
+			expiration = (n + 999) / 1000
+		default:
+			return p.fail(RESPErrSyntax, args[i])
+		}
+		i++
+	}
+
+	if p.replica != nil {
+		return p.fail(RESPErrReadOnly, args[0])
+	}
+	if err := p.writes.Set(args[0], args[1], expiration); err != nil {
+		return p.cacheError(err, args[0])
+	}
+	return p.write(RESPOK)
+}
+
+func (p *RESPParser) cacheError(err error, line []byte) bool {
+	switch err {
+	case freecache.ErrLargeKey:
+		return p.fail(RESPErrLargeKey, line)
+	case freecache.ErrLargeEntry:
+		return p.fail(RESPErrLargeEntry, line)
+	}
+	return p.fail(RESPErrUnknownCache, line)
+}
+
+func (p *RESPParser) write(b []byte) bool {
+	_, err := p.writer.Write(b)
+	return err == nil
+}
+
+func (p *RESPParser) writeHeader(prefix byte, n int64) bool {
+	p.scratch = append(p.scratch[:0], prefix)
+	p.scratch = strconv.AppendInt(p.scratch, n, 10)
+	p.scratch = append(p.scratch, CRLF...)
+	return p.write(p.scratch)
+}
+
+func (p *RESPParser) writeInt(n int64) bool {
+	return p.writeHeader(':', n)
+}
+
+func (p *RESPParser) writeBulk(v []byte) bool {
+	return p.writeHeader('$', int64(len(v))) && p.write(v) && p.write(CRLF)
+}
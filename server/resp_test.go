@@ -0,0 +1,141 @@
+package server
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"strings"
+	"testing"
+
+	"github.com/coocood/freecache"
+)
+
+func TestRESPParser(t *testing.T) {
+	cache := NewFreecacheStore(0)
+	logger := log.New(ioutil.Discard, "logger: ", log.Lshortfile)
+
+	tests := []struct {
+		request, response string
+	}{
+		{"PING\r\n", "+PONG\r\n"},
+		{"*2\r\n$4\r\nPING\r\n$2\r\nhi\r\n", "$2\r\nhi\r\n"},
+		{"*3\r\n$3\r\nSET\r\n$3\r\nkey\r\n$4\r\na\r\nb\r\n", "+OK\r\n"},
+		{"*2\r\n$3\r\nget\r\n$3\r\nkey\r\n", "$4\r\na\r\nb\r\n"},
+		{"GET missing\r\n", "$-1\r\n"},
+		{"*4\r\n$4\r\nMGET\r\n$3\r\nkey\r\n$7\r\nmissing\r\n$3\r\nkey\r\n", "*3\r\n$4\r\na\r\nb\r\n$-1\r\n$4\r\na\r\nb\r\n"},
+		{"TTL key\r\n", ":-1\r\n"},
+		{"TTL missing\r\n", ":-2\r\n"},
+		{"EXPIRE key 100\r\n", ":1\r\n"},
+		{"TTL key\r\n", ":100\r\n"},
+		{"EXPIRE missing 100\r\n", ":0\r\n"},
+		{"SET other value EX 10\r\n", "+OK\r\n"},
+		{"TTL other\r\n", ":10\r\n"},
+		{"SET other value PX 1500\r\n", "+OK\r\n"},
+		{"TTL other\r\n", ":2\r\n"},
+		{"SET other value EX\r\n", string(RESPErrSyntax)},
+		{"SET other value NX 1\r\n", string(RESPErrSyntax)},
+		{"SET other value EX -1\r\n", string(RESPErrExpire)},
+		{"DEL key other missing\r\n", ":2\r\n"},
+		{"EXPIRE key x\r\n", string(RESPErrInteger)},
+		{"GET\r\n", string(RESPErrArgs)},
+		{"FOO\r\n", string(RESPErrUnknownCmd)},
+		{"*1\r\nPING\r\n", string(RESPErrProtocol)},
+		{"*x\r\n", string(RESPErrMultiBulkLength)},
+		{"*1\r\n$x\r\n", string(RESPErrBulkLength)},
+	}
+
+	for _, test := range tests {
+		var buf bytes.Buffer
+		w := nopFlusher{&buf}
+		b := NewByteConsumer(w, nil, NewRESPParser(cache, w, logger), make([]byte, RingBufferCapacity), DefaultMaxRequestSize, logger)
+		consume(b, []byte(test.request), 3)
+		if buf.String() != test.response {
+			t.Errorf("%q: expected %q, got %q", test.request, test.response, buf.String())
+		}
+	}
+}
+
+func TestRESPParserReject(t *testing.T) {
+	cache := NewFreecacheStore(0)
+	logger := log.New(ioutil.Discard, "logger: ", log.Lshortfile)
+	large := strings.Repeat("x", 100)
+
+	// the arguments following a bulk string which is too large are skipped,
+	// so that a single error is returned for the request
+	tests := []struct {
+		request, response string
+	}{
+		{"*3\r\n$3\r\nSET\r\n$100\r\n" + large + "\r\n$5\r\nvalue\r\nPING\r\n", string(RESPErrMaxSize) + "+PONG\r\n"},
+		{"*3\r\n$3\r\nSET\r\n$3\r\nkey\r\n$100\r\n" + large + "\r\nPING\r\n", string(RESPErrMaxSize) + "+PONG\r\n"},
+		{"*2\r\n$100\r\n" + large + "\r\n$3\r\nkey\r\n*1\r\n$4\r\nPING\r\n", string(RESPErrMaxSize) + "+PONG\r\n"},
+	}
+	for _, test := range tests {
+		var buf bytes.Buffer
+		w := nopFlusher{&buf}
+		b := NewByteConsumer(w, nil, NewRESPParser(cache, w, logger), make([]byte, RingBufferCapacity), 64, logger)
+		consume(b, []byte(test.request), 3)
+		if buf.String() != test.response {
+			t.Errorf("%q: expected %q, got %q", test.request, test.response, buf.String())
+		}
+	}
+	if _, err := cache.Get([]byte("key")); err != freecache.ErrNotFound {
+		t.Fatal("rejected SET was applied")
+	}
+}
+
+// closeRecorder counts the times the consumer closes the connection.
+type closeRecorder struct{ closed int }
+
+func (c *closeRecorder) Close() error {
+	c.closed++
+	return nil
+}
+
+func TestRESPParserProtocolError(t *testing.T) {
+	cache := NewFreecacheStore(0)
+	logger := log.New(ioutil.Discard, "logger: ", log.Lshortfile)
+	cache.Set([]byte("key"), []byte("value"), 0)
+
+	// the lines following a protocol error are not taken for commands
+	tests := []struct {
+		request, response string
+	}{
+		{"*3\r\n$3\r\nSET\r\n$x\r\nDEL key\r\nPING\r\n", string(RESPErrBulkLength)},
+		{"*2\r\n$3\r\nSET\r\n$3\r\nkeyDEL key\r\n", string(RESPErrProtocol)},
+		{"*2\r\nDEL key\r\nPING\r\n", string(RESPErrProtocol)},
+		{"*x\r\nDEL key\r\n", string(RESPErrMultiBulkLength)},
+	}
+	for _, test := range tests {
+		var buf bytes.Buffer
+		var closer closeRecorder
+		w := nopFlusher{&buf}
+		b := NewByteConsumer(w, &closer, NewRESPParser(cache, w, logger), make([]byte, RingBufferCapacity), DefaultMaxRequestSize, logger)
+		consume(b, []byte(test.request), 3)
+		if buf.String() != test.response {
+			t.Errorf("%q: expected %q, got %q", test.request, test.response, buf.String())
+		}
+		if closer.closed != 1 {
+			t.Errorf("%q: expected the connection to be closed once, got %d", test.request, closer.closed)
+		}
+	}
+	if _, err := cache.Get([]byte("key")); err != nil {
+		t.Fatal("a command following a protocol error was executed")
+	}
+}
+
+func BenchmarkRESPParserGet(b *testing.B) {
+	cache := NewFreecacheStore(0)
+	logger := log.New(ioutil.Discard, "logger: ", log.Lshortfile)
+	parser := NewRESPParser(cache, ioutil.Discard, logger)
+	cache.Set([]byte("key"), []byte("value"), 0)
+	header, length, payload := []byte("*2"), []byte("$3"), []byte("GET\r\n")
+	key := []byte("key\r\n")
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		parser.Parse(header)
+		parser.Parse(length)
+		parser.ParsePayload(payload)
+		parser.Parse(length)
+		parser.ParsePayload(key)
+	}
+}
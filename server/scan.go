@@ -0,0 +1,276 @@
+package server
+
+import (
+	"bytes"
+	"container/heap"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Responses of SCAN
+var ScanPrefix = []byte("+SCAN ")
+var KeyPrefix = []byte("+KEY ")
+var ErrInvalidCursor = []byte("-ERRINVCURSOR Invalid cursor\r\n")
+var ErrInvalidCount = []byte("-ERRINVCOUNT Invalid count\r\n")
+
+// DefaultScanCount is the number of keys returned by SCAN without COUNT.
+const DefaultScanCount = 10
+
+// scanBatchSize is the number of hashes a SCAN collects at once, which the
+// connection keeps to serve the following pages.
+const scanBatchSize = 16 * 1024
+
+// SCAN <cursor> [MATCH <pattern>] [COUNT <n>] returns the next keys of a scan
+// of the cache, starting with cursor 0, and the cursor of the following page,
+// which is 0 once the scan is complete:
+//
+//	+SCAN <cursor>
+//	+KEY <key>
+//	+KEY <length>\r\n<bytes>     with LengthFraming
+//	+END
+//
+// Keys are returned in the order of their hash, and the cursor is the hash
+// following the last key. Since the position of a key does not depend on the
+// other keys, a full scan returns every key which exists during the whole
+// scan, whatever is written in the meantime; keys written or deleted during
+// the scan may or may not be returned. With FreecacheStore, a key may still be
+// missed when another one is removed while it is iterated, see
+// FreecacheStore.Iterate.
+//
+// Rather than iterating the cache for each page, a page collects the keys of
+// the next scanBatchSize hashes, which the connection keeps and serves the
+// following pages from as long as they continue the same scan.
+//
+// Patterns are matched by matchPattern. A page returns up to COUNT matching
+// keys, more only if several share the hash of the last one.
+func (p *Parser) scan(args [][]byte) bool {
+	if len(args) == 0 || len(args)%2 != 1 {
+		return p.fail(ErrInvalidArgs, nil)
+	}
+	cursor, err := strconv.ParseUint(string(args[0]), 10, 64)
+	if err != nil {
+		return p.fail(ErrInvalidCursor, args[0])
+	}
+	var pattern []byte
+	count := DefaultScanCount
+	for i := 1; i < len(args); i += 2 {
+		switch strings.ToUpper(string(args[i])) {
+		case "MATCH":
+			pattern = args[i+1]
+		case "COUNT":
+			if count, err = strconv.Atoi(string(args[i+1])); err != nil || count <= 0 {
+				return p.fail(ErrInvalidCount, args[i+1])
+			}
+		default:
+			return p.fail(ErrInvalidArgs, args[i])
+		}
+	}
+
+	batch := p.scanning
+	if cursor == 0 || !batch.continues(cursor, pattern) || (len(batch.groups) < count && !batch.complete) {
+		size := scanBatchSize
+		if count > size {
+			size = count
+		}
+		batch = collectScanBatch(p.cache, cursor, pattern, size)
+	}
+	groups := batch.groups
+	if len(groups) > count {
+		groups = groups[:count]
+	}
+	batch.groups = batch.groups[len(groups):]
+
+	// the scan is over once the last collected hash is returned
+	var next uint64
+	if len(batch.groups) > 0 || !batch.complete {
+		next = groups[len(groups)-1].hash + 1
+	}
+	batch.cursor = next
+	if next != 0 {
+		p.scanning = batch
+	} else {
+		p.scanning = nil
+	}
+
+	p.scratch = append(p.scratch[:0], ScanPrefix...)
+	p.scratch = strconv.AppendUint(p.scratch, next, 10)
+	p.scratch = append(p.scratch, CRLF...)
+	for _, group := range groups {
+		for _, key := range group.keys {
+			p.scratch = append(p.scratch, KeyPrefix...)
+			if p.framing == LengthFraming {
+				p.scratch = strconv.AppendInt(p.scratch, int64(len(key)), 10)
+				p.scratch = append(p.scratch, CRLF...)
+			}
+			p.scratch = append(p.scratch, key...)
+			p.scratch = append(p.scratch, CRLF...)
+		}
+	}
+	p.scratch = append(p.scratch, EndResponse...)
+	_, err = p.writer.Write(p.scratch)
+	return err == nil
+}
+
+// scanBatch holds the groups of keys following the cursor of a scan, sorted
+// by hash.
+type scanBatch struct {
+	pattern  []byte
+	cursor   uint64
+	groups   []*scanGroup
+	complete bool // no key follows the groups
+}
+
+// collectScanBatch collects the keys matching the pattern whose hash is one of
+// the size smallest from cursor on.
+func collectScanBatch(cache Store, cursor uint64, pattern []byte, size int) *scanBatch {
+	page := scanPage{groups: make(map[uint64]*scanGroup)}
+	cache.Iterate(func(key, value []byte, expireAt uint32) bool {
+		if pattern != nil && !matchPattern(pattern, key) {
+			return true
+		}
+		if hash := hashKey(key); hash >= cursor {
+			page.add(hash, key, size)
+		}
+		return true
+	})
+	sort.Slice(page.heap, func(i, j int) bool { return page.heap[i].hash < page.heap[j].hash })
+	batch := &scanBatch{cursor: cursor, groups: page.heap, complete: len(page.heap) < size}
+	if pattern != nil {
+		batch.pattern = append([]byte{}, pattern...)
+	}
+	return batch
+}
+
+// continues reports whether the batch holds the keys following cursor, if
+// they match pattern.
+func (b *scanBatch) continues(cursor uint64, pattern []byte) bool {
+	return b != nil && b.cursor == cursor && (b.pattern == nil) == (pattern == nil) && bytes.Equal(b.pattern, pattern)
+}
+
+// scanGroup holds the keys sharing a hash.
+type scanGroup struct {
+	hash uint64
+	keys [][]byte
+}
+
+// scanPage keeps the groups of keys with the smallest hashes seen so far, in a
+// heap whose root is the largest hash.
+type scanPage struct {
+	heap   scanHeap
+	groups map[uint64]*scanGroup
+}
+
+// add adds a copy of the key if its hash is among the count smallest. Keys
+// which the iteration visits twice are only added once.
+func (s *scanPage) add(hash uint64, key []byte, count int) {
+	if group := s.groups[hash]; group != nil {
+		for _, k := range group.keys {
+			if bytes.Equal(k, key) {
+				return
+			}
+		}
+		group.keys = append(group.keys, append([]byte(nil), key...))
+		return
+	}
+	if len(s.heap) == count {
+		if hash > s.heap[0].hash {
+			return
+		}
+		delete(s.groups, heap.Pop(&s.heap).(*scanGroup).hash)
+	}
+	group := &scanGroup{hash, [][]byte{append([]byte(nil), key...)}}
+	s.groups[hash] = group
+	heap.Push(&s.heap, group)
+}
+
+type scanHeap []*scanGroup
+
+func (h scanHeap) Len() int            { return len(h) }
+func (h scanHeap) Less(i, j int) bool  { return h[i].hash > h[j].hash }
+func (h scanHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *scanHeap) Push(x interface{}) { *h = append(*h, x.(*scanGroup)) }
+
+func (h *scanHeap) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+// matchPattern reports whether the key matches a glob pattern, in which *
+// matches any sequence of bytes, ? any single byte, [abc] and [a-z] one of the
+// listed bytes, [^abc] any other byte, and \ escapes the following byte.
+//
+// When an element fails to match, only the last * is retried with one more
+// byte, since any match of the earlier ones can be extended to it. This takes
+// O(len(pattern) * len(key)) whatever the number of stars.
+func matchPattern(pattern, key []byte) bool {
+	// position in the pattern after the last *, and in the key where it
+	// was last tried
+	star, retry := -1, 0
+	i, j := 0, 0
+	for j < len(key) {
+		if i < len(pattern) && pattern[i] == '*' {
+			i++
+			star, retry = i, j
+			continue
+		}
+		if i < len(pattern) {
+			if n, ok := matchElement(pattern[i:], key[j]); ok {
+				i += n
+				j++
+				continue
+			}
+		}
+		if star < 0 {
+			return false
+		}
+		retry++
+		i, j = star, retry
+	}
+	for i < len(pattern) && pattern[i] == '*' {
+		i++
+	}
+	return i == len(pattern)
+}
+
+// matchElement matches c against the element at the start of the pattern,
+// which is not a *, and returns the length of the element.
+func matchElement(pattern []byte, c byte) (int, bool) {
+	switch pattern[0] {
+	case '?':
+		return 1, true
+	case '[':
+		end := bytes.IndexByte(pattern[1:], ']') + 1
+		if end == 0 {
+			// an unterminated class matches a literal [
+			return 1, c == '['
+		}
+		return end + 1, matchClass(pattern[1:end], c)
+	case '\\':
+		if len(pattern) > 1 {
+			return 2, c == pattern[1]
+		}
+	}
+	return 1, c == pattern[0]
+}
+
+// matchClass reports whether c is one of the bytes listed by a class.
+func matchClass(class []byte, c byte) bool {
+	negate := len(class) > 0 && class[0] == '^'
+	if negate {
+		class = class[1:]
+	}
+	for i := 0; i < len(class); i++ {
+		if i+2 < len(class) && class[i+1] == '-' {
+			if class[i] <= c && c <= class[i+2] {
+				return !negate
+			}
+			i += 2
+		} else if class[i] == c {
+			return !negate
+		}
+	}
+	return negate
+}
@@ -0,0 +1,180 @@
+package server
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// scanPages scans the whole cache, returning the number of times each key was
+// returned and the number of pages.
+func scanPages(t *testing.T, parser *Parser, buf *bytes.Buffer, options string) (map[string]int, int) {
+	keys := make(map[string]int)
+	cursor, pages := "0", 0
+	for {
+		buf.Reset()
+		if !parser.Parse([]byte("SCAN " + cursor + options)) {
+			t.Fatalf("SCAN %s failed: %q", cursor, buf.String())
+		}
+		pages++
+		lines := strings.Split(strings.TrimSuffix(buf.String(), "\r\n"), "\r\n")
+		if !strings.HasPrefix(lines[0], "+SCAN ") || lines[len(lines)-1] != "+END" {
+			t.Fatalf("unexpected response %q", buf.String())
+		}
+		for _, line := range lines[1 : len(lines)-1] {
+			keys[strings.TrimPrefix(line, "+KEY ")]++
+		}
+		if cursor = strings.TrimPrefix(lines[0], "+SCAN "); cursor == "0" {
+			return keys, pages
+		}
+	}
+}
+
+func TestParserScan(t *testing.T) {
+	cache := NewFreecacheStore(0)
+	logger := log.New(ioutil.Discard, "logger: ", log.Lshortfile)
+	var buf bytes.Buffer
+	parser := NewParser(cache, &buf, logger)
+
+	if keys, pages := scanPages(t, parser, &buf, ""); len(keys) != 0 || pages != 1 {
+		t.Fatalf("expected an empty page, got %v in %d pages", keys, pages)
+	}
+
+	for i := 0; i < 100; i++ {
+		cache.Set([]byte("user:"+strconv.Itoa(i)), []byte("value"), 0)
+		cache.Set([]byte("session:"+strconv.Itoa(i)), []byte("value"), 0)
+	}
+	keys, pages := scanPages(t, parser, &buf, "")
+	if len(keys) != 200 || pages < 20 {
+		t.Fatalf("expected 200 keys in at least 20 pages, got %d in %d", len(keys), pages)
+	}
+	for key, n := range keys {
+		if n != 1 {
+			t.Fatalf("%s returned %d times", key, n)
+		}
+	}
+
+	keys, pages = scanPages(t, parser, &buf, " MATCH user:[1-2]? count 1000")
+	if len(keys) != 20 || pages != 1 {
+		t.Fatalf("expected 20 keys in one page, got %d in %d", len(keys), pages)
+	}
+	for key := range keys {
+		if !strings.HasPrefix(key, "user:1") && !strings.HasPrefix(key, "user:2") {
+			t.Fatalf("%s does not match", key)
+		}
+	}
+
+	for _, test := range []struct{ request, response string }{
+		{"SCAN", string(ErrInvalidArgs)},
+		{"SCAN 0 COUNT", string(ErrInvalidArgs)},
+		{"SCAN 0 LIMIT 1", string(ErrInvalidArgs)},
+		{"SCAN -1", string(ErrInvalidCursor)},
+		{"SCAN 0 COUNT 0", string(ErrInvalidCount)},
+		{"SCAN 18446744073709551615 MATCH nothing", "+SCAN 0\r\n+END\r\n"},
+	} {
+		buf.Reset()
+		parser.Parse([]byte(test.request))
+		if buf.String() != test.response {
+			t.Errorf("%q: expected %q, got %q", test.request, test.response, buf.String())
+		}
+	}
+
+	framed := NewFramedParser(cache, &buf, logger)
+	buf.Reset()
+	framed.Parse([]byte("SCAN 0 MATCH user:42 COUNT 1"))
+	if !strings.HasSuffix(buf.String(), "\r\n+KEY 7\r\nuser:42\r\n+END\r\n") {
+		t.Fatalf("unexpected framed response %q", buf.String())
+	}
+}
+
+func TestParserScanConcurrentWrites(t *testing.T) {
+	t.Run("freecache", func(t *testing.T) {
+		// freecache may skip a key when another one is removed, so the
+		// concurrent writes only add and overwrite keys
+		testScanConcurrentWrites(t, NewFreecacheStore(8*1024*1024), false)
+	})
+	t.Run("tinylfu", func(t *testing.T) {
+		testScanConcurrentWrites(t, NewTinyLFUStore(8*1024*1024), true)
+	})
+}
+
+// testScanConcurrentWrites checks that a scan spanning several batches
+// returns each key which exists throughout exactly once.
+func testScanConcurrentWrites(t *testing.T, cache Store, deletes bool) {
+	logger := log.New(ioutil.Discard, "logger: ", log.Lshortfile)
+	var buf bytes.Buffer
+	parser := NewParser(cache, &buf, logger)
+
+	stable := scanBatchSize + 1000
+	for i := 0; i < stable; i++ {
+		cache.Set([]byte("stable:"+strconv.Itoa(i)), []byte("value"), 0)
+	}
+
+	// keys are written while the scan runs
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; ; i++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				key := []byte("churn:" + strconv.Itoa(w) + ":" + strconv.Itoa(i%500))
+				if deletes && i%1000 >= 500 {
+					cache.Del(key)
+				} else {
+					cache.Set(key, []byte("value"), 0)
+				}
+			}
+		}(w)
+	}
+	keys, _ := scanPages(t, parser, &buf, " COUNT 500")
+	close(stop)
+	wg.Wait()
+
+	for i := 0; i < stable; i++ {
+		if n := keys["stable:"+strconv.Itoa(i)]; n != 1 {
+			t.Fatalf("stable:%d returned %d times", i, n)
+		}
+	}
+}
+
+func TestMatchPattern(t *testing.T) {
+	for _, test := range []struct {
+		pattern, key string
+		match        bool
+	}{
+		{"*", "", true},
+		{"user:*", "user:1", true},
+		{"user:*", "session:1", false},
+		{"*:1", "user:1", true},
+		{"u*r:?", "user:1", true},
+		{"u*r:?", "user:10", false},
+		{"user:[0-9]", "user:7", true},
+		{"user:[0-9]", "user:a", false},
+		{"user:[^0-9]", "user:a", true},
+		{"user:[abc]", "user:b", true},
+		{`user\*`, "user*", true},
+		{`user\*`, "users", false},
+		{"user[", "user[", true},
+		{"a/*", "a/b/c", true},
+		{"*a*b", "xaxxbxb", true},
+		{"*a*b", "xaxxbx", false},
+		{"a*", "b", false},
+		{"**", "", true},
+		{"*?", "", false},
+		{strings.Repeat("*a", 20) + "*b", strings.Repeat("a", 100), false},
+	} {
+		if match := matchPattern([]byte(test.pattern), []byte(test.key)); match != test.match {
+			t.Errorf("%q %q: expected %v, got %v", test.pattern, test.key, test.match, match)
+		}
+	}
+}
@@ -5,38 +5,284 @@ import (
 	"io"
 	"log"
 	"net"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/coocood/freecache"
 	"golang.org/x/net/context"
 )
 
-func NewServer(cache *freecache.Cache, logger *log.Logger) *Server {
-	return &Server{
-		cache:  cache,
-		logger: logger,
-	}
+// startTime is used to report the uptime of the process
+var startTime = time.Now()
+
+func NewServer(cache Store, logger *log.Logger) *Server {
+	return newServer(cache, Options{Logger: logger}.withDefaults())
 }
 
 func NewServerSize(cachesize int, logger *log.Logger) *Server {
+	return NewServer(NewFreecacheStore(cachesize), logger)
+}
+
+// NewServerWithOptions creates a server and its cache from the given options.
+func NewServerWithOptions(options Options) (*Server, error) {
+	options = options.withDefaults()
+	if err := options.validate(); err != nil {
+		return nil, err
+	}
+	store := options.Store
+	if store == nil && options.Engine == EngineTinyLFU {
+		store = NewTinyLFUStore(options.CacheSize)
+	} else if store == nil {
+		store = NewFreecacheStore(options.CacheSize)
+	}
+	s := newServer(store, options)
+	if err := s.restore(); err != nil {
+		return nil, err
+	}
+	if options.SnapshotInterval > 0 {
+		go s.snapshots.run(s.context, options.SnapshotInterval)
+	}
+	if s.aof != nil {
+		s.writes = s.aof
+		go s.aof.run(s.context)
+	}
+	if options.ReplicationBacklogSize > 0 {
+		s.backlog = newReplicationBacklog(s.writes, options.ReplicationBacklogSize)
+		s.writes = s.backlog
+	}
+	if options.ReplicaOf != "" {
+		s.replica = newReplica(s.cache, s.writes, options.ReplicaOf, options.AdminPassword, s.logger)
+		s.replica.synced = func() {
+			// the log must not depend on what the cache held before
+			if s.aof != nil {
+				s.aof.Rewrite()
+			}
+		}
+		go s.replica.run(s.context)
+	}
+	return s, nil
+}
+
+// restore loads the cache from the append-only log, or from the snapshot if
+// the log is not enabled or did not exist yet.
+func (s *Server) restore() error {
+	path := s.options.AppendLogPath
+	if path == "" {
+		if s.options.SnapshotPath == "" {
+			return nil
+		}
+		if err := s.LoadSnapshot(s.options.SnapshotPath); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+
+	fresh := true
+	if info, err := os.Stat(path); err == nil && info.Size() > 0 {
+		fresh = false
+	}
+	if fresh && s.options.SnapshotPath != "" {
+		if err := s.LoadSnapshot(s.options.SnapshotPath); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	start := time.Now()
+	l, replayed, err := OpenAppendLog(path, s.cache, s.options.AppendLogFsync, s.logger)
+	if err != nil {
+		s.logger.Println("[ERR] Opening append-only log failed", "path", path, "error", err)
+		return err
+	}
+	s.logger.Println("[INFO] Replayed append-only log", "path", path, "records", replayed, "duration", time.Since(start))
+	s.aof = l
+
+	// The new log must include the entries loaded from the snapshot
+	if fresh && s.cache.Stats().Entries > 0 {
+		return l.Rewrite()
+	}
+	return nil
+}
+
+func newServer(cache Store, options Options) *Server {
+	c, cancel := context.WithCancel(context.Background())
+	var snapshots *snapshotter
+	if options.SnapshotPath != "" {
+		snapshots = newSnapshotter(cache, options.SnapshotPath, options.Logger)
+	}
 	return &Server{
-		cache:  freecache.NewCache(0),
-		logger: logger,
+		cache:     cache,
+		writes:    directWriter{cache},
+		snapshots: snapshots,
+		logger:    options.Logger,
+		options:   options,
+		pools:     newHandlerPools(options),
+		context:   c,
+		cancel:    cancel,
+		stats:     newServerStats(),
+		handlers:  make(map[*tcpHandler]struct{}),
+		stopped:   make(chan struct{}),
 	}
 }
 
 // Server handles all the incoming connections as well as handler dispatch.
 type Server struct {
-	cache    *freecache.Cache
-	logger   *log.Logger
-	addr     *net.TCPAddr
+	cache   Store
+	logger  *log.Logger
+	options Options
+	pools   *handlerPools
+	addr    *net.TCPAddr
+
+	// nil unless Options.SnapshotPath and Options.AppendLogPath are set
+	snapshots *snapshotter
+	aof       *AppendLog
+
+	// applies the writes made over every protocol, recording them for
+	// the append-only log and replicas
+	writes  cacheWriter
+	backlog *replicationBacklog
+	replica *replica
+
+	// counters of the connections, updated atomically
+	stats *serverStats
+
+	// admin HTTP listener, nil until ListenAdmin is called
+	admin     *http.Server
+	adminAddr *net.TCPAddr
+
 	listener *net.TCPListener
 	context  context.Context
 	cancel   context.CancelFunc
+
+	// open listeners and connections, guarded by mu
+	mu        sync.Mutex
+	closing   bool
+	listeners []*net.TCPListener
+	handlers  map[*tcpHandler]struct{}
+	active    sync.WaitGroup
+	stopped   chan struct{}
+}
+
+// SetFraming sets how values are delimited for connections accepted after the
+// call. The default is LineFraming.
+func (s *Server) SetFraming(framing Framing) {
+	s.options.Framing = framing
+}
+
+// Cache returns the cache served by the server.
+func (s *Server) Cache() Store {
+	return s.cache
+}
+
+// SaveSnapshot writes the entries of the cache to the file at path.
+func (s *Server) SaveSnapshot(path string) error {
+	start := time.Now()
+	count, err := SaveSnapshot(path, s.cache)
+	if err != nil {
+		s.logger.Println("[ERR] Snapshot failed", "path", path, "error", err)
+		return err
+	}
+	s.logger.Println("[INFO] Saved snapshot", "path", path, "entries", count, "duration", time.Since(start))
+	return nil
+}
+
+// Snapshot writes a snapshot to Options.SnapshotPath, waiting for a snapshot
+// in progress to finish first.
+func (s *Server) Snapshot() error {
+	if s.snapshots == nil {
+		return ErrNoSnapshotPath
+	}
+	return s.snapshots.Save()
+}
+
+// SnapshotStatus returns the outcome of the last snapshot written to
+// Options.SnapshotPath.
+func (s *Server) SnapshotStatus() SnapshotStatus {
+	if s.snapshots == nil {
+		return SnapshotStatus{}
+	}
+	return s.snapshots.Status()
+}
+
+// RewriteLog compacts the append-only log by rewriting it from the contents of
+// the cache.
+func (s *Server) RewriteLog() error {
+	if s.aof == nil {
+		return ErrNoAppendLog
+	}
+	return s.aof.Rewrite()
+}
+
+// ReplicationStatus returns the role of the server, primary or replica. A
+// primary lists the replicas which polled it recently, while a replica
+// describes its own progress.
+func (s *Server) ReplicationStatus() (role string, replicas []ReplicaStatus) {
+	if s.replica != nil {
+		return "replica", []ReplicaStatus{s.replica.status()}
+	}
+	if s.backlog != nil {
+		_, replicas = s.backlog.status()
+	}
+	return "primary", replicas
+}
+
+// LoadSnapshot loads the entries of the snapshot file at path into the cache.
+// Entries which have expired since the snapshot was taken are skipped.
+func (s *Server) LoadSnapshot(path string) error {
+	start := time.Now()
+	loaded, expired, err := LoadSnapshot(path, s.cache)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			s.logger.Println("[ERR] Loading snapshot failed", "path", path, "error", err)
+		}
+		return err
+	}
+	s.logger.Println("[INFO] Loaded snapshot", "path", path, "entries", loaded, "expired", expired, "duration", time.Since(start))
+	return nil
+}
+
+// Start starts accepting client connections speaking the mulu protocol, and
+// opens the admin listener if Options.AdminAddr is set. It returns once the
+// listeners are bound. An empty addr uses Options.Addr. This method is
+// non-blocking.
+func (s *Server) Start(addr string) error {
+	if addr == "" {
+		addr = s.options.Addr
+	}
+	if err := s.Listen(addr, ProtocolMulu); err != nil {
+		return err
+	}
+	if s.options.AdminAddr != "" {
+		return s.ListenAdmin(s.options.AdminAddr)
+	}
+	return nil
+}
+
+// Serve starts the server and blocks until it is stopped.
+func (s *Server) Serve(addr string) error {
+	if err := s.Start(addr); err != nil {
+		return err
+	}
+	s.Wait()
+	return nil
 }
 
-// Start starts accepting client connections. This method is non-blocking.
-func (s *Server) Start(addr string) (err error) {
+// Wait blocks until the server is stopped and all connections are closed.
+func (s *Server) Wait() {
+	<-s.stopped
+}
+
+// Addr returns the address of the first listener, which includes the actual
+// port when binding port 0. It returns nil before the server is started.
+func (s *Server) Addr() *net.TCPAddr {
+	return s.addr
+}
+
+// Listen opens an additional listener whose connections speak the given
+// protocol. Listeners are closed when the server is stopped. This method is
+// non-blocking.
+func (s *Server) Listen(addr string, protocol Protocol) (err error) {
 	// Validate the ssh bind addr
 	if addr == "" {
 		err = fmt.Errorf("server: Empty bind address")
@@ -57,32 +303,99 @@ func (s *Server) Start(addr string) (err error) {
 		return
 	}
 
-	s.listener = listener
-	s.addr = listener.Addr().(*net.TCPAddr)
-	s.logger.Println("Starting server", "addr", addr)
-
-	c, cancel := context.WithCancel(context.Background())
-	s.context = c
-	s.cancel = cancel
-	go s.listen(c)
+	s.mu.Lock()
+	if s.closing {
+		s.mu.Unlock()
+		listener.Close()
+		return fmt.Errorf("server: Server is stopped")
+	}
+	if s.listener == nil {
+		s.listener = listener
+		s.addr = listener.Addr().(*net.TCPAddr)
+	}
+	s.listeners = append(s.listeners, listener)
+	s.mu.Unlock()
+	s.logger.Println("Starting server", "addr", addr, "protocol", protocol)
 
-	<-c.Done()
+	go s.listen(s.context, listener, protocol)
 	return
 }
 
-// Stop stops the server and kills all goroutines. This method is blocking.
-func (s *Server) Stop() {
+// Stop stops accepting connections and waits for the open connections to
+// process and respond to the requests they have already received. Connections
+// which are still open when ctx is done are closed forcibly; their number is
+// returned along with the context error. A final snapshot is then written if
+// Options.SnapshotPath is set, and the append-only log is closed. This method
+// is blocking.
+func (s *Server) Stop(ctx context.Context) (forced int, err error) {
+	s.mu.Lock()
+	if s.closing {
+		s.mu.Unlock()
+		select {
+		case <-s.stopped:
+			return 0, nil
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		}
+	}
 	s.logger.Println("[INFO] Shutting down server...")
+	s.closing = true
+
+	// Handlers stop reading once the context is cancelled
 	s.cancel()
+	for _, listener := range s.listeners {
+		listener.Close()
+	}
+	if s.admin != nil {
+		s.admin.Close()
+	}
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.active.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		s.mu.Lock()
+		for h := range s.handlers {
+			h.kill()
+			forced++
+		}
+		s.mu.Unlock()
+		<-done
+		err = ctx.Err()
+		s.logger.Println("[WRN] Closed connections forcibly", "count", forced)
+	}
+
+	if s.replica != nil {
+		<-s.replica.done
+	}
+	if s.snapshots != nil {
+		if e := s.snapshots.Save(); e != nil && err == nil {
+			err = e
+		}
+	}
+	if s.aof != nil {
+		if e := s.aof.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+
+	close(s.stopped)
+	return
 }
 
 // listen accepts new connections and handles the conversion from TCP to SSH connections.
-func (s *Server) listen(c context.Context) {
-	defer s.listener.Close()
+func (s *Server) listen(c context.Context, listener *net.TCPListener, protocol Protocol) {
+	defer listener.Close()
 
 	for {
-		// Accepts will only block for 1s
-		s.listener.SetDeadline(time.Now().Add(time.Second))
+		// Accepts will only block for the accept timeout
+		listener.SetDeadline(time.Now().Add(s.options.AcceptTimeout))
 
 		select {
 
@@ -93,11 +406,11 @@ func (s *Server) listen(c context.Context) {
 		default:
 
 			// Accept new connection
-			tcpConn, err := s.listener.Accept()
+			tcpConn, err := listener.Accept()
 			if err != nil {
 				if neterr, ok := err.(net.Error); ok && neterr.Timeout() {
 					// s.Logger.Println("[DBG] Connection timeout...")
-				} else {
+				} else if c.Err() == nil {
 					s.logger.Println("[WRN] Connection failed", "error", err)
 				}
 				continue
@@ -105,35 +418,206 @@ func (s *Server) listen(c context.Context) {
 
 			// Handle connection
 			s.logger.Println("[INF] Successful TCP connection:", tcpConn.RemoteAddr().String())
-			h := NewTcpHandler(s.cache, tcpConn, s.logger, s.context)
-			go h.Execute()
+			h := NewTcpHandler(s.cache, tcpConn, s.context, s.newParser(protocol), s.options, s.pools, s.stats)
+			h.protocol, h.connected = protocol, time.Now()
+			if !s.track(h) {
+				h.discard()
+				return
+			}
+			go s.handle(h)
+		}
+	}
+}
+
+// track registers a new connection unless the server is stopping.
+func (s *Server) track(h *tcpHandler) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closing {
+		return false
+	}
+	s.handlers[h] = struct{}{}
+	s.active.Add(1)
+	atomic.AddInt64(&s.stats.connections, 1)
+	atomic.AddInt64(&s.stats.totalConnections, 1)
+	return true
+}
+
+func (s *Server) handle(h *tcpHandler) {
+	defer s.active.Done()
+	h.Execute()
+
+	s.mu.Lock()
+	delete(s.handlers, h)
+	s.mu.Unlock()
+	atomic.AddInt64(&s.stats.connections, -1)
+}
+
+// newParser returns a function creating the parser for a connection.
+func (s *Server) newParser(protocol Protocol) func(io.Writer) RequestParser {
+	return func(w io.Writer) RequestParser {
+		switch protocol {
+		case ProtocolRESP:
+			p := NewRESPParser(s.cache, w, s.logger)
+			p.writes, p.replica, p.counters = s.writes, s.replica, s.stats
+			return p
+		case ProtocolMemcache:
+			p := NewMemcacheParser(s.cache, w, s.logger)
+			p.writes, p.replica, p.counters = s.writes, s.replica, s.stats
+			return p
 		}
+		return &Parser{logger: s.logger, writer: w, cache: s.cache, framing: s.options.Framing, snapshots: s.snapshots, aof: s.aof,
+			writes: s.writes, backlog: s.backlog, replica: s.replica, counters: s.stats, password: s.options.AdminPassword}
+	}
+}
+
+// Protocol is the wire protocol spoken on a listener.
+type Protocol int
+
+const (
+	// ProtocolMulu is the native line based protocol handled by Parser.
+	ProtocolMulu Protocol = iota
+
+	// ProtocolRESP is the Redis serialization protocol handled by RESPParser.
+	ProtocolRESP
+
+	// ProtocolMemcache is the memcached text protocol handled by
+	// MemcacheParser.
+	ProtocolMemcache
+)
+
+func (p Protocol) String() string {
+	switch p {
+	case ProtocolMulu:
+		return "mulu"
+	case ProtocolRESP:
+		return "resp"
+	case ProtocolMemcache:
+		return "memcache"
+	}
+	return "unknown"
+}
+
+// RequestParser executes the requests read from a connection and writes the
+// responses. Requests are framed by lines, optionally followed by a raw payload
+// whose size the parser announces through Expect.
+type RequestParser interface {
+	// Parse handles a single line, without the line terminator.
+	Parse(line []byte) bool
+
+	// Expect returns the number of raw bytes, including the trailing CRLF,
+	// which must be passed to ParsePayload before the next line is parsed.
+	Expect() int
+
+	// ParsePayload handles the raw bytes announced by Expect.
+	ParsePayload(data []byte) bool
+
+	// Reject abandons the current request because it does not fit in the
+	// request buffer.
+	Reject()
+
+	// Closed reports whether the connection must be closed, once the
+	// responses written so far are flushed, because the parser cannot tell
+	// where the next request starts.
+	Closed() bool
+}
+
+// NewByteConsumer creates a consumer parsing requests from the ring, which
+// must have a power of two length.
+func NewByteConsumer(w FlushableWriter, closer io.Closer, parser RequestParser, ring []byte, maxRequestSize int, logger *log.Logger) *ByteConsumer {
+	size := InitialRequestBufferSize
+	if size > maxRequestSize {
+		size = maxRequestSize
+	}
+	return &ByteConsumer{
+		sequence: -1,
+		Writer:   w,
+		Closer:   closer,
+		Parser:   parser,
+		logger:   logger,
+		ring:     ring,
+		mask:     int64(len(ring) - 1),
+		buffer:   make([]byte, size),
+		maxSize:  maxRequestSize,
 	}
 }
 
+// Requests start in a buffer of this size, which is doubled as needed up to
+// the maximum request size.
+const InitialRequestBufferSize = 4 * 1024
+
 type ByteConsumer struct {
-	Writer FlushableWriter
-	Closer io.Closer
-	Parser *Parser
-	logger *log.Logger
-	cache  *freecache.Cache
-	ring   *[RingBufferCapacity]byte
-	buffer [65336]byte
+	// last consumed sequence, updated atomically once the responses have been
+	// flushed
+	sequence int64
+
+	Writer  FlushableWriter
+	Closer  io.Closer
+	Parser  RequestParser
+	logger  *log.Logger
+	ring    []byte
+	mask    int64
+	buffer  []byte
+	maxSize int
 	// closed      bool
 	requestSize int
+
+	// number of raw payload bytes still to collect or skip
+	payload, discard int
+
+	// skipping the rest of a line which exceeded the buffer
+	overflow bool
+
+	// the parser asked for the connection to be closed
+	closed bool
 }
 
 func (b *ByteConsumer) Consume(lower, upper int64) {
-	defer b.Writer.Flush()
+	defer atomic.StoreInt64(&b.sequence, upper)
+
+	// the connection is being closed, so the rest of its input is dropped
+	if b.closed {
+		return
+	}
+	defer b.flush()
 
 	var char byte
 	for sequence := lower; sequence <= upper; sequence++ {
-		if b.requestSize >= len(b.buffer) {
-			b.Writer.Write(ErrMaxSize)
-			b.logger.Printf("ERR %s\r\n", string(ErrMaxSize))
-			return
+		char = b.ring[sequence&b.mask]
+
+		// skip the payload of a rejected request
+		if b.discard > 0 {
+			b.discard--
+			continue
+		}
+
+		// length-prefixed payloads are copied verbatim, CR and LF included
+		if b.payload > 0 {
+			b.buffer[b.requestSize] = char
+			b.requestSize++
+			if b.requestSize == b.payload {
+				_ = b.Parser.ParsePayload(b.buffer[:b.requestSize])
+				b.requestSize = 0
+				b.payload = 0
+				if b.closed = b.Parser.Closed(); b.closed {
+					return
+				}
+			}
+			continue
+		}
+
+		// reject lines which do not fit and resume after them
+		if b.requestSize >= len(b.buffer) && !b.grow(b.requestSize+1) {
+			if !b.overflow {
+				b.Parser.Reject()
+				b.overflow = true
+			}
+			if char == '\n' {
+				b.overflow = false
+				b.requestSize = 0
+			}
+			continue
 		}
-		char = b.ring[sequence&RingBufferMask]
 
 		// end of request
 		if char == '\n' {
@@ -141,6 +625,17 @@ func (b *ByteConsumer) Consume(lower, upper int64) {
 
 			// reset request size to 0
 			b.requestSize = 0
+			if b.closed = b.Parser.Closed(); b.closed {
+				return
+			}
+
+			// the parser may ask for a raw payload before the next line
+			if n := b.Parser.Expect(); n > len(b.buffer) && !b.grow(n) {
+				b.Parser.Reject()
+				b.discard = n
+			} else {
+				b.payload = n
+			}
 		} else if char == '\r' {
 			continue
 		} else {
@@ -149,3 +644,34 @@ func (b *ByteConsumer) Consume(lower, upper int64) {
 		}
 	}
 }
+
+// flush writes the pending responses, then closes the connection if the
+// parser asked for it.
+func (b *ByteConsumer) flush() {
+	b.Writer.Flush()
+	if b.closed && b.Closer != nil {
+		b.Closer.Close()
+	}
+}
+
+// grow enlarges the request buffer to hold at least n bytes. It returns false
+// if n exceeds the maximum request size.
+func (b *ByteConsumer) grow(n int) bool {
+	if n > b.maxSize {
+		return false
+	}
+	size := len(b.buffer)
+	if size == 0 {
+		size = 1
+	}
+	for size < n {
+		size *= 2
+	}
+	if size > b.maxSize {
+		size = b.maxSize
+	}
+	buffer := make([]byte, size)
+	copy(buffer, b.buffer[:b.requestSize])
+	b.buffer = buffer
+	return true
+}
@@ -0,0 +1,325 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestServerStart(t *testing.T) {
+	logger := log.New(ioutil.Discard, "logger: ", log.Lshortfile)
+	server := NewServer(NewFreecacheStore(0), logger)
+	if err := server.Start("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	if server.Addr() == nil || server.Addr().Port == 0 {
+		t.Fatalf("unexpected address %v", server.Addr())
+	}
+
+	conn, err := net.Dial("tcp", server.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if _, err := conn.Write([]byte("SET key 0 value\r\nGET key\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	r := bufio.NewReader(conn)
+	for _, expected := range []string{"+OK\r\n", "+VALUE value\r\n"} {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if line != expected {
+			t.Fatalf("expected %q, got %q", expected, line)
+		}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		server.Wait()
+		close(done)
+	}()
+	if forced, err := server.Stop(context.Background()); forced != 0 || err != nil {
+		t.Fatalf("Stop: %d connections closed forcibly, %v", forced, err)
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Wait did not return after Stop")
+	}
+}
+
+func TestServerStopDrainsRequests(t *testing.T) {
+	logger := log.New(ioutil.Discard, "logger: ", log.Lshortfile)
+	server := NewServer(NewFreecacheStore(0), logger)
+	if err := server.Start("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := net.Dial("tcp", server.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// Wait for the first response so the rest of the batch is in flight
+	// when the server stops.
+	const requests = 10000
+	r := bufio.NewReader(conn)
+	conn.Write([]byte("SET key 0 value\r\n"))
+	if line, err := r.ReadString('\n'); err != nil || line != "+OK\r\n" {
+		t.Fatalf("unexpected response %q, %v", line, err)
+	}
+	var batch []byte
+	for i := 0; i < requests; i++ {
+		batch = append(batch, "GET key\r\n"...)
+	}
+	if _, err := conn.Write(batch); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if forced, err := server.Stop(ctx); forced != 0 || err != nil {
+		t.Fatalf("Stop: %d connections closed forcibly, %v", forced, err)
+	}
+
+	for i := 0; i < requests; i++ {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("response %d: %v", i, err)
+		}
+		if line != "+VALUE value\r\n" {
+			t.Fatalf("response %d: unexpected %q", i, line)
+		}
+	}
+	if _, err := r.ReadByte(); err == nil {
+		t.Fatal("connection still open after Stop")
+	}
+
+	if _, err := net.Dial("tcp", server.Addr().String()); err == nil {
+		t.Fatal("server still accepting connections after Stop")
+	}
+}
+
+func TestServerStopForcesBlockedConnections(t *testing.T) {
+	logger := log.New(ioutil.Discard, "logger: ", log.Lshortfile)
+	cache := NewFreecacheStore(16 * 1024 * 1024)
+	cache.Set([]byte("key"), bytes.Repeat([]byte("v"), 1024), 0)
+	server := NewServer(cache, logger)
+	if err := server.Start("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := net.DialTCP("tcp", nil, server.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadBuffer(4096)
+
+	// Never reading the responses blocks the handler once the socket
+	// buffers are full, so it cannot drain. The responses to a full ring
+	// are much larger than the socket buffers, and writes time out once
+	// the handler has stopped reading as well.
+	batch := bytes.Repeat([]byte("GET key\r\n"), 64*1024)
+	for {
+		conn.SetWriteDeadline(time.Now().Add(100 * time.Millisecond))
+		if _, err := conn.Write(batch); err != nil {
+			if neterr, ok := err.(net.Error); !ok || !neterr.Timeout() {
+				t.Fatal(err)
+			}
+			break
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	forced, err := server.Stop(ctx)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("expected deadline error, got %v", err)
+	}
+	if forced != 1 {
+		t.Fatalf("expected 1 forced connection, got %d", forced)
+	}
+	server.Wait()
+}
+
+func TestServerStats(t *testing.T) {
+	logger := log.New(ioutil.Discard, "logger: ", log.Lshortfile)
+	server := NewServer(NewFreecacheStore(0), logger)
+	if err := server.Start("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop(context.Background())
+
+	conn, err := net.Dial("tcp", server.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// the responses are only counted once they are flushed
+	requests := "SET key 0 value\r\nGET key\r\nGET missing\r\nTTL key\r\nNOPE\r\nSET key\r\n"
+	if _, err := conn.Write([]byte(requests)); err != nil {
+		t.Fatal(err)
+	}
+	r := bufio.NewReader(conn)
+	written := 0
+	for i := 0; i < 6; i++ {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		written += len(line)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for server.Stats().BytesOut < int64(written) && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	requests += "STATS\r\n"
+	if _, err := conn.Write([]byte("STATS\r\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	stats := make(map[string]string)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if line == string(EndResponse) {
+			break
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 3 || fields[0] != "+STAT" {
+			t.Fatalf("unexpected line %q", line)
+		}
+		stats[fields[1]] = fields[2]
+	}
+	expected := map[string]string{
+		"entry_count":                "1",
+		"hit_count":                  "1",
+		"miss_count":                 "1",
+		"hit_rate":                   "0.5000",
+		"connections":                "1",
+		"total_connections":          "1",
+		"bytes_in":                   strconv.Itoa(len(requests)),
+		"bytes_out":                  strconv.Itoa(written),
+		"cmd_get":                    "2",
+		"cmd_set":                    "1",
+		"cmd_ttl":                    "1",
+		"cmd_stats":                  "0", // counted once it completes
+		"cmd_mget":                   "0",
+		"parse_error_unknown_cmd":    "1",
+		"parse_error_incomplete_cmd": "1",
+		"parse_error_invalid_args":   "0",
+	}
+	for name, value := range expected {
+		if stats[name] != value {
+			t.Errorf("expected %s to be %s, got %q", name, value, stats[name])
+		}
+	}
+	conn.Close()
+	deadline = time.Now().Add(5 * time.Second)
+	for server.Stats().Connections != 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if stats := server.Stats(); stats.Connections != 0 || stats.TotalConnections != 1 || stats.Commands["STATS"] != 1 {
+		t.Fatalf("unexpected stats after closing the connection: %+v", stats)
+	}
+}
+
+func TestServerStatsProtocols(t *testing.T) {
+	server := NewServer(NewFreecacheStore(0), log.New(ioutil.Discard, "", 0))
+	var buf bytes.Buffer
+	resp := server.newParser(ProtocolRESP)(&buf)
+	for _, line := range []string{"set key value", "GET key", "Ping", "NOPE"} {
+		resp.Parse([]byte(line))
+	}
+	memcache := server.newParser(ProtocolMemcache)(&buf)
+	memcache.Parse([]byte("set other 0 0 5"))
+	memcache.ParsePayload([]byte("value\r\n"))
+	for _, line := range []string{"get other", "delete other", "version"} {
+		memcache.Parse([]byte(line))
+	}
+
+	expected := map[string]int64{"GET": 2, "SET": 2, "PING": 1, "DELETE": 1, "VERSION": 1, "DEL": 0}
+	stats := server.Stats()
+	for name, count := range expected {
+		if stats.Commands[name] != count {
+			t.Errorf("expected %d %s, got %d", count, name, stats.Commands[name])
+		}
+	}
+	if _, ok := stats.Commands["NOPE"]; ok {
+		t.Error("unknown commands are counted")
+	}
+}
+
+func TestNewServerWithOptions(t *testing.T) {
+	if _, err := NewServerWithOptions(Options{RingSize: 1000}); err == nil {
+		t.Fatal("expected error for a ring size which is not a power of two")
+	}
+
+	server, err := NewServerWithOptions(Options{CacheSize: 64 * 1024 * 1024, ReadTimeout: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the minimum cache size only fits entries up to 512 bytes
+	if err := server.Cache().Set([]byte("key"), make([]byte, 32*1024), 0); err != nil {
+		t.Fatalf("cache size ignored: %v", err)
+	}
+
+	tinylfu, err := NewServerWithOptions(Options{CacheSize: 64 * 1024 * 1024, Engine: EngineTinyLFU})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := tinylfu.Cache().(*TinyLFUStore); !ok {
+		t.Fatalf("expected a TinyLFU store, got %T", tinylfu.Cache())
+	}
+	if err := tinylfu.Cache().Set([]byte("key"), make([]byte, 32*1024), 0); err != nil {
+		t.Fatalf("cache size ignored: %v", err)
+	}
+	if _, err := NewServerWithOptions(Options{Engine: Engine(5)}); err == nil {
+		t.Fatal("expected error for an unknown engine")
+	}
+
+	if err := server.Start("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop(context.Background())
+
+	conn, err := net.Dial("tcp", server.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("idle connection not closed by the server: %v", err)
+	}
+}
+
+func TestNewServerSize(t *testing.T) {
+	logger := log.New(ioutil.Discard, "logger: ", log.Lshortfile)
+	server := NewServerSize(64*1024*1024, logger)
+	if err := server.Cache().Set([]byte("key"), make([]byte, 32*1024), 0); err != nil {
+		t.Fatalf("cache size ignored: %v", err)
+	}
+}
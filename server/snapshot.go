@@ -0,0 +1,429 @@
+package server
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"hash"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// Snapshot file layout, all integers big-endian:
+//
+//	header   "MULU" uint16(version)
+//	entry    byte(1) uint32(key length) uint32(value length) uint32(expire at) key value
+//	trailer  byte(0) uint64(entry count) uint32(CRC-32C of everything before it)
+//
+// Expiration times are absolute unix seconds, 0 meaning the entry never
+// expires.
+const (
+	SnapshotMagic   = "MULU"
+	SnapshotVersion = 1
+)
+
+const (
+	snapshotEnd   byte = 0
+	snapshotEntry byte = 1
+)
+
+var (
+	ErrSnapshotFormat   = errors.New("snapshot: Invalid file format")
+	ErrSnapshotVersion  = errors.New("snapshot: Unsupported version")
+	ErrSnapshotChecksum = errors.New("snapshot: Checksum mismatch")
+	ErrNoSnapshotPath   = errors.New("snapshot: No snapshot path configured")
+)
+
+var snapshotTable = crc32.MakeTable(crc32.Castagnoli)
+
+// WriteSnapshot writes every entry of the cache to w. Entries written to the
+// cache while the snapshot is taken may or may not be included.
+func WriteSnapshot(w io.Writer, cache Store) (count int, err error) {
+	crc := crc32.New(snapshotTable)
+	bw := bufio.NewWriter(io.MultiWriter(w, crc))
+
+	var header [6]byte
+	copy(header[:], SnapshotMagic)
+	binary.BigEndian.PutUint16(header[4:], SnapshotVersion)
+	if _, err = bw.Write(header[:]); err != nil {
+		return
+	}
+
+	var hdr [13]byte
+	hdr[0] = snapshotEntry
+	cache.Iterate(func(key, value []byte, expireAt uint32) bool {
+		binary.BigEndian.PutUint32(hdr[1:], uint32(len(key)))
+		binary.BigEndian.PutUint32(hdr[5:], uint32(len(value)))
+		binary.BigEndian.PutUint32(hdr[9:], expireAt)
+		if _, err = bw.Write(hdr[:]); err != nil {
+			return false
+		}
+		if _, err = bw.Write(key); err != nil {
+			return false
+		}
+		if _, err = bw.Write(value); err != nil {
+			return false
+		}
+		count++
+		return true
+	})
+	if err != nil {
+		return
+	}
+
+	var trailer [9]byte
+	trailer[0] = snapshotEnd
+	binary.BigEndian.PutUint64(trailer[1:], uint64(count))
+	if _, err = bw.Write(trailer[:]); err != nil {
+		return
+	}
+	if err = bw.Flush(); err != nil {
+		return
+	}
+
+	// the checksum covers everything written so far
+	var sum [4]byte
+	binary.BigEndian.PutUint32(sum[:], crc.Sum32())
+	_, err = w.Write(sum[:])
+	return
+}
+
+// ReadSnapshot loads the entries of a snapshot into the cache, skipping the
+// ones which have expired since it was written. Entries are stored as they are
+// read, so a snapshot failing the checksum verification may have been loaded
+// partially; use VerifySnapshot first to avoid this.
+func ReadSnapshot(r io.Reader, cache Store) (loaded, expired int, err error) {
+	sr := newSnapshotReader(r)
+	if err = sr.readHeader(); err != nil {
+		return
+	}
+
+	for {
+		key, value, expireAt, ok, e := sr.next()
+		if e != nil {
+			return loaded, expired, e
+		} else if !ok {
+			break
+		}
+
+		var expiration int
+		if expireAt != 0 {
+			expiration = int(int64(expireAt) - time.Now().Unix())
+			if expiration <= 0 {
+				expired++
+				continue
+			}
+		}
+		if e := cache.Set(key, value, expiration); e != nil {
+			return loaded, expired, e
+		}
+		loaded++
+	}
+
+	err = sr.readTrailer(loaded + expired)
+	return
+}
+
+// VerifySnapshot checks the format and checksum of a snapshot without loading
+// it.
+func VerifySnapshot(r io.Reader) (count int, err error) {
+	sr := newSnapshotReader(r)
+	if err = sr.readHeader(); err != nil {
+		return
+	}
+	for {
+		_, _, _, ok, e := sr.next()
+		if e != nil {
+			return count, e
+		} else if !ok {
+			break
+		}
+		count++
+	}
+	err = sr.readTrailer(count)
+	return
+}
+
+// SaveSnapshot writes a snapshot of the cache to the file at path. The
+// snapshot is written to a temporary file which then replaces path, so a crash
+// while saving never leaves a partial snapshot behind.
+func SaveSnapshot(path string, cache Store) (count int, err error) {
+	dir, name := filepath.Split(path)
+	if dir == "" {
+		dir = "."
+	}
+	f, err := ioutil.TempFile(dir, name+".tmp")
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+
+	if count, err = WriteSnapshot(f, cache); err != nil {
+		return
+	}
+	if err = f.Sync(); err != nil {
+		return
+	}
+	if err = f.Close(); err != nil {
+		return
+	}
+	if err = os.Rename(f.Name(), path); err != nil {
+		return
+	}
+
+	// Persist the rename itself
+	if d, e := os.Open(dir); e == nil {
+		d.Sync()
+		d.Close()
+	}
+	return
+}
+
+// LoadSnapshot verifies the snapshot file at path and loads it into the cache.
+func LoadSnapshot(path string, cache Store) (loaded, expired int, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+
+	if _, err = VerifySnapshot(f); err != nil {
+		return
+	}
+	if _, err = f.Seek(0, io.SeekStart); err != nil {
+		return
+	}
+	return ReadSnapshot(f, cache)
+}
+
+// SnapshotStatus describes the last snapshot written by a server.
+type SnapshotStatus struct {
+	// Time the last snapshot was started, zero if none was written yet
+	LastSave time.Time
+
+	// Time taken and number of entries written by the last snapshot
+	Duration time.Duration
+	Entries  int
+
+	// Error of the last snapshot, if it failed
+	Err error
+
+	// Whether a snapshot is being written
+	InProgress bool
+}
+
+// snapshotter writes the snapshots of a server to its snapshot path, one at a
+// time.
+type snapshotter struct {
+	cache  Store
+	path   string
+	logger *log.Logger
+
+	// held while a snapshot is written
+	saving sync.Mutex
+
+	// pending counts the snapshots requested and not written yet
+	mu      sync.Mutex
+	pending int
+	status  SnapshotStatus
+}
+
+func newSnapshotter(cache Store, path string, logger *log.Logger) *snapshotter {
+	return &snapshotter{cache: cache, path: path, logger: logger}
+}
+
+// Save writes a snapshot, waiting for a snapshot in progress to finish first.
+func (s *snapshotter) Save() error {
+	s.mu.Lock()
+	s.pending++
+	s.status.InProgress = true
+	s.mu.Unlock()
+
+	s.saving.Lock()
+	defer s.saving.Unlock()
+	return s.save()
+}
+
+// BackgroundSave starts writing a snapshot in a new goroutine. It returns
+// false if a snapshot is already in progress, in the background or not.
+func (s *snapshotter) BackgroundSave() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.pending > 0 {
+		return false
+	}
+	s.pending++
+	s.status.InProgress = true
+	go func() {
+		s.saving.Lock()
+		defer s.saving.Unlock()
+		s.save()
+	}()
+	return true
+}
+
+// Status returns the outcome of the last snapshot.
+func (s *snapshotter) Status() SnapshotStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.status
+}
+
+// save must be called with the saving lock held, once the snapshot is counted
+// as pending.
+func (s *snapshotter) save() error {
+	start := time.Now()
+	count, err := SaveSnapshot(s.path, s.cache)
+	duration := time.Since(start)
+	if err != nil {
+		s.logger.Println("[ERR] Snapshot failed", "path", s.path, "error", err)
+	} else {
+		s.logger.Println("[INFO] Saved snapshot", "path", s.path, "entries", count, "duration", duration)
+	}
+
+	s.mu.Lock()
+	s.pending--
+	s.status = SnapshotStatus{LastSave: start, Duration: duration, Entries: count, Err: err, InProgress: s.pending > 0}
+	s.mu.Unlock()
+	return err
+}
+
+// run saves a snapshot every interval until ctx is done.
+func (s *snapshotter) run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.BackgroundSave()
+		}
+	}
+}
+
+// Initial growth of the buffer of a snapshotReader
+const snapshotReadChunk = 64 * 1024
+
+type snapshotReader struct {
+	r   *bufio.Reader
+	crc hash.Hash32
+	buf []byte
+}
+
+func newSnapshotReader(r io.Reader) *snapshotReader {
+	crc := crc32.New(snapshotTable)
+	return &snapshotReader{r: bufio.NewReader(r), crc: crc}
+}
+
+// read fills a buffer of n bytes, which is only valid until the next call.
+// The lengths are read before the checksum can be verified, so the buffer
+// grows with the bytes actually read rather than to n at once: a corrupt
+// length fails at the end of the snapshot instead of allocating gigabytes.
+func (s *snapshotReader) read(n int) ([]byte, error) {
+	b := s.buf[:0]
+	for len(b) < n {
+		if len(b) == cap(b) {
+			size := 2*cap(b) + snapshotReadChunk
+			if size > n {
+				size = n
+			}
+			s.buf = make([]byte, len(b), size)
+			copy(s.buf, b)
+			b = s.buf
+		}
+		end := cap(b)
+		if end > n {
+			end = n
+		}
+		if _, err := io.ReadFull(s.r, b[len(b):end]); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		b = b[:end]
+	}
+	s.crc.Write(b)
+	return b, nil
+}
+
+func (s *snapshotReader) readHeader() error {
+	b, err := s.read(6)
+	if err != nil {
+		return err
+	}
+	if string(b[:4]) != SnapshotMagic {
+		return ErrSnapshotFormat
+	}
+	if binary.BigEndian.Uint16(b[4:]) != SnapshotVersion {
+		return ErrSnapshotVersion
+	}
+	return nil
+}
+
+// next returns the next entry, or ok == false once the trailer is reached.
+// The key and value are only valid until the next call.
+func (s *snapshotReader) next() (key, value []byte, expireAt uint32, ok bool, err error) {
+	b, err := s.read(1)
+	if err != nil {
+		return
+	}
+	switch b[0] {
+	case snapshotEnd:
+		return
+	case snapshotEntry:
+	default:
+		err = ErrSnapshotFormat
+		return
+	}
+
+	if b, err = s.read(12); err != nil {
+		return
+	}
+	keyLen := int(binary.BigEndian.Uint32(b))
+	valueLen := int(binary.BigEndian.Uint32(b[4:]))
+	expireAt = binary.BigEndian.Uint32(b[8:])
+	if keyLen > 65535 || valueLen < 0 || keyLen+valueLen < 0 {
+		err = ErrSnapshotFormat
+		return
+	}
+
+	if b, err = s.read(keyLen + valueLen); err != nil {
+		return
+	}
+	return b[:keyLen], b[keyLen:], expireAt, true, nil
+}
+
+func (s *snapshotReader) readTrailer(count int) error {
+	b, err := s.read(8)
+	if err != nil {
+		return err
+	}
+	if binary.BigEndian.Uint64(b) != uint64(count) {
+		return ErrSnapshotFormat
+	}
+
+	expected := s.crc.Sum32()
+	var sum [4]byte
+	if _, err := io.ReadFull(s.r, sum[:]); err != nil {
+		return io.ErrUnexpectedEOF
+	}
+	if binary.BigEndian.Uint32(sum[:]) != expected {
+		return ErrSnapshotChecksum
+	}
+	return nil
+}
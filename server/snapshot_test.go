@@ -0,0 +1,288 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	cache := NewFreecacheStore(1024 * 1024)
+	cache.Set([]byte("key"), []byte("value"), 0)
+	cache.Set([]byte("ttl"), []byte("expiring"), 100)
+	cache.Set([]byte("binary"), []byte("a\r\nb\x00"), 0)
+
+	var buf bytes.Buffer
+	count, err := WriteSnapshot(&buf, cache)
+	if err != nil || count != 3 {
+		t.Fatalf("expected 3 entries, got %d (%v)", count, err)
+	}
+	if n, err := VerifySnapshot(bytes.NewReader(buf.Bytes())); err != nil || n != 3 {
+		t.Fatalf("expected a valid snapshot, got %d (%v)", n, err)
+	}
+
+	restored := NewFreecacheStore(1024 * 1024)
+	loaded, expired, err := ReadSnapshot(&buf, restored)
+	if err != nil || loaded != 3 || expired != 0 {
+		t.Fatalf("expected 3 loaded entries, got %d, %d (%v)", loaded, expired, err)
+	}
+	for _, key := range []string{"key", "ttl", "binary"} {
+		expected, _ := cache.Get([]byte(key))
+		if value, err := restored.Get([]byte(key)); err != nil || !bytes.Equal(value, expected) {
+			t.Errorf("%s: expected %q, got %q (%v)", key, expected, value, err)
+		}
+	}
+	if ttl, _ := restored.TTL([]byte("key")); ttl != 0 {
+		t.Errorf("expected no expiration, got %d", ttl)
+	}
+	if ttl, _ := restored.TTL([]byte("ttl")); ttl < 98 || ttl > 100 {
+		t.Errorf("expected the remaining TTL, got %d", ttl)
+	}
+}
+
+func TestSnapshotSkipsExpired(t *testing.T) {
+	cache := NewFreecacheStore(1024 * 1024)
+	cache.Set([]byte("key"), []byte("value"), 100)
+
+	var buf bytes.Buffer
+	if _, err := WriteSnapshot(&buf, cache); err != nil {
+		t.Fatal(err)
+	}
+
+	// Move the expiration of the only entry into the past
+	data := buf.Bytes()
+	binary.BigEndian.PutUint32(data[6+1+8:], uint32(time.Now().Unix()-10))
+	binary.BigEndian.PutUint32(data[len(data)-4:], crc32.Checksum(data[:len(data)-4], snapshotTable))
+
+	restored := NewFreecacheStore(1024 * 1024)
+	loaded, expired, err := ReadSnapshot(bytes.NewReader(data), restored)
+	if err != nil || loaded != 0 || expired != 1 {
+		t.Fatalf("expected 1 expired entry, got %d, %d (%v)", loaded, expired, err)
+	}
+	if restored.Stats().Entries != 0 {
+		t.Fatal("expired entry was loaded")
+	}
+}
+
+func TestSnapshotCorrupt(t *testing.T) {
+	cache := NewFreecacheStore(1024 * 1024)
+	cache.Set([]byte("key"), []byte("value"), 0)
+
+	var buf bytes.Buffer
+	WriteSnapshot(&buf, cache)
+	data := buf.Bytes()
+
+	corrupt := append([]byte{}, data...)
+	corrupt[len(corrupt)-14] ^= 0xff
+	if _, err := VerifySnapshot(bytes.NewReader(corrupt)); err != ErrSnapshotChecksum {
+		t.Errorf("expected checksum error, got %v", err)
+	}
+	if _, err := VerifySnapshot(bytes.NewReader(data[:len(data)-1])); err == nil {
+		t.Error("expected error for truncated snapshot")
+	}
+	if _, err := VerifySnapshot(bytes.NewReader([]byte("REDIS0009"))); err != ErrSnapshotFormat {
+		t.Errorf("expected format error, got %v", err)
+	}
+
+	// A corrupt length fails at the end of the data, without allocating it
+	length := append([]byte{}, data...)
+	binary.BigEndian.PutUint32(length[6+1+4:], 0xfffffff0)
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	if _, err := VerifySnapshot(bytes.NewReader(length)); err != io.ErrUnexpectedEOF {
+		t.Errorf("expected unexpected EOF, got %v", err)
+	}
+	runtime.ReadMemStats(&after)
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 1024*1024 {
+		t.Errorf("allocated %d bytes for a corrupt length", allocated)
+	}
+
+	version := append([]byte{}, data...)
+	version[5] = SnapshotVersion + 1
+	if _, err := VerifySnapshot(bytes.NewReader(version)); err != ErrSnapshotVersion {
+		t.Errorf("expected version error, got %v", err)
+	}
+}
+
+func TestServerLoadsSnapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mulu")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "mulu.snapshot")
+	logger := log.New(ioutil.Discard, "", 0)
+
+	// A missing snapshot starts an empty server
+	server, err := NewServerWithOptions(Options{CacheSize: 1024 * 1024, SnapshotPath: path, Logger: logger})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.Cache().Set([]byte("key"), []byte("value"), 0)
+	if err := server.SaveSnapshot(path); err != nil {
+		t.Fatal(err)
+	}
+
+	server, err = NewServerWithOptions(Options{CacheSize: 1024 * 1024, SnapshotPath: path, Logger: logger})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value, err := server.Cache().Get([]byte("key")); err != nil || string(value) != "value" {
+		t.Fatalf("expected restored value, got %q (%v)", value, err)
+	}
+
+	ioutil.WriteFile(path, []byte("garbage"), 0644)
+	if _, err := NewServerWithOptions(Options{CacheSize: 1024 * 1024, SnapshotPath: path, Logger: logger}); err == nil {
+		t.Fatal("expected error for corrupt snapshot")
+	}
+}
+
+func TestSnapshotCommands(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mulu")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "mulu.snapshot")
+
+	cache := NewFreecacheStore(1024 * 1024)
+	cache.Set([]byte("key"), []byte("value"), 0)
+	logger := log.New(ioutil.Discard, "", 0)
+	var buf bytes.Buffer
+	parser := NewParser(cache, &buf, logger)
+
+	if parser.Parse([]byte("SAVE")) || !bytes.Equal(buf.Bytes(), ErrSnapshotDisabled) {
+		t.Fatalf("expected %q, got %q", ErrSnapshotDisabled, buf.String())
+	}
+
+	parser.snapshots = newSnapshotter(cache, path, logger)
+	buf.Reset()
+	if !parser.Parse([]byte("LASTSAVE")) || buf.String() != "+LASTSAVE 0 0 0 ok\r\n" {
+		t.Fatalf("unexpected LASTSAVE response %q", buf.String())
+	}
+
+	buf.Reset()
+	if !parser.Parse([]byte("save")) || !bytes.Equal(buf.Bytes(), OKResponse) {
+		t.Fatalf("expected %q, got %q", OKResponse, buf.String())
+	}
+	if n, err := verifyFile(t, path); err != nil || n != 1 {
+		t.Fatalf("expected a snapshot with 1 entry, got %d (%v)", n, err)
+	}
+
+	buf.Reset()
+	parser.Parse([]byte("LASTSAVE"))
+	var unix, duration, entries int64
+	var state string
+	if _, err := fmt.Sscanf(buf.String(), "+LASTSAVE %d %d %d %s\r\n", &unix, &duration, &entries, &state); err != nil {
+		t.Fatalf("unexpected LASTSAVE response %q: %v", buf.String(), err)
+	}
+	if time.Since(time.Unix(unix, 0)) > time.Minute || entries != 1 || state != "ok" {
+		t.Fatalf("unexpected LASTSAVE response %q", buf.String())
+	}
+
+	cache.Set([]byte("other"), []byte("value"), 0)
+	buf.Reset()
+	if !parser.Parse([]byte("BGSAVE")) || !bytes.Equal(buf.Bytes(), OKResponse) {
+		t.Fatalf("expected %q, got %q", OKResponse, buf.String())
+	}
+	eventually(t, "BGSAVE did not complete", func() bool {
+		return !parser.snapshots.Status().InProgress
+	})
+	if status := parser.snapshots.Status(); status.Entries != 2 || status.Err != nil {
+		t.Fatalf("unexpected status after BGSAVE: %+v", status)
+	}
+
+	// BGSAVE is rejected while a SAVE is pending, which stays reported as
+	// such until it completes
+	parser.snapshots.saving.Lock()
+	saved := make(chan error)
+	go func() { saved <- parser.snapshots.Save() }()
+	eventually(t, "SAVE not pending", func() bool {
+		return parser.snapshots.Status().InProgress
+	})
+	for line, expected := range map[string]string{"BGSAVE": string(ErrSnapshotInProgress), "LASTSAVE": " pending\r\n"} {
+		buf.Reset()
+		parser.Parse([]byte(line))
+		if !strings.HasSuffix(buf.String(), expected) {
+			t.Errorf("%s: expected %q, got %q", line, expected, buf.String())
+		}
+	}
+	parser.snapshots.saving.Unlock()
+	if err := <-saved; err != nil {
+		t.Fatal(err)
+	}
+	if parser.snapshots.Status().InProgress {
+		t.Fatal("SAVE still in progress once complete")
+	}
+
+	// Only the snapshot itself is left behind
+	if files, _ := ioutil.ReadDir(dir); len(files) != 1 {
+		t.Fatalf("expected only the snapshot file, got %d files", len(files))
+	}
+
+	for line, expected := range map[string][]byte{"SAVE now": ErrInvalidArgs, "FOO": ErrUnknownCmd, "SETX key": ErrUnknownCmd} {
+		buf.Reset()
+		if parser.Parse([]byte(line)) || !bytes.Equal(buf.Bytes(), expected) {
+			t.Errorf("%q: expected %q, got %q", line, expected, buf.String())
+		}
+	}
+}
+
+func TestServerWritesSnapshots(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mulu")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "mulu.snapshot")
+	logger := log.New(ioutil.Discard, "", 0)
+
+	if _, err := NewServerWithOptions(Options{SnapshotInterval: time.Second}); err == nil {
+		t.Fatal("expected error for an interval without a path")
+	}
+
+	server, err := NewServerWithOptions(Options{CacheSize: 1024 * 1024, SnapshotPath: path, SnapshotInterval: 10 * time.Millisecond, Logger: logger})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.Cache().Set([]byte("key"), []byte("value"), 0)
+	for deadline := time.Now().Add(5 * time.Second); server.SnapshotStatus().Entries != 1; {
+		if time.Now().After(deadline) {
+			t.Fatalf("no periodic snapshot written: %+v", server.SnapshotStatus())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// Stop writes a final snapshot
+	server.Cache().Set([]byte("other"), []byte("value"), 0)
+	if err := server.Start("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := server.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := verifyFile(t, path); err != nil || n != 2 {
+		t.Fatalf("expected a snapshot with 2 entries, got %d (%v)", n, err)
+	}
+}
+
+func verifyFile(t *testing.T, path string) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	return VerifySnapshot(f)
+}
@@ -0,0 +1,215 @@
+package server
+
+import (
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// parseErrors names the parse errors counted by STATS, after their constants.
+var parseErrors = []struct {
+	err  []byte
+	name string
+}{
+	{ErrMaxSize, "max_size"},
+	{ErrUnknownCmd, "unknown_cmd"},
+	{ErrIncompleteCmd, "incomplete_cmd"},
+	{ErrEmptyRequest, "empty_request"},
+	{ErrInvalidArgs, "invalid_args"},
+	{ErrInvalidExpiration, "invalid_expiration"},
+	{ErrInvalidLength, "invalid_length"},
+	{ErrInvalidValueDelimiter, "invalid_value_delimiter"},
+	{ErrInvalidToken, "invalid_token"},
+	{ErrInvalidIncrement, "invalid_increment"},
+}
+
+// latencyBuckets are the upper bounds of the command latency histograms.
+var latencyBuckets = [...]time.Duration{
+	time.Microsecond, 5 * time.Microsecond, 10 * time.Microsecond, 50 * time.Microsecond,
+	100 * time.Microsecond, 500 * time.Microsecond, time.Millisecond, 5 * time.Millisecond,
+	10 * time.Millisecond, 50 * time.Millisecond, 100 * time.Millisecond,
+}
+
+// ServerStats are the counters of a server, in addition to those of its store.
+type ServerStats struct {
+	// open connections and connections accepted since the server started
+	Connections      int64 `json:"connections"`
+	TotalConnections int64 `json:"total_connections"`
+
+	// bytes read from and written to the connections
+	BytesIn  int64 `json:"bytes_in"`
+	BytesOut int64 `json:"bytes_out"`
+
+	// requests over every protocol by upper-case command name, and parse
+	// errors of the mulu protocol by the name of their constant, such as
+	// incomplete_cmd for ErrIncompleteCmd
+	Commands    map[string]int64 `json:"commands"`
+	ParseErrors map[string]int64 `json:"parse_errors"`
+}
+
+// serverStats holds the counters of a server, which are updated atomically by
+// the connections. The maps are never modified once created, so they are read
+// without locking.
+type serverStats struct {
+	connections      int64
+	totalConnections int64
+	bytesIn          int64
+	bytesOut         int64
+
+	commands   map[string]*commandStats
+	errors     map[string]*int64
+	errorNames map[string]string
+}
+
+// commandStats counts the requests of a command and their latency. Buckets
+// are not cumulative, and are incremented after count so that they never add
+// up to more than count when they are loaded first.
+type commandStats struct {
+	count    int64
+	duration int64
+	buckets  [len(latencyBuckets)]int64
+}
+
+func (c *commandStats) observe(d time.Duration) {
+	atomic.AddInt64(&c.count, 1)
+	atomic.AddInt64(&c.duration, int64(d))
+	for i, bound := range latencyBuckets {
+		if d <= bound {
+			atomic.AddInt64(&c.buckets[i], 1)
+			break
+		}
+	}
+}
+
+func newServerStats() *serverStats {
+	s := &serverStats{
+		commands:   make(map[string]*commandStats),
+		errors:     make(map[string]*int64),
+		errorNames: make(map[string]string),
+	}
+	for name := range commands {
+		s.commands[name] = new(commandStats)
+	}
+	// commands parsed before the table, and those of the RESP and memcached
+	// protocols which the mulu protocol does not have
+	for _, name := range []string{"GET", "SET", "DEL", "PING", "DELETE", "VERSION"} {
+		s.commands[name] = new(commandStats)
+	}
+	for _, e := range parseErrors {
+		s.errors[string(e.err)] = new(int64)
+		s.errorNames[string(e.err)] = e.name
+	}
+	return s
+}
+
+// command counts a request which took d to handle. Requests which failed to
+// parse have no name.
+func (s *serverStats) command(name string, d time.Duration) {
+	if c := s.commands[name]; c != nil {
+		c.observe(d)
+	}
+}
+
+// commandFold counts a request of the RESP or memcached protocols, whose
+// command names are case-insensitive.
+func (s *serverStats) commandFold(name []byte, d time.Duration) {
+	var upper [16]byte
+	if len(name) > len(upper) {
+		return
+	}
+	for i, c := range name {
+		if 'a' <= c && c <= 'z' {
+			c -= 'a' - 'A'
+		}
+		upper[i] = c
+	}
+	if c := s.commands[string(upper[:len(name)])]; c != nil {
+		c.observe(d)
+	}
+}
+
+// parseError counts an error response if it is a parse error.
+func (s *serverStats) parseError(err []byte) {
+	if s != nil {
+		if n := s.errors[string(err)]; n != nil {
+			atomic.AddInt64(n, 1)
+		}
+	}
+}
+
+func (s *serverStats) read(n int) {
+	if s != nil {
+		atomic.AddInt64(&s.bytesIn, int64(n))
+	}
+}
+
+func (s *serverStats) written(n int) {
+	if s != nil {
+		atomic.AddInt64(&s.bytesOut, int64(n))
+	}
+}
+
+func (s *serverStats) snapshot() ServerStats {
+	stats := ServerStats{
+		Connections:      atomic.LoadInt64(&s.connections),
+		TotalConnections: atomic.LoadInt64(&s.totalConnections),
+		BytesIn:          atomic.LoadInt64(&s.bytesIn),
+		BytesOut:         atomic.LoadInt64(&s.bytesOut),
+		Commands:         make(map[string]int64, len(s.commands)),
+		ParseErrors:      make(map[string]int64, len(s.errors)),
+	}
+	for name, c := range s.commands {
+		stats.Commands[name] = atomic.LoadInt64(&c.count)
+	}
+	for err, n := range s.errors {
+		stats.ParseErrors[s.errorNames[err]] = atomic.LoadInt64(n)
+	}
+	return stats
+}
+
+// Stats returns the counters of the server. Those of the cache are returned by
+// Cache().Stats().
+func (s *Server) Stats() ServerStats {
+	return s.stats.snapshot()
+}
+
+// STATS reports the counters of the cache and the server as +STAT <name>
+// <value> lines followed by +END. Commands and parse errors are listed in
+// alphabetical order, as cmd_<command> and parse_error_<error>.
+func (p *Parser) stats(args [][]byte) bool {
+	if len(args) != 0 {
+		return p.fail(ErrInvalidArgs, nil)
+	}
+
+	cache := p.cache.Stats()
+	p.scratch = p.scratch[:0]
+	p.appendStat("uptime", strconv.FormatInt(int64(time.Since(startTime).Seconds()), 10))
+	p.appendStat("entry_count", strconv.FormatInt(cache.Entries, 10))
+	p.appendStat("hit_count", strconv.FormatInt(cache.Hits, 10))
+	p.appendStat("miss_count", strconv.FormatInt(cache.Misses, 10))
+	p.appendStat("hit_rate", strconv.FormatFloat(cache.HitRate(), 'f', 4, 64))
+	p.appendStat("evacuate_count", strconv.FormatInt(cache.Evictions, 10))
+	p.appendStat("expired_count", strconv.FormatInt(cache.Expired, 10))
+	p.appendStat("overwrite_count", strconv.FormatInt(cache.Overwrites, 10))
+
+	if p.counters != nil {
+		stats := p.counters.snapshot()
+		p.appendStat("connections", strconv.FormatInt(stats.Connections, 10))
+		p.appendStat("total_connections", strconv.FormatInt(stats.TotalConnections, 10))
+		p.appendStat("bytes_in", strconv.FormatInt(stats.BytesIn, 10))
+		p.appendStat("bytes_out", strconv.FormatInt(stats.BytesOut, 10))
+		p.appendCounters("cmd_", stats.Commands)
+		p.appendCounters("parse_error_", stats.ParseErrors)
+	}
+	p.scratch = append(p.scratch, EndResponse...)
+	_, err := p.writer.Write(p.scratch)
+	return err == nil
+}
+
+// appendCounters appends a +STAT line for each counter, sorted by name.
+func (p *Parser) appendCounters(prefix string, counters map[string]int64) {
+	for _, name := range sortedNames(counters) {
+		p.appendStat(prefix+strings.ToLower(name), strconv.FormatInt(counters[name], 10))
+	}
+}
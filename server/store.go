@@ -0,0 +1,301 @@
+package server
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/coocood/freecache"
+)
+
+// Store is the storage engine of a Server. Implementations must be safe for
+// concurrent use, and report missing keys and oversized keys or entries with
+// freecache.ErrNotFound, freecache.ErrLargeKey and freecache.ErrLargeEntry.
+//
+// Expirations passed to a store are relative, in seconds, with 0 or less
+// meaning the entry never expires. Expirations returned by a store are
+// absolute unix seconds, with 0 meaning the entry never expires.
+type Store interface {
+	Get(key []byte) (value []byte, err error)
+	Set(key, value []byte, expireSeconds int) error
+	Del(key []byte) (affected bool)
+
+	// TTL returns the number of seconds left before key expires, 0 if it
+	// never expires.
+	TTL(key []byte) (timeLeft uint32, err error)
+
+	// Touch changes the expiration of key, keeping its value.
+	Touch(key []byte, expireSeconds int) error
+
+	// Update atomically replaces the entry of key with the one returned by
+	// fn, which is given the current value and expiration if the entry was
+	// found. Returning false from fn leaves the entry untouched. fn may be
+	// called several times if the entry is modified concurrently, must not
+	// use the store and must not modify value.
+	Update(key []byte, fn UpdateFunc) (found, updated bool, err error)
+
+	// GetWithVersion returns the value of key and its version, which is
+	// unique to each Set, Update and CompareAndSwap of the entry, even if it
+	// writes the same value.
+	GetWithVersion(key []byte) (value []byte, version uint64, err error)
+
+	// CompareAndSwap replaces the value of key only if its version is still
+	// the given one.
+	CompareAndSwap(key []byte, version uint64, value []byte, expireSeconds int) (found, swapped bool, err error)
+
+	// MaxEntrySize returns the largest combined size of a key and its value
+	// which the store accepts.
+	MaxEntrySize() int
+
+	// Iterate calls fn with the live entries until it returns false. Entries
+	// written during the iteration may or may not be visited, the others are
+	// visited at least once.
+	Iterate(fn func(key, value []byte, expireAt uint32) bool)
+
+	Stats() StoreStats
+
+	// Clear removes all entries.
+	Clear()
+}
+
+// UpdateFunc computes the new entry of a key for Store.Update.
+type UpdateFunc func(value []byte, expireAt uint32, found bool) (newValue []byte, expireSeconds int, ok bool)
+
+// StoreStats are the counters of a store.
+type StoreStats struct {
+	Entries    int64 `json:"entries"`
+	Hits       int64 `json:"hits"`
+	Misses     int64 `json:"misses"`
+	Evictions  int64 `json:"evictions"`
+	Expired    int64 `json:"expired"`
+	Overwrites int64 `json:"overwrites"`
+}
+
+// HitRate returns the ratio of lookups which found their key.
+func (s StoreStats) HitRate() float64 {
+	if s.Hits+s.Misses == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(s.Hits+s.Misses)
+}
+
+// remaining converts an absolute expiration into the relative one expected by
+// Store.Set. ok is false if the entry has already expired.
+func remaining(expireAt uint32) (expireSeconds int, ok bool) {
+	if expireAt == 0 {
+		return 0, true
+	}
+	expireSeconds = int(int64(expireAt) - time.Now().Unix())
+	return expireSeconds, expireSeconds > 0
+}
+
+// unixTime returns the current time in the resolution of expirations.
+func unixTime() uint32 {
+	return uint32(time.Now().Unix())
+}
+
+// absoluteExpiration converts a relative expiration into a unix time, 0 if the
+// entry never expires.
+func absoluteExpiration(expireSeconds int) uint32 {
+	if expireSeconds <= 0 {
+		return 0
+	}
+	return unixTime() + uint32(expireSeconds)
+}
+
+// versionCounter assigns increasing versions to the writes of a store. It
+// starts from the clock, so versions are not reused after a restart.
+type versionCounter struct {
+	last uint64
+}
+
+func newVersionCounter() versionCounter {
+	return versionCounter{uint64(time.Now().UnixNano())}
+}
+
+func (v *versionCounter) next() uint64 {
+	return atomic.AddUint64(&v.last, 1)
+}
+
+// Engine selects the Store created by NewServerWithOptions.
+type Engine int
+
+const (
+	// EngineFreecache evicts entries in near-LRU order, segment by segment.
+	EngineFreecache Engine = iota
+
+	// EngineTinyLFU uses a TinyLFUStore, which keeps the entries used most
+	// often when the cache is scanned.
+	EngineTinyLFU
+)
+
+func (e Engine) String() string {
+	switch e {
+	case EngineFreecache:
+		return "freecache"
+	case EngineTinyLFU:
+		return "tinylfu"
+	}
+	return "unknown"
+}
+
+// ParseEngine parses "freecache" or "tinylfu".
+func ParseEngine(s string) (Engine, error) {
+	for _, engine := range []Engine{EngineFreecache, EngineTinyLFU} {
+		if s == engine.String() {
+			return engine, nil
+		}
+	}
+	return 0, fmt.Errorf("server: Unknown storage engine %q", s)
+}
+
+// FreecacheStore is the default Store, backed by a freecache.Cache. Values
+// are stored after the 8 byte big-endian version of the entry.
+type FreecacheStore struct {
+	cache    *freecache.Cache
+	maxEntry int
+	versions versionCounter
+}
+
+const (
+	// Smallest cache allocated by freecache
+	FreecacheMinSize = 512 * 1024
+
+	// Size of the version stored in front of the values
+	freecacheVersionSize = 8
+)
+
+// NewFreecacheStore creates a store backed by a freecache.Cache of size
+// bytes, or FreecacheMinSize if smaller.
+func NewFreecacheStore(size int) *FreecacheStore {
+	if size < FreecacheMinSize {
+		size = FreecacheMinSize
+	}
+
+	// freecache splits the cache in 256 segments, and rejects the entries
+	// larger than a quarter of a segment
+	return &FreecacheStore{
+		cache:    freecache.NewCache(size),
+		maxEntry: size/256/4 - freecache.ENTRY_HDR_SIZE - freecacheVersionSize,
+		versions: newVersionCounter(),
+	}
+}
+
+func (f *FreecacheStore) MaxEntrySize() int {
+	return f.maxEntry
+}
+
+// entry prefixes the value with a new version.
+func (f *FreecacheStore) entry(value []byte) []byte {
+	entry := make([]byte, freecacheVersionSize+len(value))
+	binary.BigEndian.PutUint64(entry, f.versions.next())
+	copy(entry[freecacheVersionSize:], value)
+	return entry
+}
+
+func (f *FreecacheStore) Get(key []byte) ([]byte, error) {
+	value, _, err := f.GetWithVersion(key)
+	return value, err
+}
+
+func (f *FreecacheStore) GetWithVersion(key []byte) ([]byte, uint64, error) {
+	entry, err := f.cache.Get(key)
+	if err != nil {
+		return nil, 0, err
+	}
+	return entry[freecacheVersionSize:], binary.BigEndian.Uint64(entry), nil
+}
+
+func (f *FreecacheStore) Set(key, value []byte, expireSeconds int) error {
+	return f.cache.Set(key, f.entry(value), expireSeconds)
+}
+
+func (f *FreecacheStore) Del(key []byte) bool {
+	return f.cache.Del(key)
+}
+
+func (f *FreecacheStore) TTL(key []byte) (uint32, error) {
+	return f.cache.TTL(key)
+}
+
+func (f *FreecacheStore) Touch(key []byte, expireSeconds int) error {
+	return f.cache.Touch(key, expireSeconds)
+}
+
+// Update reads the entry and replaces it only if it still has the version
+// which was read, since freecache does not pass the expiration of the current
+// entry to its updater.
+func (f *FreecacheStore) Update(key []byte, fn UpdateFunc) (found, updated bool, err error) {
+	for {
+		entry, expireAt, err := f.cache.GetWithExpiration(key)
+		if err == freecache.ErrNotFound {
+			// insert unless another write gets there first
+			found, updated, err = f.cache.Update(key, func(current []byte, found bool) ([]byte, bool, int) {
+				if found {
+					return nil, false, 0
+				}
+				newValue, expiration, ok := fn(nil, 0, false)
+				if !ok {
+					return nil, false, 0
+				}
+				return f.entry(newValue), true, expiration
+			})
+			if err != nil || !found {
+				return false, updated, err
+			}
+			continue
+		} else if err != nil {
+			return false, false, err
+		}
+
+		newValue, expiration, ok := fn(entry[freecacheVersionSize:], expireAt, true)
+		if !ok {
+			return true, false, nil
+		}
+
+		// only replace the entry we read; anything else is a lost race
+		found, updated, err = f.CompareAndSwap(key, binary.BigEndian.Uint64(entry), newValue, expiration)
+		if err != nil || updated {
+			return true, updated, err
+		}
+	}
+}
+
+func (f *FreecacheStore) CompareAndSwap(key []byte, version uint64, value []byte, expireSeconds int) (found, swapped bool, err error) {
+	entry := f.entry(value)
+	return f.cache.Update(key, func(current []byte, found bool) ([]byte, bool, int) {
+		return entry, found && binary.BigEndian.Uint64(current) == version, expireSeconds
+	})
+}
+
+// Iterate walks the slots of freecache, which are locked one step at a time.
+// An entry removed from a slot while it is walked shifts the following ones,
+// so one of them may be missed.
+func (f *FreecacheStore) Iterate(fn func(key, value []byte, expireAt uint32) bool) {
+	now := uint32(time.Now().Unix())
+	it := f.cache.NewIterator()
+	for entry := it.Next(); entry != nil; entry = it.Next() {
+		if entry.ExpireAt != 0 && entry.ExpireAt <= now {
+			continue
+		}
+		if !fn(entry.Key, entry.Value[freecacheVersionSize:], entry.ExpireAt) {
+			return
+		}
+	}
+}
+
+func (f *FreecacheStore) Stats() StoreStats {
+	return StoreStats{
+		Entries:    f.cache.EntryCount(),
+		Hits:       f.cache.HitCount(),
+		Misses:     f.cache.MissCount(),
+		Evictions:  f.cache.EvacuateCount(),
+		Expired:    f.cache.ExpiredCount(),
+		Overwrites: f.cache.OverwriteCount(),
+	}
+}
+
+func (f *FreecacheStore) Clear() {
+	f.cache.Clear()
+}
@@ -0,0 +1,143 @@
+package server
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/coocood/freecache"
+)
+
+// testStore checks the behaviour every Store must share.
+func testStore(t *testing.T, store Store) {
+	if _, err := store.Get([]byte("missing")); err != freecache.ErrNotFound {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+	if err := store.Set([]byte("key"), []byte("value"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Set([]byte("ttl"), []byte("value"), 100); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := store.Get([]byte("key")); err != nil || string(value) != "value" {
+		t.Fatalf("unexpected value %q (%v)", value, err)
+	}
+	if ttl, err := store.TTL([]byte("ttl")); err != nil || ttl < 99 || ttl > 100 {
+		t.Fatalf("unexpected TTL %d (%v)", ttl, err)
+	}
+	if err := store.Touch([]byte("key"), 50); err != nil {
+		t.Fatal(err)
+	}
+	if ttl, _ := store.TTL([]byte("key")); ttl < 49 || ttl > 50 {
+		t.Fatalf("expected the touched TTL, got %d", ttl)
+	}
+	if err := store.Touch([]byte("missing"), 50); err != freecache.ErrNotFound {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+
+	// Entries up to MaxEntrySize are accepted
+	large := make([]byte, store.MaxEntrySize()-len("large"))
+	if err := store.Set([]byte("large"), large, 0); err != nil {
+		t.Fatalf("expected %d bytes to be accepted, got %v", len(large), err)
+	}
+	if err := store.Set([]byte("large"), append(large, 0), 0); err != freecache.ErrLargeEntry {
+		t.Fatalf("expected ErrLargeEntry, got %v", err)
+	}
+	store.Del([]byte("large"))
+
+	// Updates see the expiration of the entry and may insert missing ones
+	found, updated, err := store.Update([]byte("ttl"), func(value []byte, expireAt uint32, found bool) ([]byte, int, bool) {
+		expiration, ok := remaining(expireAt)
+		return append(value, '!'), expiration, found && ok
+	})
+	if err != nil || !found || !updated {
+		t.Fatalf("expected an update, got %v %v (%v)", found, updated, err)
+	}
+	if value, _ := store.Get([]byte("ttl")); string(value) != "value!" {
+		t.Fatalf("unexpected updated value %q", value)
+	}
+	if ttl, _ := store.TTL([]byte("ttl")); ttl < 98 || ttl > 100 {
+		t.Fatalf("expected the TTL to be kept, got %d", ttl)
+	}
+	found, updated, _ = store.Update([]byte("new"), func(value []byte, expireAt uint32, found bool) ([]byte, int, bool) {
+		return []byte("inserted"), 0, !found
+	})
+	if found || !updated {
+		t.Fatalf("expected an insert, got %v %v", found, updated)
+	}
+	found, updated, _ = store.Update([]byte("new"), func(value []byte, expireAt uint32, found bool) ([]byte, int, bool) {
+		return nil, 0, false
+	})
+	if !found || updated {
+		t.Fatalf("expected the entry to be left untouched, got %v %v", found, updated)
+	}
+
+	// Every write changes the version, even if the value is the same
+	_, v1, err := store.GetWithVersion([]byte("new"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Set([]byte("new"), []byte("inserted"), 0)
+	value, v2, _ := store.GetWithVersion([]byte("new"))
+	if v2 == v1 || string(value) != "inserted" {
+		t.Fatalf("expected a new version of %q, got %d", value, v2)
+	}
+	if found, swapped, err := store.CompareAndSwap([]byte("new"), v1, []byte("stale"), 0); !found || swapped || err != nil {
+		t.Fatalf("expected a stale version to be rejected, got %v %v (%v)", found, swapped, err)
+	}
+	if found, swapped, err := store.CompareAndSwap([]byte("new"), v2, []byte("inserted"), 0); !found || !swapped || err != nil {
+		t.Fatalf("expected a swap, got %v %v (%v)", found, swapped, err)
+	}
+	if _, v3, _ := store.GetWithVersion([]byte("new")); v3 == v2 || v3 == v1 {
+		t.Fatalf("expected a new version, got %d", v3)
+	}
+	if found, swapped, _ := store.CompareAndSwap([]byte("missing"), v2, []byte("value"), 0); found || swapped {
+		t.Fatal("swapped a missing key")
+	}
+
+	seen := make(map[string]string)
+	store.Iterate(func(key, value []byte, expireAt uint32) bool {
+		seen[string(key)] = string(value)
+		return true
+	})
+	if len(seen) != 3 || seen["key"] != "value" || seen["ttl"] != "value!" || seen["new"] != "inserted" {
+		t.Fatalf("unexpected entries %v", seen)
+	}
+
+	if !store.Del([]byte("key")) || store.Del([]byte("key")) {
+		t.Fatal("expected a single delete to succeed")
+	}
+	if stats := store.Stats(); stats.Entries != 2 || stats.Hits == 0 || stats.Misses == 0 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+	store.Clear()
+	if stats := store.Stats(); stats.Entries != 0 {
+		t.Fatalf("expected no entries after Clear, got %d", stats.Entries)
+	}
+}
+
+// testStoreUpdates checks that concurrent updates are not lost.
+func testStoreUpdates(t *testing.T, store Store) {
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				store.Update([]byte("counter"), func(value []byte, expireAt uint32, found bool) ([]byte, int, bool) {
+					n, _ := strconv.Atoi(string(value))
+					return strconv.AppendInt(nil, int64(n+1), 10), 0, true
+				})
+			}
+		}()
+	}
+	wg.Wait()
+	if value, _ := store.Get([]byte("counter")); string(value) != "800" {
+		t.Fatalf("expected 800 updates, got %s", value)
+	}
+}
+
+func TestFreecacheStore(t *testing.T) {
+	testStore(t, NewFreecacheStore(1024*1024))
+	testStoreUpdates(t, NewFreecacheStore(1024*1024))
+}
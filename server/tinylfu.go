@@ -0,0 +1,571 @@
+package server
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/coocood/freecache"
+)
+
+// Limits of the TinyLFU store, matching those of freecache
+const (
+	TinyLFUMinSize    = 512 * 1024
+	TinyLFUMaxKeySize = 65535
+)
+
+const (
+	// the store is split into 1<<tinyLFUShardBits independently locked shards
+	tinyLFUShardBits = 4
+	tinyLFUShards    = 1 << tinyLFUShardBits
+
+	// approximate memory used by an entry besides its key and value
+	tinyLFUEntryOverhead = 64
+
+	// bytes of a shard per sketch counter
+	tinyLFUBytesPerCounter = 32
+)
+
+// TinyLFUStore is a Store implementing Window-TinyLFU. New entries enter a
+// small LRU window. Entries leaving the window are only admitted into the main
+// segmented LRU if a count-min sketch estimates that they are used more often
+// than the entry they would evict, so a scan cannot flush the working set.
+type TinyLFUStore struct {
+	hits, misses, evictions, expired, overwrites int64
+
+	versions versionCounter
+	maxEntry int
+	shards   [tinyLFUShards]tinyLFUShard
+}
+
+// NewTinyLFUStore creates a store holding up to size bytes. Like freecache,
+// it rejects entries larger than 1/1024 of its size.
+func NewTinyLFUStore(size int) *TinyLFUStore {
+	if size < TinyLFUMinSize {
+		size = TinyLFUMinSize
+	}
+	s := &TinyLFUStore{versions: newVersionCounter(), maxEntry: size / 1024}
+	for i := range s.shards {
+		s.shards[i].init(size/tinyLFUShards, s.maxEntry)
+	}
+	return s
+}
+
+func (s *TinyLFUStore) MaxEntrySize() int {
+	return s.maxEntry - tinyLFUEntryOverhead
+}
+
+// tinyLFUShard holds the entries of a store whose hashes share the top bits.
+// The window holds about 1% of the shard, or at least one entry. The main
+// space is split between probation, where admitted entries start, and
+// protected, which holds 80% of it and receives the entries used again.
+type tinyLFUShard struct {
+	mu      sync.Mutex
+	entries map[string]*tinyLFUEntry
+	sketch  *countMinSketch
+
+	window, probation, protected tinyLFUList
+
+	capacity, windowCapacity, protectedCapacity int
+}
+
+type tinyLFUEntry struct {
+	key      string
+	value    []byte
+	expireAt uint32
+	hash     uint64
+	version  uint64
+
+	list       *tinyLFUList
+	prev, next *tinyLFUEntry
+}
+
+func (e *tinyLFUEntry) size() int {
+	return len(e.key) + len(e.value) + tinyLFUEntryOverhead
+}
+
+func (s *tinyLFUShard) init(capacity, maxEntry int) {
+	s.capacity = capacity
+	s.windowCapacity = capacity / 100
+	if s.windowCapacity < maxEntry {
+		s.windowCapacity = maxEntry
+	}
+	s.protectedCapacity = (capacity - s.windowCapacity) * 80 / 100
+	s.sketch = newCountMinSketch(capacity / tinyLFUBytesPerCounter)
+	s.reset()
+}
+
+func (s *tinyLFUShard) reset() {
+	s.entries = make(map[string]*tinyLFUEntry)
+	s.window.init()
+	s.probation.init()
+	s.protected.init()
+	s.sketch.clear()
+}
+
+func (s *tinyLFUShard) size() int {
+	return s.window.size + s.probation.size + s.protected.size
+}
+
+// access moves the entry to the front of its queue, promoting it to
+// protected if it was on probation.
+func (s *tinyLFUShard) access(e *tinyLFUEntry) {
+	if e.list != &s.probation {
+		e.list.moveToFront(e)
+		return
+	}
+	s.probation.remove(e)
+	s.protected.pushFront(e)
+	s.demote()
+}
+
+// demote moves the least recently used protected entries to probation until
+// protected fits its capacity.
+func (s *tinyLFUShard) demote() {
+	for s.protected.size > s.protectedCapacity {
+		e := s.protected.back()
+		s.protected.remove(e)
+		s.probation.pushFront(e)
+	}
+}
+
+// victim returns the entry to evict next from the main space, or the window
+// if the main space is empty.
+func (s *tinyLFUShard) victim() *tinyLFUEntry {
+	if e := s.probation.back(); e != nil {
+		return e
+	}
+	if e := s.protected.back(); e != nil {
+		return e
+	}
+	return s.window.back()
+}
+
+func (s *tinyLFUShard) remove(e *tinyLFUEntry) {
+	if e.list != nil {
+		e.list.remove(e)
+	}
+	delete(s.entries, e.key)
+}
+
+func (s *TinyLFUStore) shard(key []byte) (*tinyLFUShard, uint64) {
+	hash := hashKey(key)
+	return &s.shards[hash>>(64-tinyLFUShardBits)], hash
+}
+
+// lookup returns the live entry of key, removing it if it expired.
+func (s *TinyLFUStore) lookup(shard *tinyLFUShard, key []byte, now uint32) *tinyLFUEntry {
+	e, ok := shard.entries[string(key)]
+	if !ok {
+		return nil
+	}
+	if e.expireAt != 0 && e.expireAt <= now {
+		shard.remove(e)
+		atomic.AddInt64(&s.expired, 1)
+		return nil
+	}
+	return e
+}
+
+// set stores the entry, which owns value, and evicts what no longer fits.
+func (s *TinyLFUStore) set(shard *tinyLFUShard, key []byte, hash uint64, value []byte, expireAt uint32) {
+	shard.sketch.increment(hash)
+	if e, ok := shard.entries[string(key)]; ok {
+		// requeue the entry since its size changes
+		list := e.list
+		list.remove(e)
+		e.value, e.expireAt, e.version = value, expireAt, s.versions.next()
+		list.pushFront(e)
+		atomic.AddInt64(&s.overwrites, 1)
+	} else {
+		e = &tinyLFUEntry{key: string(key), value: value, expireAt: expireAt, hash: hash, version: s.versions.next()}
+		shard.entries[e.key] = e
+		shard.window.pushFront(e)
+	}
+	s.evict(shard)
+}
+
+// evict moves the entries overflowing the window into the main space, where
+// each competes with the entry it would evict, then evicts until the shard
+// fits its capacity.
+func (s *TinyLFUStore) evict(shard *tinyLFUShard) {
+	shard.demote()
+	for shard.window.size > shard.windowCapacity {
+		candidate := shard.window.back()
+		shard.window.remove(candidate)
+		for candidate != nil && shard.size()+candidate.size() > shard.capacity {
+			victim := shard.victim()
+			if victim == nil {
+				break
+			}
+			// ties favour the entry which has been around longer
+			if shard.sketch.estimate(candidate.hash) <= shard.sketch.estimate(victim.hash) {
+				victim = candidate
+				candidate = nil
+			}
+			shard.remove(victim)
+			atomic.AddInt64(&s.evictions, 1)
+		}
+		if candidate != nil {
+			shard.probation.pushFront(candidate)
+		}
+	}
+
+	// entries replaced by larger values may have grown the main space
+	for shard.size() > shard.capacity {
+		shard.remove(shard.victim())
+		atomic.AddInt64(&s.evictions, 1)
+	}
+}
+
+func (s *TinyLFUStore) Get(key []byte) ([]byte, error) {
+	value, _, err := s.GetWithVersion(key)
+	return value, err
+}
+
+func (s *TinyLFUStore) GetWithVersion(key []byte) ([]byte, uint64, error) {
+	shard, hash := s.shard(key)
+	shard.mu.Lock()
+	shard.sketch.increment(hash)
+	e := s.lookup(shard, key, unixTime())
+	if e == nil {
+		shard.mu.Unlock()
+		atomic.AddInt64(&s.misses, 1)
+		return nil, 0, freecache.ErrNotFound
+	}
+	shard.access(e)
+	value, version := e.value, e.version
+	shard.mu.Unlock()
+
+	// values are never modified once stored
+	atomic.AddInt64(&s.hits, 1)
+	return clone(value), version, nil
+}
+
+func (s *TinyLFUStore) Set(key, value []byte, expireSeconds int) error {
+	if err := s.check(key, value); err != nil {
+		return err
+	}
+	value = clone(value)
+	shard, hash := s.shard(key)
+	shard.mu.Lock()
+	s.set(shard, key, hash, value, absoluteExpiration(expireSeconds))
+	shard.mu.Unlock()
+	return nil
+}
+
+func (s *TinyLFUStore) check(key, value []byte) error {
+	if len(key) > TinyLFUMaxKeySize {
+		return freecache.ErrLargeKey
+	}
+	if len(key)+len(value)+tinyLFUEntryOverhead > s.maxEntry {
+		return freecache.ErrLargeEntry
+	}
+	return nil
+}
+
+func (s *TinyLFUStore) Del(key []byte) bool {
+	shard, _ := s.shard(key)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	e := s.lookup(shard, key, unixTime())
+	if e == nil {
+		return false
+	}
+	shard.remove(e)
+	return true
+}
+
+func (s *TinyLFUStore) TTL(key []byte) (uint32, error) {
+	shard, _ := s.shard(key)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	now := unixTime()
+	e := s.lookup(shard, key, now)
+	if e == nil {
+		return 0, freecache.ErrNotFound
+	}
+	if e.expireAt == 0 {
+		return 0, nil
+	}
+	return e.expireAt - now, nil
+}
+
+func (s *TinyLFUStore) Touch(key []byte, expireSeconds int) error {
+	shard, _ := s.shard(key)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	e := s.lookup(shard, key, unixTime())
+	if e == nil {
+		return freecache.ErrNotFound
+	}
+	e.expireAt = absoluteExpiration(expireSeconds)
+	return nil
+}
+
+func (s *TinyLFUStore) Update(key []byte, fn UpdateFunc) (found, updated bool, err error) {
+	if len(key) > TinyLFUMaxKeySize {
+		return false, false, freecache.ErrLargeKey
+	}
+	shard, hash := s.shard(key)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	var value []byte
+	var expireAt uint32
+	e := s.lookup(shard, key, unixTime())
+	if e != nil {
+		value, expireAt = e.value, e.expireAt
+	}
+	newValue, expiration, ok := fn(value, expireAt, e != nil)
+	if !ok {
+		return e != nil, false, nil
+	}
+	if err := s.check(key, newValue); err != nil {
+		return e != nil, false, err
+	}
+	s.set(shard, key, hash, clone(newValue), absoluteExpiration(expiration))
+	return e != nil, true, nil
+}
+
+func (s *TinyLFUStore) CompareAndSwap(key []byte, version uint64, value []byte, expireSeconds int) (found, swapped bool, err error) {
+	if err := s.check(key, value); err != nil {
+		return false, false, err
+	}
+	shard, hash := s.shard(key)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	e := s.lookup(shard, key, unixTime())
+	if e == nil || e.version != version {
+		return e != nil, false, nil
+	}
+	s.set(shard, key, hash, clone(value), absoluteExpiration(expireSeconds))
+	return true, true, nil
+}
+
+// Iterate copies the entries of one shard at a time, so fn may use the store.
+func (s *TinyLFUStore) Iterate(fn func(key, value []byte, expireAt uint32) bool) {
+	type item struct {
+		key      string
+		value    []byte
+		expireAt uint32
+	}
+	var items []item
+	for i := range s.shards {
+		shard := &s.shards[i]
+		shard.mu.Lock()
+		items = items[:0]
+		for _, e := range shard.entries {
+			items = append(items, item{e.key, e.value, e.expireAt})
+		}
+		shard.mu.Unlock()
+
+		now := unixTime()
+		for _, item := range items {
+			if item.expireAt != 0 && item.expireAt <= now {
+				continue
+			}
+			if !fn([]byte(item.key), item.value, item.expireAt) {
+				return
+			}
+		}
+	}
+}
+
+func (s *TinyLFUStore) Stats() StoreStats {
+	var entries int64
+	for i := range s.shards {
+		shard := &s.shards[i]
+		shard.mu.Lock()
+		entries += int64(len(shard.entries))
+		shard.mu.Unlock()
+	}
+	return StoreStats{
+		Entries:    entries,
+		Hits:       atomic.LoadInt64(&s.hits),
+		Misses:     atomic.LoadInt64(&s.misses),
+		Evictions:  atomic.LoadInt64(&s.evictions),
+		Expired:    atomic.LoadInt64(&s.expired),
+		Overwrites: atomic.LoadInt64(&s.overwrites),
+	}
+}
+
+func (s *TinyLFUStore) Clear() {
+	for i := range s.shards {
+		shard := &s.shards[i]
+		shard.mu.Lock()
+		shard.reset()
+		shard.mu.Unlock()
+	}
+}
+
+// tinyLFUList is a doubly linked LRU queue which tracks the size of its
+// entries.
+type tinyLFUList struct {
+	root tinyLFUEntry
+	size int
+}
+
+func (l *tinyLFUList) init() {
+	l.root.next = &l.root
+	l.root.prev = &l.root
+	l.size = 0
+}
+
+func (l *tinyLFUList) pushFront(e *tinyLFUEntry) {
+	e.list = l
+	e.prev = &l.root
+	e.next = l.root.next
+	e.next.prev = e
+	l.root.next = e
+	l.size += e.size()
+}
+
+func (l *tinyLFUList) remove(e *tinyLFUEntry) {
+	e.prev.next = e.next
+	e.next.prev = e.prev
+	e.prev, e.next, e.list = nil, nil, nil
+	l.size -= e.size()
+}
+
+func (l *tinyLFUList) moveToFront(e *tinyLFUEntry) {
+	l.remove(e)
+	l.pushFront(e)
+}
+
+// back returns the least recently used entry, or nil if the list is empty.
+func (l *tinyLFUList) back() *tinyLFUEntry {
+	if l.root.prev == &l.root {
+		return nil
+	}
+	return l.root.prev
+}
+
+// countMinSketch estimates how often keys are used with four rows of 4-bit
+// counters. Once the number of increments reaches ten times the number of
+// counters, every counter is halved so that past popularity fades. A
+// doorkeeper bloom filter absorbs the first use of each key, which keeps keys
+// used only once out of the counters.
+type countMinSketch struct {
+	rows       [4][]uint64
+	doorkeeper []uint64
+	shift      uint
+	dkShift    uint
+
+	additions, sampleSize int
+}
+
+var sketchSeeds = [4]uint64{0xc3a5c85c97cb3127, 0xb492b66fbe98f273, 0x9ae16a3b2f90404f, 0xcbf29ce484222325}
+
+// newCountMinSketch creates a sketch with at least the given number of
+// counters per row.
+func newCountMinSketch(counters int) *countMinSketch {
+	bits := uint(6)
+	for 1<<bits < counters {
+		bits++
+	}
+	s := &countMinSketch{shift: 64 - bits, dkShift: 64 - (bits + 4), sampleSize: 10 << bits}
+	for i := range s.rows {
+		s.rows[i] = make([]uint64, 1<<bits/16)
+	}
+	s.doorkeeper = make([]uint64, 1<<(bits+4)/64)
+	return s
+}
+
+func (s *countMinSketch) increment(hash uint64) {
+	s.additions++
+	if s.additions >= s.sampleSize {
+		s.halve()
+	}
+
+	bit := (hash * sketchSeeds[0]) >> s.dkShift
+	bit2 := (hash * sketchSeeds[1]) >> s.dkShift
+	if s.doorkeeper[bit/64]&(1<<(bit%64)) == 0 || s.doorkeeper[bit2/64]&(1<<(bit2%64)) == 0 {
+		s.doorkeeper[bit/64] |= 1 << (bit % 64)
+		s.doorkeeper[bit2/64] |= 1 << (bit2 % 64)
+		return
+	}
+
+	// conservative update: only the smallest counters are incremented, which
+	// keeps collisions from inflating the estimates of other keys
+	var indexes [4]uint64
+	count := uint64(0xf)
+	for i, row := range s.rows {
+		indexes[i] = (hash * sketchSeeds[i]) >> s.shift
+		if c := (row[indexes[i]/16] >> ((indexes[i] % 16) * 4)) & 0xf; c < count {
+			count = c
+		}
+	}
+	if count == 0xf {
+		return
+	}
+	for i, row := range s.rows {
+		offset := (indexes[i] % 16) * 4
+		if (row[indexes[i]/16]>>offset)&0xf == count {
+			row[indexes[i]/16] += 1 << offset
+		}
+	}
+}
+
+// estimate returns the approximate number of uses of the hash.
+func (s *countMinSketch) estimate(hash uint64) int {
+	count := 0xf
+	for i, row := range s.rows {
+		index := (hash * sketchSeeds[i]) >> s.shift
+		if c := int(row[index/16]>>((index%16)*4)) & 0xf; c < count {
+			count = c
+		}
+	}
+	bit := (hash * sketchSeeds[0]) >> s.dkShift
+	bit2 := (hash * sketchSeeds[1]) >> s.dkShift
+	if s.doorkeeper[bit/64]&(1<<(bit%64)) != 0 && s.doorkeeper[bit2/64]&(1<<(bit2%64)) != 0 {
+		count++
+	}
+	return count
+}
+
+// halve divides the counters by two and empties the doorkeeper.
+func (s *countMinSketch) halve() {
+	for _, row := range s.rows {
+		for i := range row {
+			row[i] = (row[i] >> 1) & 0x7777777777777777
+		}
+	}
+	for i := range s.doorkeeper {
+		s.doorkeeper[i] = 0
+	}
+	s.additions /= 2
+}
+
+func (s *countMinSketch) clear() {
+	for _, row := range s.rows {
+		for i := range row {
+			row[i] = 0
+		}
+	}
+	for i := range s.doorkeeper {
+		s.doorkeeper[i] = 0
+	}
+	s.additions = 0
+}
+
+// hashKey is 64-bit FNV-1a followed by the MurmurHash3 finalizer, which mixes
+// the low bits of short keys into the top bits used to pick a shard.
+func hashKey(key []byte) uint64 {
+	hash := uint64(14695981039346656037)
+	for _, b := range key {
+		hash ^= uint64(b)
+		hash *= 1099511628211
+	}
+	hash ^= hash >> 33
+	hash *= 0xff51afd7ed558ccd
+	hash ^= hash >> 33
+	hash *= 0xc4ceb9fe1a85ec53
+	hash ^= hash >> 33
+	return hash
+}
+
+func clone(b []byte) []byte {
+	c := make([]byte, len(b))
+	copy(c, b)
+	return c
+}
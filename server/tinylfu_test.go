@@ -0,0 +1,160 @@
+package server
+
+import (
+	"math/rand"
+	"strconv"
+	"testing"
+
+	"github.com/coocood/freecache"
+)
+
+func TestTinyLFUStore(t *testing.T) {
+	testStore(t, NewTinyLFUStore(1024*1024))
+	testStoreUpdates(t, NewTinyLFUStore(1024*1024))
+}
+
+func TestTinyLFUStoreLimits(t *testing.T) {
+	store := NewTinyLFUStore(1024 * 1024)
+	if err := store.Set(make([]byte, TinyLFUMaxKeySize+1), nil, 0); err != freecache.ErrLargeKey {
+		t.Fatalf("expected ErrLargeKey, got %v", err)
+	}
+	if err := store.Set([]byte("key"), make([]byte, 1024), 0); err != freecache.ErrLargeEntry {
+		t.Fatalf("expected ErrLargeEntry, got %v", err)
+	}
+
+	// Writing four times the capacity keeps the store within its size
+	value := make([]byte, 512)
+	for i := 0; i < 8*1024; i++ {
+		if err := store.Set([]byte("key"+strconv.Itoa(i)), value, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stats := store.Stats()
+	if size := stats.Entries * int64(len(value)+tinyLFUEntryOverhead); size > 1024*1024 || size < 512*1024 {
+		t.Fatalf("expected about 1MB of entries, got %d bytes", size)
+	}
+	if stats.Evictions == 0 {
+		t.Fatal("expected evictions")
+	}
+}
+
+func TestTinyLFUStoreScanResistance(t *testing.T) {
+	store := NewTinyLFUStore(1024 * 1024)
+	value := make([]byte, 64)
+	hot := func(i int) []byte { return []byte("hot" + strconv.Itoa(i)) }
+	for round := 0; round < 4; round++ {
+		for i := 0; i < 1000; i++ {
+			if _, err := store.Get(hot(i)); err != nil {
+				store.Set(hot(i), value, 0)
+			}
+		}
+	}
+
+	// A scan of ten times the capacity does not flush the hot entries
+	for i := 0; i < 100000; i++ {
+		key := []byte("scan" + strconv.Itoa(i))
+		if _, err := store.Get(key); err != nil {
+			store.Set(key, value, 0)
+		}
+	}
+	missing := 0
+	for i := 0; i < 1000; i++ {
+		if _, err := store.Get(hot(i)); err != nil {
+			missing++
+		}
+	}
+	if missing > 50 {
+		t.Fatalf("%d of 1000 hot entries were evicted by the scan", missing)
+	}
+}
+
+func TestCountMinSketch(t *testing.T) {
+	sketch := newCountMinSketch(1024)
+	hash := hashKey([]byte("key"))
+	if n := sketch.estimate(hash); n != 0 {
+		t.Fatalf("expected 0, got %d", n)
+	}
+	for i := 0; i < 10; i++ {
+		sketch.increment(hash)
+	}
+	if n := sketch.estimate(hash); n != 10 {
+		t.Fatalf("expected 10, got %d", n)
+	}
+	for i := 0; i < 100; i++ {
+		sketch.increment(hash)
+	}
+	if n := sketch.estimate(hash); n != 16 {
+		t.Fatalf("expected the counters to saturate at 16, got %d", n)
+	}
+
+	// Popularity fades once the sample is full
+	for i := 0; sketch.additions < sketch.sampleSize-1; i++ {
+		sketch.increment(hashKey([]byte(strconv.Itoa(i))))
+	}
+	sketch.increment(hashKey([]byte("other")))
+	if n := sketch.estimate(hash); n != 7 && n != 8 {
+		t.Fatalf("expected the counters to be halved, got %d", n)
+	}
+}
+
+// The hit ratio benchmarks replay b.N requests of a trace through a read-through
+// cache of 4MB holding 64 byte values, and report the percentage of hits. Run
+// them with a fixed -benchtime, such as 2000000x, to compare the engines.
+
+func benchmarkHitRatio(b *testing.B, store Store, next func() []byte) {
+	value := make([]byte, 64)
+	hits := 0
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		key := next()
+		if _, err := store.Get(key); err == nil {
+			hits++
+		} else {
+			store.Set(key, value, 0)
+		}
+	}
+	b.ReportMetric(100*float64(hits)/float64(b.N), "hit%")
+}
+
+// zipfTrace draws keys from a million with a Zipfian distribution.
+func zipfTrace() func() []byte {
+	zipf := rand.NewZipf(rand.New(rand.NewSource(1)), 1.01, 1, 1<<20)
+	var key []byte
+	return func() []byte {
+		key = strconv.AppendUint(append(key[:0], "key"...), zipf.Uint64(), 10)
+		return key
+	}
+}
+
+// scanTrace alternates the Zipfian trace with scans of keys used only once.
+func scanTrace() func() []byte {
+	zipf := zipfTrace()
+	var key []byte
+	scanned := 0
+	i := 0
+	return func() []byte {
+		i++
+		if i%100000 < 50000 {
+			return zipf()
+		}
+		scanned++
+		key = strconv.AppendInt(append(key[:0], "scan"...), int64(scanned), 10)
+		return key
+	}
+}
+
+func BenchmarkHitRatioZipfFreecache(b *testing.B) {
+	benchmarkHitRatio(b, NewFreecacheStore(4*1024*1024), zipfTrace())
+}
+
+func BenchmarkHitRatioZipfTinyLFU(b *testing.B) {
+	benchmarkHitRatio(b, NewTinyLFUStore(4*1024*1024), zipfTrace())
+}
+
+func BenchmarkHitRatioScanFreecache(b *testing.B) {
+	benchmarkHitRatio(b, NewFreecacheStore(4*1024*1024), scanTrace())
+}
+
+func BenchmarkHitRatioScanTinyLFU(b *testing.B) {
+	benchmarkHitRatio(b, NewTinyLFUStore(4*1024*1024), scanTrace())
+}